@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigRevision is a previously applied configuration
+type ConfigRevision struct {
+	Revision  int       `json:"revision"`
+	Timestamp time.Time `json:"timestamp"`
+	Config    Config    `json:"config"`
+}
+
+// AuditEntry records an accepted configuration change
+type AuditEntry struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Host          string    `json:"host"`
+	Identity      string    `json:"identity"`
+	Action        string    `json:"action"`
+	ChangedFields []string  `json:"changedFields"`
+}
+
+// maxAuditEntries is the number of audit entries kept in memory for GET /patroneos/config/audit.
+const maxAuditEntries = 100
+
+var (
+	configHistory []ConfigRevision // most recent configurations, oldest first
+	nextRevision  = 1              // number given to the next recorded revision
+	auditEntries  []AuditEntry     // most recent audit entries, oldest first
+)
+
+// recordConfigRevision adds a persisted config to the history, dropping the
+// oldest revisions beyond configHistorySize.
+func recordConfigRevision(config Config) {
+	size := getConfig().ConfigHistorySize
+	if size <= 0 {
+		size = defaultConfigHistorySize
+	}
+
+	configHistory = append(configHistory, ConfigRevision{
+		Revision:  nextRevision,
+		Timestamp: time.Now().UTC(),
+		Config:    config,
+	})
+	nextRevision++
+
+	if len(configHistory) > size {
+		configHistory = configHistory[len(configHistory)-size:]
+	}
+}
+
+// getChangedFields returns the json names of the fields that differ between two configs.
+func getChangedFields(previous Config, updated Config) []string {
+	changed := []string{}
+	previousValue := reflect.ValueOf(previous)
+	updatedValue := reflect.ValueOf(updated)
+
+	for i := 0; i < previousValue.NumField(); i++ {
+		if !reflect.DeepEqual(previousValue.Field(i).Interface(), updatedValue.Field(i).Interface()) {
+			changed = append(changed, strings.Split(previousValue.Type().Field(i).Tag.Get("json"), ",")[0])
+		}
+	}
+
+	return changed
+}
+
+// getAuditLogLocation returns auditLogLocation, defaulting to patroneos-audit.log
+// in the directory of logFileLocation.
+func getAuditLogLocation(config *Config) string {
+	if config.AuditLogLocation != "" {
+		return config.AuditLogLocation
+	}
+
+	return filepath.Join(filepath.Dir(config.LogFileLocation), "patroneos-audit.log")
+}
+
+// auditConfigChange records who changed the config and which fields changed.
+// It must be called while holding configUpdateLock.
+func auditConfigChange(r *http.Request, previous Config, updated Config) {
+	config := getConfig()
+
+	identity := "anonymous"
+	if config.AdminToken != "" {
+		identity = "adminToken"
+	}
+
+	entry := AuditEntry{
+		Timestamp:     time.Now().UTC(),
+		Host:          getHost(r),
+		Identity:      identity,
+		Action:        r.Method + " " + r.URL.RequestURI(),
+		ChangedFields: getChangedFields(previous, updated),
+	}
+
+	auditEntries = append(auditEntries, entry)
+	if len(auditEntries) > maxAuditEntries {
+		auditEntries = auditEntries[len(auditEntries)-maxAuditEntries:]
+	}
+
+	body, _ := json.Marshal(entry)
+	log.Printf("Config change: %s", body)
+
+	file, err := os.OpenFile(getAuditLogLocation(config), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error opening audit log %s", err)
+		return
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(body, '\n'))
+	if err != nil {
+		log.Printf("Error writing audit log %s", err)
+	}
+}
+
+// getConfigAudit returns the most recent configuration changes.
+func getConfigAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeErrorMessage(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+
+	configUpdateLock.Lock()
+	defer configUpdateLock.Unlock()
+
+	writeJSON(w, append([]AuditEntry{}, auditEntries...))
+}
+
+// writeJSON writes a value as an indented JSON response.
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	responseBody, err := json.MarshalIndent(value, "", "    ")
+	if err != nil {
+		log.Printf("Failed to marshal response %s", err)
+		writeErrorMessage(w, "INTERNAL_ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(responseBody)
+	if err != nil {
+		log.Printf("Error writing response body %s", err)
+	}
+}
+
+// getConfigHistory returns the recorded configuration revisions.
+func getConfigHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeErrorMessage(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+
+	configUpdateLock.Lock()
+	defer configUpdateLock.Unlock()
+
+	revisions := make([]ConfigRevision, len(configHistory))
+	for i, revision := range configHistory {
+		revision.Config = redactConfig(revision.Config)
+		revisions[i] = revision
+	}
+
+	writeJSON(w, revisions)
+}
+
+// rollbackConfig restores the revision given by the rev query parameter.
+// The restored config is validated and persisted like any other update.
+func rollbackConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeErrorMessage(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+
+	revision, err := strconv.Atoi(r.URL.Query().Get("rev"))
+	if err != nil {
+		writeErrorMessage(w, "INVALID_REVISION", http.StatusBadRequest)
+		return
+	}
+
+	configUpdateLock.Lock()
+	defer configUpdateLock.Unlock()
+
+	for _, entry := range configHistory {
+		if entry.Revision != revision {
+			continue
+		}
+
+		restored, err := copyConfig(entry.Config)
+		if err != nil {
+			log.Printf("Error copying config revision %s", err)
+			writeErrorMessage(w, "INTERNAL_ERROR", http.StatusInternalServerError)
+			return
+		}
+
+		previous := fileConfig
+		err = applyConfig(restored)
+		if errs, invalid := err.(configError); invalid {
+			log.Printf("Rejected config rollback: %s", errs)
+			writeErrorMessage(w, "INVALID_CONFIG: "+errs.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("Error applying config revision %s", err)
+			writeErrorMessage(w, "INTERNAL_ERROR", http.StatusInternalServerError)
+			return
+		}
+
+		auditConfigChange(r, previous, fileConfig)
+		log.Printf("Rolled back configuration to revision %d", revision)
+		writeJSON(w, redactConfig(*getConfig()))
+		return
+	}
+
+	writeErrorMessage(w, "REVISION_NOT_FOUND", http.StatusNotFound)
+}
+
+// Stats describes the current load on patroneos
+type Stats struct {
+	InFlightRequests         int64        `json:"inFlightRequests"`
+	MaxConcurrentRequests    int          `json:"maxConcurrentRequests"`
+	UpstreamInFlightRequests int64        `json:"upstreamInFlightRequests"`
+	MaxUpstreamConcurrency   int          `json:"maxUpstreamConcurrency"`
+	QueueDepth               int64        `json:"queueDepth"`
+	MaxQueueLength           int          `json:"maxQueueLength"`
+	QueueWait                LatencyStats `json:"queueWait"`
+	UpstreamLatency          LatencyStats `json:"upstreamLatency"`
+	LogQueueDepth            int64        `json:"logQueueDepth"`
+	DroppedLogEvents         int64        `json:"droppedLogEvents"`
+	LogRetryDepth            int          `json:"logRetryDepth"`
+	SpooledLogEvents         int64        `json:"spooledLogEvents"`
+}
+
+// getStats returns the number of requests in flight, to help tune maxConcurrentRequests and maxUpstreamConcurrency,
+// the latency percentiles of nodeos over the last few minutes and the log events waiting for the relays.
+func getStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeErrorMessage(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config := getConfig()
+	writeJSON(w, Stats{
+		InFlightRequests:         clientLimiter.getInFlight(),
+		MaxConcurrentRequests:    config.MaxConcurrentRequests,
+		UpstreamInFlightRequests: upstreamLimiter.getInFlight(),
+		MaxUpstreamConcurrency:   config.MaxUpstreamConcurrency,
+		QueueDepth:               getQueueDepth(),
+		MaxQueueLength:           config.MaxQueueLength,
+		QueueWait:                upstreamQueue.wait.getStats(),
+		UpstreamLatency:          upstreamLatency.getStats(),
+		LogQueueDepth:            logEvents.getPending(),
+		DroppedLogEvents:         logEvents.getDropped(),
+		LogRetryDepth:            logRetries.getDepth(),
+		SpooledLogEvents:         logRetries.getSpooled(),
+	})
+}
+
+// getUpstreamStatus returns the health of each nodeos upstream and the number of requests it was given.
+func getUpstreamStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeErrorMessage(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, upstreams.getStatuses(getConfig()))
+}
+
+// resetUpstreamConnections closes the idle connections to nodeos, so the next requests resolve and connect again.
+func resetUpstreamConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeErrorMessage(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Printf("Closing the idle upstream connections for %s", getHost(r))
+	client.CloseIdleConnections()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getBlacklist returns the blacklisted contracts in alphabetical order.
+func getBlacklist() []string {
+	contracts := []string{}
+	for contract := range getConfig().ContractBlackList {
+		contracts = append(contracts, contract)
+	}
+	sort.Strings(contracts)
+
+	return contracts
+}
+
+// updateBlacklist lists the contract blacklist on GET /patroneos/blacklist,
+// and adds or removes a single contract on PUT and DELETE /patroneos/blacklist/{account}.
+func updateBlacklist(w http.ResponseWriter, r *http.Request) {
+	account := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/patroneos/blacklist"), "/")
+
+	if account == "" {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			writeErrorMessage(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, getBlacklist())
+		return
+	}
+
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "PUT, DELETE")
+		writeErrorMessage(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !isAccountName(account) {
+		writeErrorMessage(w, "INVALID_ACCOUNT_NAME", http.StatusBadRequest)
+		return
+	}
+
+	configUpdateLock.Lock()
+	defer configUpdateLock.Unlock()
+
+	newConfig, err := copyConfig(fileConfig)
+	if err != nil {
+		log.Printf("Error copying current config %s", err)
+		writeErrorMessage(w, "INTERNAL_ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "PUT" {
+		if newConfig.ContractBlackList == nil {
+			newConfig.ContractBlackList = make(map[string]bool)
+		}
+		newConfig.ContractBlackList[account] = true
+	} else {
+		if _, exists := newConfig.ContractBlackList[account]; !exists {
+			writeErrorMessage(w, "ACCOUNT_NOT_FOUND", http.StatusNotFound)
+			return
+		}
+		delete(newConfig.ContractBlackList, account)
+	}
+
+	previous := fileConfig
+	err = applyConfig(newConfig)
+	if errs, invalid := err.(configError); invalid {
+		log.Printf("Rejected blacklist update: %s", errs)
+		writeErrorMessage(w, "INVALID_CONFIG: "+errs.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error applying blacklist update %s", err)
+		writeErrorMessage(w, "INTERNAL_ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	auditConfigChange(r, previous, fileConfig)
+	log.Printf("Blacklist %s %s", strings.ToLower(r.Method), account)
+	writeJSON(w, getBlacklist())
+}
+
+// updateMaintenanceMode reports maintenanceMode on GET /patroneos/maintenance, and turns it
+// on with PUT and off with DELETE. The change is persisted like any other config update.
+func updateMaintenanceMode(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		writeJSON(w, map[string]bool{"maintenanceMode": getConfig().MaintenanceMode})
+		return
+	}
+
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeErrorMessage(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+
+	configUpdateLock.Lock()
+	defer configUpdateLock.Unlock()
+
+	newConfig, err := copyConfig(fileConfig)
+	if err != nil {
+		log.Printf("Error copying current config %s", err)
+		writeErrorMessage(w, "INTERNAL_ERROR", http.StatusInternalServerError)
+		return
+	}
+	newConfig.MaintenanceMode = r.Method == "PUT"
+
+	previous := fileConfig
+	err = applyConfig(newConfig)
+	if errs, invalid := err.(configError); invalid {
+		log.Printf("Rejected maintenance mode update: %s", errs)
+		writeErrorMessage(w, "INVALID_CONFIG: "+errs.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error applying maintenance mode update %s", err)
+		writeErrorMessage(w, "INTERNAL_ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	auditConfigChange(r, previous, fileConfig)
+	log.Printf("Maintenance mode %t", newConfig.MaintenanceMode)
+	writeJSON(w, map[string]bool{"maintenanceMode": getConfig().MaintenanceMode})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func resetConfigHistory() {
+	configHistory = nil
+	nextRevision = 1
+}
+
+func TestConfigHistoryRollback(t *testing.T) {
+	defer setConfigFile(t, getValidConfig())()
+	resetConfigHistory()
+	recordConfigRevision(fileConfig)
+
+	for _, body := range []string{`{"maxSignatures": 5}`, `{"maxSignatures": 7}`} {
+		updateConfig(httptest.NewRecorder(), httptest.NewRequest("PATCH", "/patroneos/config", bytes.NewBufferString(body)))
+	}
+
+	recorder := httptest.NewRecorder()
+	getConfigHistory(recorder, httptest.NewRequest("GET", "/patroneos/config/history", nil))
+
+	var revisions []ConfigRevision
+	json.Unmarshal(recorder.Body.Bytes(), &revisions)
+
+	if len(revisions) != 3 || revisions[1].Config.MaxSignatures != 5 || revisions[2].Config.MaxSignatures != 7 {
+		t.Fatalf("Expected three revisions and got %+v.", revisions)
+	}
+
+	recorder = httptest.NewRecorder()
+	rollbackConfig(recorder, httptest.NewRequest("POST", "/patroneos/config/rollback?rev=2", nil))
+
+	if recorder.Code != http.StatusOK || getConfig().MaxSignatures != 5 || readConfigFile(t).MaxSignatures != 5 {
+		t.Errorf("Expected rollback to restore revision 2 and got %d %+v.", recorder.Code, getConfig())
+	}
+
+	if len(configHistory) != 4 {
+		t.Errorf("Expected the rollback to be recorded as a new revision and got %d revisions.", len(configHistory))
+	}
+
+	tests := []struct {
+		url          string
+		expectedCode int
+	}{
+		{"/patroneos/config/rollback?rev=99", http.StatusNotFound},
+		{"/patroneos/config/rollback?rev=latest", http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		recorder = httptest.NewRecorder()
+		rollbackConfig(recorder, httptest.NewRequest("POST", tc.url, nil))
+
+		if recorder.Code != tc.expectedCode {
+			t.Errorf("Expected %s to return %d and got %d.", tc.url, tc.expectedCode, recorder.Code)
+		}
+	}
+}
+
+func TestConfigHistorySize(t *testing.T) {
+	defer setConfigFile(t, getValidConfig())()
+	resetConfigHistory()
+	config := getValidConfig()
+	config.ConfigHistorySize = 2
+	storeConfig(config)
+
+	for i := 0; i < 5; i++ {
+		recordConfigRevision(fileConfig)
+	}
+
+	if len(configHistory) != 2 || configHistory[0].Revision != 4 {
+		t.Errorf("Expected only the last two revisions to be kept and got %+v.", configHistory)
+	}
+}
+
+func TestUpdateBlacklist(t *testing.T) {
+	config := getValidConfig()
+	config.ContractBlackList = map[string]bool{"currency": true}
+	defer setConfigFile(t, config)()
+
+	tests := []struct {
+		method       string
+		url          string
+		expectedCode int
+		expectedList []string
+	}{
+		{"PUT", "/patroneos/blacklist/spamcoin1", http.StatusOK, []string{"currency", "spamcoin1"}},
+		{"PUT", "/patroneos/blacklist/Not-Valid", http.StatusBadRequest, nil},
+		{"DELETE", "/patroneos/blacklist/currency", http.StatusOK, []string{"spamcoin1"}},
+		{"DELETE", "/patroneos/blacklist/currency", http.StatusNotFound, nil},
+		{"GET", "/patroneos/blacklist", http.StatusOK, []string{"spamcoin1"}},
+		{"POST", "/patroneos/blacklist", http.StatusMethodNotAllowed, nil},
+	}
+
+	for _, tc := range tests {
+		recorder := httptest.NewRecorder()
+		updateBlacklist(recorder, httptest.NewRequest(tc.method, tc.url, nil))
+
+		if recorder.Code != tc.expectedCode {
+			t.Errorf("Expected %s %s to return %d and got %d.", tc.method, tc.url, tc.expectedCode, recorder.Code)
+		}
+
+		if tc.expectedList != nil {
+			var list []string
+			json.Unmarshal(recorder.Body.Bytes(), &list)
+
+			if !reflect.DeepEqual(list, tc.expectedList) {
+				t.Errorf("Expected %s %s to return %v and got %v.", tc.method, tc.url, tc.expectedList, list)
+			}
+		}
+	}
+
+	saved := readConfigFile(t)
+	if !reflect.DeepEqual(saved.ContractBlackList, map[string]bool{"spamcoin1": true}) || !reflect.DeepEqual(getConfig().ContractBlackList, saved.ContractBlackList) {
+		t.Errorf("Expected the blacklist changes to be applied and persisted and got %v.", saved.ContractBlackList)
+	}
+}
+
+func TestUpdateMaintenanceMode(t *testing.T) {
+	defer setConfigFile(t, getValidConfig())()
+
+	ts := httptest.NewServer(rejectInMaintenance(getTestHandler()))
+	defer ts.Close()
+
+	tests := []struct {
+		method       string
+		expectedCode int
+		enabled      bool
+	}{
+		{"PUT", http.StatusOK, true},
+		{"GET", http.StatusOK, true},
+		{"DELETE", http.StatusOK, false},
+		{"POST", http.StatusMethodNotAllowed, false},
+	}
+
+	for _, tc := range tests {
+		recorder := httptest.NewRecorder()
+		updateMaintenanceMode(recorder, httptest.NewRequest(tc.method, "/patroneos/maintenance", nil))
+
+		if recorder.Code != tc.expectedCode {
+			t.Errorf("Expected %s to return %d and got %d.", tc.method, tc.expectedCode, recorder.Code)
+		}
+		if getConfig().MaintenanceMode != tc.enabled {
+			t.Errorf("Expected maintenance mode to be %t after %s.", tc.enabled, tc.method)
+		}
+
+		// Writes are rejected while reads still pass
+		res, _ := http.Post(ts.URL+"/v1/chain/push_transaction", "application/json", bytes.NewBufferString("{}"))
+		if expected := map[bool]int{true: 503, false: 200}[tc.enabled]; res.StatusCode != expected {
+			t.Errorf("Expected push_transaction to return %d after %s and got %d.", expected, tc.method, res.StatusCode)
+		}
+		res.Body.Close()
+
+		res, _ = http.Get(ts.URL + "/v1/chain/get_info")
+		if res.StatusCode != 200 {
+			t.Errorf("Expected get_info to return 200 after %s and got %d.", tc.method, res.StatusCode)
+		}
+		res.Body.Close()
+	}
+
+	updateMaintenanceMode(httptest.NewRecorder(), httptest.NewRequest("PUT", "/patroneos/maintenance", nil))
+	if saved := readConfigFile(t); !saved.MaintenanceMode {
+		t.Errorf("Expected maintenance mode to be persisted.")
+	}
+
+	config := *getConfig()
+	config.MaintenancePaths = []string{"/v1/chain/get_*"}
+	storeConfig(config)
+
+	res, _ := http.Get(ts.URL + "/v1/chain/get_info")
+	if res.StatusCode != 503 {
+		t.Errorf("Expected maintenancePaths to be rejected and got %d.", res.StatusCode)
+	}
+	res.Body.Close()
+}
+
+func TestConfigAudit(t *testing.T) {
+	config := getValidConfig()
+	config.AdminToken = "secret"
+	config.TrustedProxies = []string{"192.0.2.1"}
+	defer setConfigFile(t, config)()
+	auditEntries = nil
+
+	req := httptest.NewRequest("PATCH", "/patroneos/config", bytes.NewBufferString(`{"maxSignatures": 5, "contractBlackList": {"spam": true}}`))
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	updateConfig(httptest.NewRecorder(), req)
+	updateBlacklist(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/patroneos/blacklist/spam", nil))
+
+	recorder := httptest.NewRecorder()
+	getConfigAudit(recorder, httptest.NewRequest("GET", "/patroneos/config/audit", nil))
+
+	var entries []AuditEntry
+	json.Unmarshal(recorder.Body.Bytes(), &entries)
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected two audit entries and got %+v.", entries)
+	}
+
+	if entries[0].Host != "10.0.0.1" || entries[0].Identity != "adminToken" || entries[0].Action != "PATCH /patroneos/config" {
+		t.Errorf("Expected the audit entry to identify the request and got %+v.", entries[0])
+	}
+
+	if !reflect.DeepEqual(entries[0].ChangedFields, []string{"contractBlackList", "maxSignatures"}) {
+		t.Errorf("Expected the changed fields to be recorded and got %v.", entries[0].ChangedFields)
+	}
+
+	if !reflect.DeepEqual(entries[1].ChangedFields, []string{"contractBlackList"}) {
+		t.Errorf("Expected the blacklist change to be recorded and got %v.", entries[1].ChangedFields)
+	}
+
+	body, _ := ioutil.ReadFile(getAuditLogLocation(getConfig()))
+	if lines := strings.Count(string(body), "\n"); lines != 2 {
+		t.Errorf("Expected two lines in the audit log and got %d.", lines)
+	}
+}
+
+func TestResetUpstreamConnections(t *testing.T) {
+	var connections int32
+	upstream := httptest.NewUnstartedServer(getTestHandler())
+	upstream.Config.ConnState = func(connection net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	storeConfig(config)
+	defer setConfig()
+	resetUpstreams()
+
+	forward := func() {
+		request := httptest.NewRequest("GET", "/v1/chain/get_info", nil)
+		_, ctx := getParsedBody(request)
+		forwardCallToNodeos(httptest.NewRecorder(), request.WithContext(ctx))
+	}
+
+	forward()
+	forward()
+	if count := atomic.LoadInt32(&connections); count != 1 {
+		t.Fatalf("Expected the connection to nodeos to be reused and got %d connections.", count)
+	}
+
+	mux := http.NewServeMux()
+	addAdminHandlers(mux)
+	for _, path := range []string{"/patroneos/upstream/reset", "/patroneos/upstreams/reset"} {
+		if _, pattern := mux.Handler(httptest.NewRequest("POST", path, nil)); pattern != path {
+			t.Errorf("Expected %s to be registered and got %q.", path, pattern)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	resetUpstreamConnections(recorder, httptest.NewRequest("GET", "/patroneos/upstream/reset", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be rejected and got %d.", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	resetUpstreamConnections(recorder, httptest.NewRequest("POST", "/patroneos/upstream/reset", nil))
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected the connections to be reset and got %d.", recorder.Code)
+	}
+
+	forward()
+	if count := atomic.LoadInt32(&connections); count != 2 {
+		t.Errorf("Expected a new connection after the reset and got %d connections.", count)
+	}
+}
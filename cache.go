@@ -0,0 +1,148 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheTTLMs      = 1000
+	defaultCacheMaxEntries = 1000
+	// maxCachedResponseBytes bounds a single cached response. Larger responses are relayed but not cached.
+	maxCachedResponseBytes = 1024 * 1024
+	// cacheHeader tells clients whether a response to a cached path came from the cache.
+	cacheHeader = "X-Patroneos-Cache"
+)
+
+// cachedResponse is a nodeos response kept for the requests that follow within cacheTtlMs.
+type cachedResponse struct {
+	key        string
+	expires    time.Time
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+// responseCache keeps up to cacheMaxEntries responses. Entries are kept in the order they were stored,
+// so the oldest is evicted first when the cache is full.
+type responseCache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   list.List
+}
+
+// responses caches the nodeos responses to the paths listed in cachePaths.
+var responses = responseCache{entries: map[string]*list.Element{}}
+
+// isCacheable reports whether the response to a request can be cached. Only the paths listed in
+// cachePaths are, and never the push endpoints.
+func isCacheable(config *Config, r *http.Request) bool {
+	if len(config.CachePaths) == 0 || isPushEndpoint(r) || (r.Method != "GET" && r.Method != "POST") {
+		return false
+	}
+
+	requestPath := path.Clean("/" + r.URL.Path)
+	for _, cachedPath := range config.CachePaths {
+		if requestPath == cachedPath {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getCacheKey identifies a request by its method, path, query and body. Accept-Encoding is part
+// of the key so a compressed response is only returned to clients that asked for one.
+func getCacheKey(r *http.Request, body []byte) string {
+	hash := sha256.Sum256(body)
+	return r.Method + " " + r.URL.EscapedPath() + "?" + r.URL.RawQuery + " " + r.Header.Get("Accept-Encoding") + " " + hex.EncodeToString(hash[:])
+}
+
+func getCacheTTL(config *Config) time.Duration {
+	if config.CacheTTLMs > 0 {
+		return time.Duration(config.CacheTTLMs) * time.Millisecond
+	}
+
+	return defaultCacheTTLMs * time.Millisecond
+}
+
+func getCacheMaxEntries(config *Config) int {
+	if config.CacheMaxEntries > 0 {
+		return config.CacheMaxEntries
+	}
+
+	return defaultCacheMaxEntries
+}
+
+// get returns the cached response to a key, or nil when there is none or it expired.
+func (cache *responseCache) get(key string) *cachedResponse {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, exists := cache.entries[key]
+	if !exists {
+		return nil
+	}
+
+	response := element.Value.(*cachedResponse)
+	if time.Now().After(response.expires) {
+		cache.remove(element)
+		return nil
+	}
+
+	return response
+}
+
+// store caches a response for cacheTtlMs, evicting the oldest entries to stay within cacheMaxEntries.
+func (cache *responseCache) store(config *Config, response *cachedResponse) {
+	response.expires = time.Now().Add(getCacheTTL(config))
+	maxEntries := getCacheMaxEntries(config)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, exists := cache.entries[response.key]; exists {
+		cache.remove(element)
+	}
+	for cache.order.Len() >= maxEntries {
+		cache.remove(cache.order.Front())
+	}
+
+	cache.entries[response.key] = cache.order.PushBack(response)
+}
+
+// remove drops an entry. The mutex must be held.
+func (cache *responseCache) remove(element *list.Element) {
+	delete(cache.entries, element.Value.(*cachedResponse).key)
+	cache.order.Remove(element)
+}
+
+// size returns the number of cached responses, including expired ones that were not evicted yet.
+func (cache *responseCache) size() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cache.order.Len()
+}
+
+// cacheCapture keeps a copy of a response body as it is relayed, up to maxCachedResponseBytes.
+type cacheCapture struct {
+	body     []byte
+	overflow bool
+}
+
+func (capture *cacheCapture) Write(data []byte) (int, error) {
+	if !capture.overflow && len(capture.body)+len(data) <= maxCachedResponseBytes {
+		capture.body = append(capture.body, data...)
+	} else {
+		capture.overflow = true
+		capture.body = nil
+	}
+
+	return len(data), nil
+}
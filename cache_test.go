@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetCache forgets the responses cached by previous tests.
+func resetCache() {
+	responses.mutex.Lock()
+	responses.entries = map[string]*list.Element{}
+	responses.order.Init()
+	responses.mutex.Unlock()
+}
+
+func TestResponseCache(t *testing.T) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"head_block_num":` + strconv.Itoa(int(atomic.LoadInt32(&requests))) + `}`))
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	config.CachePaths = []string{"/v1/chain/get_info", "/v1/chain/get_block"}
+	config.CacheTTLMs = 100
+	storeConfig(config)
+	defer setConfig()
+	resetUpstreams()
+	resetCache()
+
+	forward := func(url string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", url, bytes.NewBufferString(body))
+		_, ctx := getParsedBody(request)
+		recorder := httptest.NewRecorder()
+		forwardCallToNodeos(recorder, request.WithContext(ctx))
+		return recorder
+	}
+
+	first := forward("/v1/chain/get_info", "")
+	second := forward("/v1/chain/get_info", "")
+	if requests != 1 {
+		t.Errorf("Expected nodeos to be called once and got %d requests.", requests)
+	}
+	if first.Header().Get(cacheHeader) != "MISS" || second.Header().Get(cacheHeader) != "HIT" {
+		t.Errorf("Expected a MISS then a HIT and got %q and %q.", first.Header().Get(cacheHeader), second.Header().Get(cacheHeader))
+	}
+	if second.Body.String() != first.Body.String() || second.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected the cached response to match the first one and got %s.", second.Body.String())
+	}
+
+	// Requests with another body are cached separately
+	forward("/v1/chain/get_block", `{"block_num_or_id":1}`)
+	forward("/v1/chain/get_block", `{"block_num_or_id":2}`)
+	if hit := forward("/v1/chain/get_block", `{"block_num_or_id":1}`); hit.Header().Get(cacheHeader) != "HIT" || requests != 3 {
+		t.Errorf("Expected each block to be cached and got %q after %d requests.", hit.Header().Get(cacheHeader), requests)
+	}
+
+	// Paths that are not listed are never cached
+	forward("/v1/chain/get_account", `{"account_name":"eosio"}`)
+	if recorder := forward("/v1/chain/get_account", `{"account_name":"eosio"}`); recorder.Header().Get(cacheHeader) != "" || requests != 5 {
+		t.Errorf("Expected get_account to bypass the cache and got %q after %d requests.", recorder.Header().Get(cacheHeader), requests)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if recorder := forward("/v1/chain/get_info", ""); recorder.Header().Get(cacheHeader) != "MISS" || requests != 6 {
+		t.Errorf("Expected the cached response to expire and got %q after %d requests.", recorder.Header().Get(cacheHeader), requests)
+	}
+}
+
+func TestResponseCacheSize(t *testing.T) {
+	setConfig()
+	config := *getConfig()
+	config.CacheMaxEntries = 10
+	defer resetCache()
+	resetCache()
+
+	var wait sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			key := strconv.Itoa(i)
+			responses.store(&config, &cachedResponse{key: key, statusCode: 200, body: []byte(key)})
+			responses.get(key)
+		}(i)
+	}
+	wait.Wait()
+
+	if size := responses.size(); size != 10 {
+		t.Errorf("Expected the cache to be bounded to 10 entries and got %d.", size)
+	}
+
+	responses.store(&config, &cachedResponse{key: "latest", statusCode: 200})
+	if responses.get("latest") == nil || responses.size() != 10 {
+		t.Errorf("Expected the oldest entry to be evicted for the latest one.")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// defaultCORSAllowedHeaders are the request headers allowed when corsAllowedHeaders is not set.
+// Content-Type is needed for browsers to POST JSON.
+var defaultCORSAllowedHeaders = []string{"Content-Type"}
+
+// isCORSEnabled reports whether patroneos handles CORS itself.
+func isCORSEnabled(config *Config) bool {
+	return len(config.CORSAllowedOrigins) > 0
+}
+
+// getAllowedOrigin returns the Access-Control-Allow-Origin value for the origin, or "" when
+// it is not in corsAllowedOrigins. "*" allows any origin.
+func getAllowedOrigin(config *Config, origin string) string {
+	for _, allowed := range config.CORSAllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+
+	return ""
+}
+
+// validateCORSOrigin checks that an entry of corsAllowedOrigins is "*" or a scheme and host, such as https://example.com.
+func validateCORSOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+	return err == nil && parsed.Scheme != "" && parsed.Host != "" && parsed.Path == "" && parsed.RawQuery == ""
+}
+
+// removeCORSHeaders removes the access control headers nodeos may have set, so only ours are sent.
+func removeCORSHeaders(headers http.Header) {
+	for header := range headers {
+		if strings.HasPrefix(header, "Access-Control-") {
+			headers.Del(header)
+		}
+	}
+}
+
+// setCORSHeaders sets the access control headers of a response to an allowed origin.
+// It does nothing when CORS is disabled or the origin is not allowed.
+func setCORSHeaders(headers http.Header, r *http.Request) {
+	config := getConfig()
+	origin := r.Header.Get("Origin")
+	if !isCORSEnabled(config) || origin == "" {
+		return
+	}
+
+	removeCORSHeaders(headers)
+	if !strings.Contains(strings.Join(headers["Vary"], ","), "Origin") {
+		headers.Add("Vary", "Origin")
+	}
+	if allowed := getAllowedOrigin(config, origin); allowed != "" {
+		headers.Set("Access-Control-Allow-Origin", allowed)
+	}
+}
+
+// writePreflight answers a CORS preflight request without forwarding it to nodeos.
+func writePreflight(w http.ResponseWriter, r *http.Request) {
+	config := getConfig()
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		allowedHeaders := config.CORSAllowedHeaders
+		if len(allowedHeaders) == 0 {
+			allowedHeaders = defaultCORSAllowedHeaders
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(getAllowedMethods(config, path.Clean("/"+r.URL.Path)), ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(allowedHeaders, ", "))
+		if config.CORSMaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(config.CORSMaxAge))
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCORS adds the CORS headers to every response, including rejections, so browsers can read them.
+// Preflight requests are answered by patroneos once the path and method checks pass.
+// It is skipped when corsAllowedOrigins is not configured.
+func handleCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		if !isCORSEnabled(config) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setCORSHeaders(w.Header(), r)
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			access := []middleware{validatePath, validateMethod}
+			if config.AuditMode {
+				access = auditMiddlewares(access)
+			}
+
+			chainMiddleware(access...)(writePreflight)(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func setCORSConfig(origins []string) {
+	setConfig()
+	config := *getConfig()
+	config.CORSAllowedOrigins = origins
+	config.CORSMaxAge = 600
+	storeConfig(config)
+}
+
+func sendCORSRequest(t *testing.T, ts *httptest.Server, method string, url string, origin string, body string) (*http.Response, string) {
+	request, _ := http.NewRequest(method, ts.URL+url, bytes.NewBufferString(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Origin", origin)
+	if method == "OPTIONS" {
+		request.Header.Set("Access-Control-Request-Method", "POST")
+	}
+
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("There should not be a server error.")
+	}
+	defer res.Body.Close()
+
+	b, _ := ioutil.ReadAll(res.Body)
+	return res, string(b)
+}
+
+func TestCORSPreflight(t *testing.T) {
+	ts := httptest.NewServer(handleCORS(configuredMiddleware(getTestHandler())))
+	defer ts.Close()
+
+	setCORSConfig([]string{"https://dapp.example.com"})
+
+	res, body := sendCORSRequest(t, ts, "OPTIONS", "/v1/chain/push_transaction", "https://dapp.example.com", "")
+	if res.StatusCode != 204 || body != "" {
+		t.Errorf("Expected the preflight to be answered by patroneos and got %d %s.", res.StatusCode, body)
+	}
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "https://dapp.example.com" {
+		t.Errorf("Expected the origin to be allowed and got %q.", origin)
+	}
+	if methods := res.Header.Get("Access-Control-Allow-Methods"); methods != "GET, POST" {
+		t.Errorf("Expected GET, POST to be allowed and got %q.", methods)
+	}
+	if headers := res.Header.Get("Access-Control-Allow-Headers"); headers != "Content-Type" {
+		t.Errorf("Expected Content-Type to be allowed and got %q.", headers)
+	}
+	if maxAge := res.Header.Get("Access-Control-Max-Age"); maxAge != "600" {
+		t.Errorf("Expected a max age of 600 and got %q.", maxAge)
+	}
+
+	// The rejection of the actual request carries the headers so the browser can read it
+	res, body = sendCORSRequest(t, ts, "POST", "/v1/chain/push_transaction", "https://dapp.example.com", `{"actions": [{"code": "currency"}]}`)
+	if res.StatusCode != 403 || body != "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}" {
+		t.Errorf("Expected the blacklisted contract to be rejected and got %d %s.", res.StatusCode, body)
+	}
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "https://dapp.example.com" {
+		t.Errorf("Expected the rejection to allow the origin and got %q.", origin)
+	}
+
+	res, _ = sendCORSRequest(t, ts, "OPTIONS", "/v1/chain/push_transaction", "https://evil.example.com", "")
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); res.StatusCode != 204 || origin != "" {
+		t.Errorf("Expected other origins not to be allowed and got %d %q.", res.StatusCode, origin)
+	}
+
+	setCORSConfig([]string{"*"})
+	res, _ = sendCORSRequest(t, ts, "OPTIONS", "/v1/chain/push_transaction", "https://evil.example.com", "")
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("Expected any origin to be allowed and got %q.", origin)
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	ts := httptest.NewServer(handleCORS(configuredMiddleware(getTestHandler())))
+	defer ts.Close()
+
+	setConfig()
+
+	// Preflights are forwarded to nodeos as before
+	res, body := sendCORSRequest(t, ts, "OPTIONS", "/v1/chain/get_info", "https://dapp.example.com", "")
+	if res.StatusCode != 200 || body != "SUCCESS\n" {
+		t.Errorf("Expected the preflight to be forwarded and got %d %s.", res.StatusCode, body)
+	}
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Expected no CORS headers and got %q.", origin)
+	}
+}
+
+func TestCORSReplacesNodeosHeaders(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Access-Control-Allow-Origin", "*")
+	headers.Set("Access-Control-Allow-Credentials", "true")
+
+	setCORSConfig([]string{"https://dapp.example.com"})
+
+	request := httptest.NewRequest("POST", "/v1/chain/get_info", nil)
+	request.Header.Set("Origin", "https://dapp.example.com")
+	setCORSHeaders(headers, request)
+	setCORSHeaders(headers, request)
+
+	if origin := headers.Get("Access-Control-Allow-Origin"); origin != "https://dapp.example.com" {
+		t.Errorf("Expected the configured origin and got %q.", origin)
+	}
+	if credentials := headers.Get("Access-Control-Allow-Credentials"); credentials != "" {
+		t.Errorf("Expected the nodeos headers to be removed and got %q.", credentials)
+	}
+	if vary := headers["Vary"]; len(vary) != 1 {
+		t.Errorf("Expected a single Vary header and got %v.", vary)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultDedupCacheSize is the number of transactions remembered when dedupCacheSize is not set.
+const defaultDedupCacheSize = 10000
+
+// dedupEntry is a transaction hash and when it was first seen
+type dedupEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+// dedupCache remembers recently seen transactions, evicting the least recently
+// seen ones beyond its size and any that are older than the window.
+type dedupCache struct {
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // most recently seen first
+}
+
+func newDedupCache() *dedupCache {
+	return &dedupCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// seen reports whether any of the keys was seen within the window. If none was,
+// they are all recorded so later copies are detected.
+func (cache *dedupCache) seen(keys []string, window time.Duration, size int, now time.Time) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.expire(window, now)
+
+	for _, key := range keys {
+		if _, exists := cache.entries[key]; exists {
+			return true
+		}
+	}
+
+	for _, key := range keys {
+		cache.entries[key] = cache.order.PushFront(&dedupEntry{key: key, seenAt: now})
+	}
+
+	for cache.order.Len() > size {
+		cache.remove(cache.order.Back())
+	}
+
+	return false
+}
+
+// expire removes the entries seen before the window.
+func (cache *dedupCache) expire(window time.Duration, now time.Time) {
+	for element := cache.order.Back(); element != nil; element = cache.order.Back() {
+		if now.Sub(element.Value.(*dedupEntry).seenAt) < window {
+			return
+		}
+		cache.remove(element)
+	}
+}
+
+func (cache *dedupCache) remove(element *list.Element) {
+	cache.order.Remove(element)
+	delete(cache.entries, element.Value.(*dedupEntry).key)
+}
+
+// forget removes the keys, so the transactions they belong to can be sent again.
+func (cache *dedupCache) forget(keys []string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for _, key := range keys {
+		if element, exists := cache.entries[key]; exists {
+			cache.remove(element)
+		}
+	}
+}
+
+// flush removes every entry.
+func (cache *dedupCache) flush() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.entries = make(map[string]*list.Element)
+	cache.order.Init()
+}
+
+// len returns the number of remembered transactions.
+func (cache *dedupCache) len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.order.Len()
+}
+
+// transactionCache holds the transactions seen by validateDuplicate.
+var transactionCache = newDedupCache()
+
+// getTransactionKey hashes the signatures and body of a transaction.
+func getTransactionKey(transaction Transaction) (string, error) {
+	body, err := json.Marshal(transaction)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// dedupWriter records the status code of the response to a transaction checked by validateDuplicate.
+type dedupWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (writer *dedupWriter) WriteHeader(statusCode int) {
+	if writer.statusCode == 0 {
+		writer.statusCode = statusCode
+	}
+	writer.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (writer *dedupWriter) Write(body []byte) (int, error) {
+	if writer.statusCode == 0 {
+		writer.statusCode = http.StatusOK
+	}
+	return writer.ResponseWriter.Write(body)
+}
+
+// accepted reports whether the transaction got a 2xx response, from nodeos or a later middleware.
+func (writer *dedupWriter) accepted() bool {
+	return writer.statusCode >= 200 && writer.statusCode < 300
+}
+
+// validateDuplicate rejects signed transactions sent to the push endpoints that were
+// already seen within the last dedupWindowSeconds.
+// Transactions are remembered while they are forwarded, so concurrent copies are rejected too,
+// and forgotten again unless they get a 2xx response, so a client can retry after a rejection or an upstream failure.
+// It is skipped if dedupWindowSeconds is not configured, or set to 0.
+func validateDuplicate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		config := getConfig()
+		if config.DedupWindowSeconds <= 0 || !isPushEndpoint(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		transactions, ctx, err := getTransactions(r)
+		if err != nil {
+			logError(err, w, r)
+			return
+		}
+
+		keys := []string{}
+		for _, transaction := range transactions {
+			if len(transaction.Signatures) == 0 {
+				continue
+			}
+
+			key, err := getTransactionKey(transaction)
+			if err != nil {
+				logFailure("PARSE_ERROR", w, r, 0)
+				return
+			}
+			keys = append(keys, key)
+		}
+
+		size := config.DedupCacheSize
+		if size <= 0 {
+			size = defaultDedupCacheSize
+		}
+
+		window := time.Duration(config.DedupWindowSeconds) * time.Second
+		if transactionCache.seen(keys, window, size, time.Now()) {
+			logFailure("DUPLICATE_TRANSACTION", w, r, http.StatusConflict)
+			return
+		}
+
+		// In audit mode the response is written past this middleware, so the transaction stays remembered
+		if _, auditing := w.(*auditWriter); auditing {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		writer := &dedupWriter{ResponseWriter: w}
+		defer func() {
+			if !writer.accepted() {
+				transactionCache.forget(keys)
+			}
+		}()
+
+		next.ServeHTTP(writer, r.WithContext(ctx))
+	}
+}
+
+// flushDedupCache clears the duplicate transaction cache on DELETE /patroneos/dedup.
+func flushDedupCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		writeErrorMessage(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+
+	transactionCache.flush()
+	w.WriteHeader(http.StatusNoContent)
+}
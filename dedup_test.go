@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	cache := newDedupCache()
+	now := time.Now()
+
+	if cache.seen([]string{"a"}, time.Minute, 2, now) {
+		t.Errorf("Expected a new key not to be seen.")
+	}
+	if !cache.seen([]string{"a"}, time.Minute, 2, now.Add(time.Second)) {
+		t.Errorf("Expected a repeated key to be seen.")
+	}
+
+	// Entries expire after the window
+	if cache.seen([]string{"a"}, time.Minute, 2, now.Add(2*time.Minute)) {
+		t.Errorf("Expected an expired key not to be seen.")
+	}
+
+	// The oldest entries are evicted beyond the size
+	cache.seen([]string{"b"}, time.Minute, 2, now.Add(2*time.Minute))
+	cache.seen([]string{"c"}, time.Minute, 2, now.Add(2*time.Minute))
+	if cache.len() != 2 {
+		t.Errorf("Expected 2 entries and got %d.", cache.len())
+	}
+	if cache.seen([]string{"a"}, time.Minute, 2, now.Add(2*time.Minute)) {
+		t.Errorf("Expected an evicted key not to be seen.")
+	}
+
+	cache.forget([]string{"c"})
+	if cache.len() != 1 || cache.seen([]string{"c"}, time.Minute, 2, now.Add(2*time.Minute)) {
+		t.Errorf("Expected a forgotten key not to be seen.")
+	}
+
+	cache.flush()
+	if cache.len() != 0 {
+		t.Errorf("Expected the cache to be empty after a flush and got %d entries.", cache.len())
+	}
+}
+
+func TestDedupCacheConcurrency(t *testing.T) {
+	cache := newDedupCache()
+	now := time.Now()
+
+	var wait sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			cache.seen([]string{strconv.Itoa(i % 10)}, time.Minute, 20, now)
+		}(i)
+	}
+	wait.Wait()
+
+	if cache.len() != 10 {
+		t.Errorf("Expected 10 entries and got %d.", cache.len())
+	}
+}
+
+func TestValidateDuplicate(t *testing.T) {
+	body := []byte(`{"signatures": ["SIG_K1_test"], "actions": [{"code": "tokens"}]}`)
+	tests := []TestStruct{
+		{
+			description:  "first",
+			url:          "/v1/chain/push_transaction",
+			body:         body,
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "duplicate",
+			url:          "/v1/chain/push_transaction",
+			body:         body,
+			expectedBody: "{\"message\":\"DUPLICATE_TRANSACTION\",\"code\":409}",
+			expectedCode: 409,
+		},
+		{
+			description:  "different signature",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"signatures": ["SIG_K1_other"], "actions": [{"code": "tokens"}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "not a push endpoint",
+			url:          "/v1/chain/get_info",
+			body:         body,
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateDuplicate(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.DedupWindowSeconds = 60
+	storeConfig(config)
+	transactionCache.flush()
+	defer transactionCache.flush()
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	recorder := httptest.NewRecorder()
+	flushDedupCache(recorder, httptest.NewRequest("DELETE", "/patroneos/dedup", nil))
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status code to be %d and got %d.", http.StatusNoContent, recorder.Code)
+	}
+
+	verifyMiddleware(t, ts, tests[0])
+}
+
+func TestValidateDuplicateRetry(t *testing.T) {
+	var lock sync.Mutex
+	relayed := []string{}
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Log
+		json.NewDecoder(r.Body).Decode(&event)
+		lock.Lock()
+		relayed = append(relayed, event.Message)
+		lock.Unlock()
+	}))
+	defer relay.Close()
+
+	// The upstream fails the first push and accepts the next one
+	var pushes int32
+	ts := httptest.NewServer(validateDuplicate(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&pushes, 1) == 1 {
+			logUpstreamFailure(errors.New("connection refused"), w, r)
+			return
+		}
+		w.Write([]byte("SUCCESS\n"))
+	}))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.DedupWindowSeconds = 60
+	config.LogEndpoints = []string{relay.URL}
+	storeConfig(config)
+	defer setConfig()
+	transactionCache.flush()
+	defer transactionCache.flush()
+
+	body := []byte(`{"signatures": ["SIG_K1_test"], "actions": [{"code": "tokens"}]}`)
+	tests := []TestStruct{
+		{
+			description:  "upstream failure",
+			url:          "/v1/chain/push_transaction",
+			body:         body,
+			expectedBody: "{\"message\":\"UPSTREAM_UNAVAILABLE\",\"code\":502}",
+			expectedCode: 502,
+		},
+		{
+			description:  "retry after the failure",
+			url:          "/v1/chain/push_transaction",
+			body:         body,
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "duplicate of the accepted transaction",
+			url:          "/v1/chain/push_transaction",
+			body:         body,
+			expectedBody: "{\"message\":\"DUPLICATE_TRANSACTION\",\"code\":409}",
+			expectedCode: 409,
+		},
+	}
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	// Only the duplicate is a failure for fail2ban, the upstream failure is not the client's
+	logEvents.flush(time.Second)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(relayed) != 1 || relayed[0] != "DUPLICATE_TRANSACTION" {
+		t.Errorf("Expected a DUPLICATE_TRANSACTION failure to be sent to fail2ban and got %v.", relayed)
+	}
+}
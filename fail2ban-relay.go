@@ -2,20 +2,22 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 )
 
 // Log defines the fields needed for the Fail2Ban logs
 type Log struct {
-	Host    string `json:"host"`
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Host      string `json:"host"`
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	Audit     bool   `json:"audit,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
 }
 
-var logFile *os.File
+var logFile *rotatingFile
 var logger *log.Logger
 
 // listenForLogs listens to the middleware for success/failure logs
@@ -31,18 +33,24 @@ func listenForLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	line := fmt.Sprintf("%s %t %s", logEntry.Host, logEntry.Success, logEntry.Message)
+	if logEntry.RequestID != "" {
+		line += " requestId=" + logEntry.RequestID
+	}
+
 	// Print to file and stderr for now
-	logger.Printf("%s %t %s", logEntry.Host, logEntry.Success, logEntry.Message)
-	log.Printf("%s %t %s", logEntry.Host, logEntry.Success, logEntry.Message)
+	logger.Print(line)
+	log.Print(line)
 }
 
 func addLogHandlers(mux *http.ServeMux) {
 	var err error
-	logFile, err = os.OpenFile(appConfig.LogFileLocation, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err = openRotatingFile(getConfig().LogFileLocation)
 	if err != nil {
 		log.Fatalf("Error opening log file %s", err)
 	}
 
 	logger = log.New(logFile, "", log.LstdFlags)
+	go reopenOnSignal(logFile)
 	mux.HandleFunc("/patroneos/fail2ban-relay", listenForLogs)
 }
@@ -2,14 +2,28 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // Middleware returns a handler that can perform various operations
@@ -20,45 +34,240 @@ type middleware func(next http.HandlerFunc) http.HandlerFunc
 type ErrorMessage struct {
 	Message string `json:"message"`
 	Code    int    `json:"code"`
+
+	// Details of the failure, only included when verboseErrors is set
+	Detail         string `json:"detail,omitempty"`
+	Limit          *int   `json:"limit,omitempty"`
+	Observed       *int   `json:"observed,omitempty"`
+	OffendingIndex *int   `json:"offendingIndex,omitempty"`
+
+	// The ID assigned to the request, see assignRequestID
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Error returns the failure message, so failures can be returned by validators.
+func (failure *ErrorMessage) Error() string {
+	return failure.Message
+}
+
+// intPointer returns a pointer to the value, for the optional fields of ErrorMessage.
+func intPointer(value int) *int {
+	return &value
+}
+
+// Authorization is a permission level that authorizes an action
+type Authorization struct {
+	Actor      string `json:"actor"`
+	Permission string `json:"permission"`
+}
+
+// UnmarshalJSON accepts both the object form {"actor": "a", "permission": "p"}
+// and the array form ["a", "p"] emitted by nodeos.
+func (authorization *Authorization) UnmarshalJSON(data []byte) error {
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		var level []string
+		err := json.Unmarshal(data, &level)
+		if err != nil {
+			return err
+		}
+		if len(level) != 2 {
+			return errors.New("authorization must contain an actor and a permission")
+		}
+
+		authorization.Actor = level[0]
+		authorization.Permission = level[1]
+		return nil
+	}
+
+	// Use a separate type so json.Unmarshal does not call this method again
+	type permissionLevel Authorization
+	return json.Unmarshal(data, (*permissionLevel)(authorization))
 }
 
 // Action represents the structure of an action rpc payload
 type Action struct {
-	Code string `json:"code"`
-	Data string `json:"data"`
+	Code          string          `json:"code"`
+	Type          string          `json:"type"`
+	Data          string          `json:"data"`
+	Authorization []Authorization `json:"authorization"`
+	Recipients    []string        `json:"recipients"`
+}
+
+// UnmarshalJSON accepts both the current account/name field names and the legacy code/type ones.
+// Data can be a hex string or, as accepted by nodeos, a JSON object which is kept as JSON text.
+func (action *Action) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		Account       string          `json:"account"`
+		Name          string          `json:"name"`
+		Code          string          `json:"code"`
+		Type          string          `json:"type"`
+		Data          json.RawMessage `json:"data"`
+		Authorization []Authorization `json:"authorization"`
+		Recipients    []string        `json:"recipients"`
+	}
+
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+
+	action.Code = fields.Account
+	if action.Code == "" {
+		action.Code = fields.Code
+	}
+
+	action.Type = fields.Name
+	if action.Type == "" {
+		action.Type = fields.Type
+	}
+
+	action.Authorization = fields.Authorization
+	action.Recipients = fields.Recipients
+	action.Data = ""
+	if len(fields.Data) > 0 && string(fields.Data) != "null" {
+		if fields.Data[0] == '"' {
+			return json.Unmarshal(fields.Data, &action.Data)
+		}
+
+		var compacted bytes.Buffer
+		err = json.Compact(&compacted, fields.Data)
+		if err != nil {
+			return err
+		}
+		action.Data = compacted.String()
+	}
+
+	return nil
+}
+
+// jsonUint32 is an unsigned integer that clients send either as a JSON number or as a string.
+type jsonUint32 uint32
+
+// UnmarshalJSON accepts 42 as well as "42".
+func (value *jsonUint32) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		err := json.Unmarshal(data, &text)
+		if err != nil {
+			return err
+		}
+		data = []byte(text)
+	}
+
+	var number uint32
+	err := json.Unmarshal(data, &number)
+	if err != nil {
+		return err
+	}
+
+	*value = jsonUint32(number)
+	return nil
 }
 
-// Transaction describes the structure of a transaction rpc payload
+// Transaction describes the structure of a transaction rpc payload.
+// push_transaction payloads carry the transaction serialized in PackedTrx,
+// which getTransactions decodes into the other fields.
 type Transaction struct {
-	Actions    []Action `json:"actions"`
-	Signatures []string `json:"signatures"`
+	Expiration         string          `json:"expiration"`
+	RefBlockNum        uint16          `json:"ref_block_num"`
+	RefBlockPrefix     uint32          `json:"ref_block_prefix"`
+	MaxNetUsageWords   uint32          `json:"max_net_usage_words"`
+	MaxCPUUsageMs      uint8           `json:"max_cpu_usage_ms"`
+	DelaySec           jsonUint32      `json:"delay_sec"`
+	ContextFreeActions []Action        `json:"context_free_actions"`
+	Actions            []Action        `json:"actions"`
+	Signatures         []string        `json:"signatures"`
+	Authorizations     []Authorization `json:"authorizations"`
+	Scope              []string        `json:"scope"`
+
+	TransactionExtensions []json.RawMessage `json:"transaction_extensions"`
+
+	Compression           string `json:"compression"`
+	PackedContextFreeData string `json:"packed_context_free_data"`
+	PackedTrx             string `json:"packed_trx"`
+}
+
+// getActions returns the context-free actions followed by the actions of the transaction.
+func (transaction Transaction) getActions() []Action {
+	if len(transaction.ContextFreeActions) == 0 {
+		return transaction.Actions
+	}
+
+	return append(append([]Action{}, transaction.ContextFreeActions...), transaction.Actions...)
+}
+
+// accountNamePattern matches EOSIO account names: up to 12 characters from a-z, 1-5 and dot,
+// optionally followed by a 13th character from a-j and 1-5, never ending in a dot.
+var accountNamePattern = regexp.MustCompile(`^[a-z1-5.]{0,11}[a-z1-5]([a-j1-5])?$`)
+
+// isAccountName reports whether name follows the EOSIO account name rules.
+func isAccountName(name string) bool {
+	return accountNamePattern.MatchString(name)
 }
 
 // Define Context Keys
 type contextKey string
 
 var (
-	transactionsKey = contextKey("transactions")
+	bodyKey = contextKey("body")
 )
 
 var client = http.Client{}
 
-// getHost returns the host based on the existence of the X-Forwarded-For header.
+// stripPort returns the IP of a host:port address, or the address itself when it has no port.
+func stripPort(address string) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(address))
+	if err != nil {
+		return strings.TrimSpace(address)
+	}
+
+	return host
+}
+
+// trustedProxyNetworks holds the []*net.IPNet parsed from trustedProxies in the running configuration.
+var trustedProxyNetworks atomic.Value
+
+// isTrustedProxy reports whether the connection comes from one of the trustedProxies,
+// whose X-Forwarded-For, X-Real-IP and X-Forwarded-Proto headers can be believed.
+func isTrustedProxy(r *http.Request) bool {
+	networks, _ := trustedProxyNetworks.Load().([]*net.IPNet)
+	return containsIP(networks, r.RemoteAddr)
+}
+
+// getHost returns the address of the client, without its port so the fail2ban filters match it.
+// X-Forwarded-For can be set by anyone, so it is only consulted when the connection comes from one of the
+// trustedProxies. The client is then the right-most entry that is not itself a trusted proxy, since the
+// entries to its left were sent by the client and can be forged.
 func getHost(r *http.Request) string {
-	var remoteHost string
+	host := stripPort(r.RemoteAddr)
+	if !isTrustedProxy(r) {
+		return host
+	}
 
-	if header := r.Header.Get("X-Forwarded-For"); header != "" {
-		remoteHost = header
-	} else {
-		remoteHost = r.RemoteAddr
+	networks, _ := trustedProxyNetworks.Load().([]*net.IPNet)
+	entries := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := stripPort(entries[i])
+		if entry == "" {
+			continue
+		}
+		// Stop at the last valid hop if a proxy passed on garbage
+		if net.ParseIP(entry) == nil {
+			break
+		}
+
+		host = entry
+		if !containsIP(networks, entry) {
+			break
+		}
 	}
 
-	return remoteHost
+	return host
 }
 
 // injectHeaders adds configured headers into response
 func injectHeaders(headers http.Header) {
-	for header, value := range appConfig.Headers {
+	for header, value := range getConfig().Headers {
 		if value != "" {
 			headers.Set(header, value)
 		} else {
@@ -67,101 +276,197 @@ func injectHeaders(headers http.Header) {
 	}
 }
 
-// logFailure logs a failure to the Fail2Ban server
+// sendLogEvent queues a log event for every configured Fail2Ban relay.
+func sendLogEvent(logEvent Log) {
+	config := getConfig()
+	if len(config.LogEndpoints) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(logEvent)
+	if err != nil {
+		log.Printf("Error marshalling log message %s", err)
+		return
+	}
+
+	logEvents.enqueue(config, body)
+}
+
+// defaultStatusCodes maps the failures that are not answered with a 400 by default to their status code.
+var defaultStatusCodes = map[string]int{
+	"INVALID_TRANSACTION_SIZE": http.StatusRequestEntityTooLarge,
+	"JSON_TOO_COMPLEX":         http.StatusRequestEntityTooLarge,
+	"BLACKLISTED_CONTRACT":     http.StatusForbidden,
+	"WHITELIST_VIOLATION":      http.StatusForbidden,
+	"BLACKLISTED_ACCOUNT":      http.StatusForbidden,
+	"BLACKLISTED_RECIPIENT":    http.StatusForbidden,
+	"BLACKLISTED_SCOPE":        http.StatusForbidden,
+	"BLACKLISTED_ACTION":       http.StatusForbidden,
+	"BLACKLISTED_RULE":         http.StatusForbidden,
+	"SYSTEM_ACTION_LIMIT":      http.StatusForbidden,
+	"ACTOR_RATE_LIMIT":         http.StatusTooManyRequests,
+	"BAD_BYPASS_TOKEN":         http.StatusUnauthorized,
+}
+
+// getStatusCode returns the status code of a failure. Any batch index or detail after a colon in the message is ignored.
+// The statusCodes configuration takes precedence, then the status code given by the caller,
+// then defaultStatusCodes, and finally 400.
+func getStatusCode(message string, statusCode int) int {
+	reason := strings.SplitN(message, ":", 2)[0]
+	if index := strings.Index(reason, "["); index >= 0 {
+		reason = reason[:index]
+	}
+
+	if code, exists := getConfig().StatusCodes[reason]; exists {
+		return code
+	}
+	if statusCode >= 100 {
+		return statusCode
+	}
+	if code, exists := defaultStatusCodes[reason]; exists {
+		return code
+	}
+
+	return http.StatusBadRequest
+}
+
+// logFailure logs a failure to the Fail2Ban server.
+// Failures written to an auditWriter are logged as WOULD_REJECT:<message> instead, so they are not banned.
+// A statusCode of 0 uses the status code configured for the failure, see getStatusCode.
 func logFailure(message string, w http.ResponseWriter, r *http.Request, statusCode int) {
+	logFailureDetails(ErrorMessage{Message: message}, w, r, statusCode)
+}
 
-	// Default status code
-	if statusCode < 100 {
-		statusCode = 400
+// logFailureDetails logs a failure like logFailure. The details of the failure are always logged,
+// but only included in the response when verboseErrors is set.
+func logFailureDetails(failure ErrorMessage, w http.ResponseWriter, r *http.Request, statusCode int) {
+	message := failure.Message
+	failure.Code = getStatusCode(message, statusCode)
+
+	logged := message
+	if failure.Detail != "" {
+		logged += " (" + failure.Detail + ")"
 	}
 
 	remoteHost := getHost(r)
-	for _, logAgent := range appConfig.LogEndpoints {
-		if !strings.Contains(logAgent, "/patroneos/fail2ban-relay") {
-			logAgent += "/patroneos/fail2ban-relay"
-		}
-		logEvent := Log{
-			Host:    remoteHost,
-			Success: false,
-			Message: message,
-		}
-		body, err := json.Marshal(logEvent)
-		if err != nil {
-			log.Printf("Error marshalling failure message %s", err)
-		}
-		_, err = client.Post(logAgent, "application/json", bytes.NewBuffer(body))
-		if err != nil {
-			log.Print(err)
-		}
+	failure.RequestID = getRequestID(r)
+	if writer, auditing := w.(*auditWriter); auditing {
+		writer.rejected = true
+		sendLogEvent(Log{Host: remoteHost, Success: true, Audit: true, Message: "WOULD_REJECT:" + message, RequestID: failure.RequestID})
+		log.Printf("Audit: %s WOULD_REJECT:%s%s", remoteHost, logged, requestIDSuffix(r))
+		return
 	}
-	log.Printf("Failure: %s %s", remoteHost, message)
-	if w != nil {
-		errorBody, _ := json.Marshal(ErrorMessage{Message: message, Code: statusCode})
-		w.Header().Add("X-REJECTED-BY", "patroneos")
-		w.Header().Add("CONTENT-TYPE", "application/json")
 
-		injectHeaders(w.Header())
-		w.WriteHeader(statusCode)
-		_, err := w.Write(errorBody)
-		if err != nil {
-			log.Printf("Error writing response body %s", err)
-		}
+	sendLogEvent(Log{Host: remoteHost, Success: false, Message: message, RequestID: failure.RequestID})
+	log.Printf("Failure: %s %s%s", remoteHost, logged, requestIDSuffix(r))
+	if w != nil {
+		writeFailure(failure, w)
 	}
 }
 
-// logSuccess logs a success to the Fail2Ban server
-func logSuccess(message string, r *http.Request) {
-	remoteHost := getHost(r)
-	for _, logAgent := range appConfig.LogEndpoints {
-		if !strings.Contains(logAgent, "/patroneos/fail2ban-relay") {
-			logAgent += "/patroneos/fail2ban-relay"
-		}
-		logEvent := Log{
-			Host:    remoteHost,
-			Success: true,
-			Message: message,
-		}
-		body, err := json.Marshal(logEvent)
-		if err != nil {
-			log.Printf("Error marshalling success message %s", err)
-		}
-		_, err = client.Post(logAgent, "application/json", bytes.NewBuffer(body))
-		if err != nil {
-			log.Print(err)
-		}
+// writeFailure answers the request with the failure, without its details unless verboseErrors is set.
+func writeFailure(failure ErrorMessage, w http.ResponseWriter) {
+	if !getConfig().VerboseErrors {
+		failure = ErrorMessage{Message: failure.Message, Code: failure.Code, RequestID: failure.RequestID}
+	}
+
+	errorBody, _ := json.Marshal(failure)
+	w.Header().Add("X-REJECTED-BY", "patroneos")
+	w.Header().Add("CONTENT-TYPE", "application/json")
+
+	injectHeaders(w.Header())
+	w.WriteHeader(failure.Code)
+	_, err := w.Write(errorBody)
+	if err != nil {
+		log.Printf("Error writing response body %s", err)
 	}
-	log.Printf("Success: %s %s", remoteHost, message)
 }
 
-// validateJSON checks that the POST body contains a valid JSON object.
-func validateJSON(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		jsonBytes, err := ioutil.ReadAll(r.Body)
-		r.Body = ioutil.NopCloser(bytes.NewBuffer(jsonBytes))
-		if len(jsonBytes) > 0 {
-			if !json.Valid(jsonBytes) || err != nil {
-				logFailure("INVALID_JSON", w, r, 0)
-				return
-			}
+// isTLSError reports whether the connection to nodeos failed during the TLS handshake: the certificate
+// of nodeos could not be verified, nodeos does not speak TLS, or it refused our client certificate.
+func isTLSError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var opErr *net.OpError
+
+	return errors.As(err, &verificationErr) || errors.As(err, &recordErr) ||
+		(errors.As(err, &opErr) && opErr.Op == "remote error")
+}
+
+// logUpstreamFailure answers with a 502 UPSTREAM_UNAVAILABLE, a 502 UPSTREAM_TLS_ERROR when the TLS handshake
+// with nodeos failed, a 502 UPSTREAM_UNAUTHORIZED when nodeos refused the credentials of patroneos,
+// a 503 UPSTREAM_BUSY when maxUpstreamConcurrency was reached, a 429 QUEUE_FULL or QUEUE_TIMEOUT with a Retry-After
+// when the request could not wait in the queue, or a 504 UPSTREAM_TIMEOUT when nodeos did not answer in time.
+// The fault is not the client's, so no failure is sent to the fail2ban relays.
+func logUpstreamFailure(err error, w http.ResponseWriter, r *http.Request) {
+	failure := ErrorMessage{Message: "UPSTREAM_UNAVAILABLE", Code: http.StatusBadGateway}
+
+	var netErr net.Error
+	if isTLSError(err) {
+		failure = ErrorMessage{Message: "UPSTREAM_TLS_ERROR", Code: http.StatusBadGateway}
+	} else if errors.Is(err, errUpstreamBusy) {
+		failure = ErrorMessage{Message: "UPSTREAM_BUSY", Code: http.StatusServiceUnavailable}
+	} else if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+		failure = ErrorMessage{Message: "QUEUE_FULL", Code: http.StatusTooManyRequests}
+		if errors.Is(err, errQueueTimeout) {
+			failure.Message = "QUEUE_TIMEOUT"
 		}
+		w.Header().Set("Retry-After", strconv.Itoa(getRetryAfter(getConfig())))
+	} else if errors.Is(err, errUpstreamUnauthorized) {
+		failure = ErrorMessage{Message: "UPSTREAM_UNAUTHORIZED", Code: http.StatusBadGateway}
+	} else if errors.Is(err, errResponseTooLarge) {
+		failure = ErrorMessage{Message: "RESPONSE_TOO_LARGE", Code: http.StatusBadGateway}
+	} else if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		failure = ErrorMessage{Message: "UPSTREAM_TIMEOUT", Code: http.StatusGatewayTimeout}
+	}
 
-		next.ServeHTTP(w, r)
+	failure.RequestID = getRequestID(r)
+	log.Printf("Upstream failure: %s %s (%s)%s", getHost(r), failure.Message, err, requestIDSuffix(r))
+	if w != nil {
+		writeFailure(failure, w)
+	}
+}
+
+// logError reports an error as a failure, with its details when it is an *ErrorMessage.
+func logError(err error, w http.ResponseWriter, r *http.Request) {
+	if failure, detailed := err.(*ErrorMessage); detailed {
+		logFailureDetails(*failure, w, r, failure.Code)
+		return
 	}
+
+	logFailure(err.Error(), w, r, 0)
+}
+
+// logSuccess logs a success to the Fail2Ban server, with the time nodeos took to answer
+func logSuccess(message string, r *http.Request, upstreamDuration time.Duration) {
+	remoteHost := getHost(r)
+	sendLogEvent(Log{Host: remoteHost, Success: true, Message: message, RequestID: getRequestID(r)})
+	log.Printf("Success: %s %s upstreamMs=%d%s", remoteHost, message, upstreamDuration.Milliseconds(), requestIDSuffix(r))
 }
 
-// validateMaxSignatures checks that the transaction does not have more signatures than the max allowed.
-func validateMaxSignatures(next http.HandlerFunc) http.HandlerFunc {
+// chainAPIPrefix is the path prefix of the nodeos chain API.
+const chainAPIPrefix = "/v1/chain/"
+
+// validateContentType checks that requests with a body sent to the chain API are application/json.
+// Requests without a Content-Type header pass when allowMissingContentType is set.
+func validateContentType(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(path.Clean("/"+r.URL.Path), chainAPIPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		transactions, ctx, err := getTransactions(r)
-		if err != nil {
-			logFailure(err.Error(), w, r, 0)
+		parsed, ctx := getParsedBody(r)
+		if parsed.readErr != nil {
+			logFailure("BODY_NOT_READ", w, r, 0)
 			return
 		}
 
-		for _, transaction := range transactions {
-			if len(transaction.Signatures) > appConfig.MaxSignatures {
-				logFailure("INVALID_NUMBER_SIGNATURES", w, r, 0)
+		contentType := r.Header.Get("Content-Type")
+		if len(parsed.raw) > 0 && !(contentType == "" && getConfig().AllowMissingContentType) {
+			mediaType, _, err := mime.ParseMediaType(contentType)
+			if err != nil || mediaType != "application/json" {
+				logFailure("INVALID_CONTENT_TYPE", w, r, http.StatusUnsupportedMediaType)
 				return
 			}
 		}
@@ -170,199 +475,1306 @@ func validateMaxSignatures(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// validateContract checks that the transaction does not act on a blacklisted contract.
-func validateContract(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// isSingleJSONValue reports whether the body is exactly one JSON value, with nothing but whitespace after it.
+// Concatenated documents and newline delimited JSON are rejected, so nodeos cannot parse a different document than we validated.
+func isSingleJSONValue(body []byte) bool {
+	decoder := json.NewDecoder(bytes.NewReader(body))
 
-		transactions, ctx, err := getTransactions(r)
-		if err != nil {
-			logFailure(err.Error(), w, r, 0)
-			return
-		}
+	var value json.RawMessage
+	if err := decoder.Decode(&value); err != nil {
+		return false
+	}
 
-		for _, transaction := range transactions {
-			for _, action := range transaction.Actions {
-				_, exists := appConfig.ContractBlackList[action.Code]
-				if exists {
-					logFailure("BLACKLISTED_CONTRACT", w, r, 0)
-					return
-				}
+	return decoder.Decode(&value) == io.EOF
+}
+
+// validateJSON checks that the POST body contains a single valid JSON document.
+func validateJSON(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parsed, ctx := getParsedBody(r)
+		if len(parsed.raw) > 0 {
+			// The complexity is checked first, the JSON validation itself fails on very deep nesting
+			if parsed.err == errJSONTooComplex {
+				logFailure(parsed.err.Error(), w, r, 0)
+				return
+			}
+
+			if !isSingleJSONValue(parsed.raw) || parsed.readErr != nil {
+				logFailure("INVALID_JSON", w, r, 0)
+				return
 			}
 		}
+
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
-// validateMaxTransactions checks that the number of transactions in the request does not exceed the defined maximum.
-func validateMaxTransactions(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		transactions, ctx, err := getTransactions(r)
+var errJSONTooComplex = errors.New("JSON_TOO_COMPLEX")
+
+// byteOrderMark is the UTF-8 byte order mark some clients put before the JSON.
+var byteOrderMark = []byte("\xef\xbb\xbf")
+
+// trimByteOrderMark removes a leading UTF-8 byte order mark, which the JSON decoder does not accept.
+func trimByteOrderMark(body []byte) []byte {
+	return bytes.TrimPrefix(body, byteOrderMark)
+}
 
+// checkJSONComplexity scans the JSON without decoding it and checks its nesting depth, number of tokens
+// and string lengths against maxJSONDepth, maxJSONTokens and maxJSONStringLength. Limits that are 0 are not checked.
+// Syntax errors are left to isSingleJSONValue and json.Unmarshal.
+func checkJSONComplexity(body []byte, config *Config) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	depth := 0
+	tokens := 0
+
+	for {
+		token, err := decoder.Token()
 		if err != nil {
-			logFailure(err.Error(), w, r, 0)
-			return
+			return nil
 		}
 
-		// Skip this middleware if MaxTransactions is not configured, or set to 0
-		if appConfig.MaxTransactions > 0 {
-			if len(transactions) > appConfig.MaxTransactions {
-				logFailure("TOO_MANY_TRANSACTIONS", w, r, 0)
-				return
-			}
+		tokens++
+		if config.MaxJSONTokens > 0 && tokens > config.MaxJSONTokens {
+			return errJSONTooComplex
 		}
 
-		next.ServeHTTP(w, r.WithContext(ctx))
+		switch value := token.(type) {
+		case json.Delim:
+			if value == '{' || value == '[' {
+				depth++
+				if config.MaxJSONDepth > 0 && depth > config.MaxJSONDepth {
+					return errJSONTooComplex
+				}
+			} else {
+				depth--
+			}
+		case string:
+			if config.MaxJSONStringLength > 0 && len(value) > config.MaxJSONStringLength {
+				return errJSONTooComplex
+			}
+		}
 	}
 }
 
-// validateTransactionSize checks that the transaction data does not exceed the max allowed size.
-func validateTransactionSize(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// maxSignaturesValidator checks that the transaction does not have more signatures than the max allowed,
+// and that a whole request has at most maxTotalSignatures. With rejectDuplicateSignatures a signature
+// may also only appear once in a request.
+type maxSignaturesValidator struct{}
 
-		transactions, ctx, err := getTransactions(r)
-		if err != nil {
-			logFailure(err.Error(), w, r, 0)
-			return
+func (maxSignaturesValidator) Name() string {
+	return "validateMaxSignatures"
+}
+
+func (maxSignaturesValidator) Validate(transactions []Transaction, r *http.Request) error {
+	config := getConfig()
+	for i, transaction := range transactions {
+		if len(transaction.Signatures) > config.MaxSignatures {
+			return &ErrorMessage{
+				Message:        batchMessage(r, "INVALID_NUMBER_SIGNATURES", i),
+				Detail:         fmt.Sprintf("transaction %d has %d signatures, the limit is %d", i, len(transaction.Signatures), config.MaxSignatures),
+				Limit:          intPointer(config.MaxSignatures),
+				Observed:       intPointer(len(transaction.Signatures)),
+				OffendingIndex: intPointer(i),
+			}
 		}
+	}
 
-		for _, transaction := range transactions {
-			for _, action := range transaction.Actions {
-				if len(action.Data) > appConfig.MaxTransactionSize {
-					logFailure("INVALID_TRANSACTION_SIZE", w, r, 0)
-					return
+	total := 0
+	seen := map[string]bool{}
+	for i, transaction := range transactions {
+		for _, signature := range transaction.Signatures {
+			if config.RejectDuplicateSignatures && seen[signature] {
+				return &ErrorMessage{
+					Message:        batchMessage(r, "DUPLICATE_SIGNATURE", i),
+					Detail:         fmt.Sprintf("transaction %d repeats a signature already used in this request", i),
+					OffendingIndex: intPointer(i),
 				}
 			}
+			seen[signature] = true
+			total++
+		}
+	}
+
+	if config.MaxTotalSignatures > 0 && total > config.MaxTotalSignatures {
+		return &ErrorMessage{
+			Message:  "INVALID_NUMBER_SIGNATURES:TOTAL",
+			Detail:   fmt.Sprintf("the request has %d signatures, %d of them unique, the limit is %d", total, len(seen), config.MaxTotalSignatures),
+			Limit:    intPointer(config.MaxTotalSignatures),
+			Observed: intPointer(total),
 		}
-		next.ServeHTTP(w, r.WithContext(ctx))
 	}
+
+	return nil
 }
 
-// getTransactions parses json and returns a slice containing the transactions
-func getTransactions(r *http.Request) ([]Transaction, context.Context, error) {
-	var transactions []Transaction
-	var transaction Transaction
+// validateMaxSignatures runs maxSignaturesValidator as a middleware.
+var validateMaxSignatures = validatorMiddleware(maxSignaturesValidator{})
 
-	// Context has not been set
-	if r.Context().Value(transactionsKey) == nil {
-		// Read request body
-		jsonBytes, _ := ioutil.ReadAll(r.Body)
-		r.Body = ioutil.NopCloser(bytes.NewBuffer(jsonBytes))
+// base58Alphabet is the bitcoin base58 alphabet used by EOSIO keys and signatures.
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
 
-		// Determine if JSON is a single object or an array of objects
-		body := strings.TrimSpace(string(jsonBytes))
+// signatureLength is the size of a decoded signature: 65 bytes of signature and a 4 byte checksum.
+const signatureLength = 69
 
-		if strings.HasPrefix(body, "{") {
-			// Single Object
-			err := json.Unmarshal(jsonBytes, &transaction)
+// maxEncodedSignatureLength is the longest base58 encoding of signatureLength bytes. Longer strings are
+// rejected before decoding, as decodeBase58 takes time quadratic in the length of its input.
+const maxEncodedSignatureLength = 95
 
-			if err != nil {
-				return nil, nil, errors.New("PARSE_ERROR")
-			}
+// signaturePrefixes are the signature types accepted by validateSignatureFormat.
+var signaturePrefixes = []string{"SIG_K1_", "SIG_R1_"}
 
-			transactions = append(transactions, transaction)
-		} else if strings.HasPrefix(body, "[") {
-			// Array of Objects
-			err := json.Unmarshal(jsonBytes, &transactions)
+// decodeBase58 decodes a base58 string, returning false if it contains other characters.
+func decodeBase58(encoded string) ([]byte, bool) {
+	value := new(big.Int)
+	base := big.NewInt(58)
 
-			if err != nil {
-				return nil, nil, errors.New("PARSE_ERROR")
-			}
+	for _, character := range encoded {
+		digit := strings.IndexRune(base58Alphabet, character)
+		if digit < 0 {
+			return nil, false
 		}
+		value.Mul(value, base)
+		value.Add(value, big.NewInt(int64(digit)))
+	}
 
-		// Add transactions to request context so subsequent middleware does not have to parse the transactions again
-		ctx := context.WithValue(r.Context(), transactionsKey, transactions)
-		return transactions, ctx, nil
+	// Each leading 1 encodes a leading zero byte
+	leadingZeros := 0
+	for leadingZeros < len(encoded) && encoded[leadingZeros] == '1' {
+		leadingZeros++
 	}
 
-	// Context already exists
-	transactions = r.Context().Value(transactionsKey).([]Transaction)
-	return transactions, r.Context(), nil
+	return append(make([]byte, leadingZeros), value.Bytes()...), true
 }
 
-// Walks through the middleware list in reverse order and
-// pass the return value into the function before it so they are called
-// in the correct order.
-// Middleware pattern inspired by https://hackernoon.com/simple-http-middleware-with-go-79a4ad62889b
-func chainMiddleware(mw ...middleware) middleware {
-	return func(final http.HandlerFunc) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			last := final
-			for i := len(mw) - 1; i >= 0; i-- {
-				last = mw[i](last)
+// isSignature reports whether the string is a K1 or R1 signature in the EOSIO string format.
+func isSignature(signature string) bool {
+	for _, prefix := range signaturePrefixes {
+		if strings.HasPrefix(signature, prefix) {
+			if len(signature)-len(prefix) > maxEncodedSignatureLength {
+				return false
 			}
-			last(w, r)
+			decoded, valid := decodeBase58(strings.TrimPrefix(signature, prefix))
+			return valid && len(decoded) == signatureLength
 		}
 	}
+
+	return false
 }
 
-func copyHeaders(response http.Header, request http.Header) {
-	for key, value := range request {
-		for _, header := range value {
-			response.Add(key, header)
+// signatureFormatValidator checks that every signature looks like an EOSIO signature.
+// It is skipped if allowAnySignatureFormat is set, for chains with other key types.
+type signatureFormatValidator struct{}
+
+func (signatureFormatValidator) Name() string {
+	return "validateSignatureFormat"
+}
+
+func (signatureFormatValidator) Validate(transactions []Transaction, r *http.Request) error {
+	if !getConfig().AllowAnySignatureFormat {
+		for i, transaction := range transactions {
+			for j, signature := range transaction.Signatures {
+				if !isSignature(signature) {
+					return &ErrorMessage{
+						Message:        batchMessage(r, "INVALID_SIGNATURE_FORMAT", i),
+						Detail:         fmt.Sprintf("signature %d of transaction %d is not a valid SIG_K1_ or SIG_R1_ signature", j, i),
+						OffendingIndex: intPointer(j),
+					}
+				}
+			}
 		}
 	}
+
+	return nil
 }
 
-// If the request passes all middleware validations
-// we forward it to the node to be processed.
-func forwardCallToNodeos(w http.ResponseWriter, r *http.Request) {
-	nodeosHost := fmt.Sprintf("%s://%s:%s", appConfig.NodeosProtocol, appConfig.NodeosURL, appConfig.NodeosPort)
-	url := nodeosHost + r.URL.String()
-	method := r.Method
-	body, _ := ioutil.ReadAll(r.Body)
+// validateSignatureFormat runs signatureFormatValidator as a middleware.
+var validateSignatureFormat = validatorMiddleware(signatureFormatValidator{})
 
-	request, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+// contractPattern is a compiled entry of contractBlackListPatterns
+type contractPattern struct {
+	source string
+	regexp *regexp.Regexp
+}
 
-	if err != nil {
-		log.Printf("Error in creating request %s", err)
-		logFailure("NODEOS_REQUEST_NOT_CREATED", w, r, 500)
-		return
+// contractPatterns holds the []contractPattern compiled from the running configuration.
+var contractPatterns atomic.Value
+
+// compileContractPattern compiles a contract pattern. Patterns enclosed in slashes, such as /^spam[0-9]+$/,
+// are Go regular expressions. Other patterns match the whole contract name, with * matching any characters.
+func compileContractPattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile(pattern[1 : len(pattern)-1])
 	}
 
-	// Forward headers to nodeos
-	request.Header = make(http.Header)
-	copyHeaders(request.Header, r.Header)
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
 
-	res, err := client.Do(request)
+	return regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+}
 
-	if err != nil {
-		log.Printf("Error in executing request %s", err)
-		logFailure("NODEOS_UNREACHABLE", w, r, 503)
-		return
+// compileContractPatterns compiles the valid patterns. Invalid patterns are rejected by validateConfig.
+func compileContractPatterns(patterns []string) []contractPattern {
+	compiled := []contractPattern{}
+	for _, pattern := range patterns {
+		expression, err := compileContractPattern(pattern)
+		if err != nil {
+			log.Printf("Ignoring invalid contract pattern %s %s", pattern, err)
+			continue
+		}
+		compiled = append(compiled, contractPattern{source: pattern, regexp: expression})
 	}
 
-	defer res.Body.Close()
+	return compiled
+}
 
-	body, _ = ioutil.ReadAll(res.Body)
+// matchContractPattern returns the first contract pattern that matches the contract, or an empty string.
+func matchContractPattern(contract string) string {
+	patterns, _ := contractPatterns.Load().([]contractPattern)
+	for _, pattern := range patterns {
+		if pattern.regexp.MatchString(contract) {
+			return pattern.source
+		}
+	}
 
-	if res.StatusCode == 200 {
-		logSuccess("SUCCESS", r)
-	} else {
-		logFailure("TRANSACTION_FAILED", nil, r, 0)
+	return ""
+}
+
+// trustedNetworks holds the []*net.IPNet parsed from trustedSources in the running configuration.
+var trustedNetworks atomic.Value
+
+// isTrustedSource reports whether the request comes from one of the trustedSources.
+// It matches the address of the connection, as X-Forwarded-For can be set by any client.
+func isTrustedSource(r *http.Request) bool {
+	networks, _ := trustedNetworks.Load().([]*net.IPNet)
+	if len(networks) == 0 {
+		return false
 	}
 
-	copyHeaders(w.Header(), res.Header)
+	return containsIP(networks, r.RemoteAddr)
+}
 
-	// Inject configured headers
-	injectHeaders(w.Header())
+// bypassHeader carries a bypass token.
+const bypassHeader = "X-Patroneos-Bypass"
 
-	w.WriteHeader(res.StatusCode)
+// matchBypassToken returns the label of the bypass token, comparing every token in constant time.
+func matchBypassToken(tokens []BypassToken, token string) (string, bool) {
+	label, valid := "", false
+	for _, candidate := range tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate.Token), []byte(token)) == 1 {
+			label, valid = candidate.Label, true
+		}
+	}
 
-	_, err = w.Write(body)
-	if err != nil {
-		log.Printf("Error writing response body %s", err)
-		return
+	return label, valid
+}
+
+// findBlacklisted returns the first account that is in the blacklist.
+func findBlacklisted(blacklist map[string]bool, accounts ...string) (string, bool) {
+	for _, account := range accounts {
+		if _, exists := blacklist[account]; exists {
+			return account, true
+		}
 	}
+
+	return "", false
 }
 
-func relay(w http.ResponseWriter, r *http.Request) {
-	message := "Patroneos cannot receive fail2ban relay requests when running in filter mode. Please check your config."
-	log.Printf("%s", message)
+// recipientsValidator checks that no action notifies a blacklisted recipient and
+// that the transaction scope does not include a blacklisted account.
+type recipientsValidator struct{}
 
-	errorBody, _ := json.Marshal(ErrorMessage{Message: message, Code: 403})
+func (recipientsValidator) Name() string {
+	return "validateRecipients"
+}
 
-	w.WriteHeader(http.StatusForbidden)
-	_, err := w.Write(errorBody)
+func (recipientsValidator) Validate(transactions []Transaction, r *http.Request) error {
+	config := getConfig()
+	for i, transaction := range transactions {
+		if account, blacklisted := findBlacklisted(config.ScopeBlackList, transaction.Scope...); blacklisted {
+			return &ErrorMessage{
+				Message: batchMessage(r, "BLACKLISTED_SCOPE", i),
+				Detail:  fmt.Sprintf("the scope of transaction %d includes blacklisted account %s", i, account),
+			}
+		}
+
+		for j, action := range transaction.getActions() {
+			if account, blacklisted := findBlacklisted(config.RecipientBlackList, action.Recipients...); blacklisted {
+				return &ErrorMessage{
+					Message:        batchMessage(r, "BLACKLISTED_RECIPIENT", i),
+					Detail:         fmt.Sprintf("action %d of transaction %d notifies blacklisted account %s", j, i, account),
+					OffendingIndex: intPointer(j),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRecipients runs recipientsValidator as a middleware.
+var validateRecipients = validatorMiddleware(recipientsValidator{})
+
+// contractValidator checks that the transaction does not act on a blacklisted contract.
+// Exact matches in contractBlackList are checked before contractBlackListPatterns, and no rule exempts either.
+type contractValidator struct{}
+
+func (contractValidator) Name() string {
+	return "validateContract"
+}
+
+func (contractValidator) Validate(transactions []Transaction, r *http.Request) error {
+	config := getConfig()
+	for i, transaction := range transactions {
+		for j, action := range transaction.getActions() {
+			if _, blacklisted := findBlacklisted(config.ContractBlackList, action.Code); blacklisted {
+				return &ErrorMessage{
+					Message:        batchMessage(r, "BLACKLISTED_CONTRACT", i),
+					Detail:         fmt.Sprintf("action %d of transaction %d uses blacklisted contract %s", j, i, action.Code),
+					OffendingIndex: intPointer(j),
+				}
+			}
+
+			if pattern := matchContractPattern(action.Code); pattern != "" {
+				return &ErrorMessage{
+					Message:        batchMessage(r, "BLACKLISTED_CONTRACT:"+pattern, i),
+					Detail:         fmt.Sprintf("action %d of transaction %d uses contract %s, which matches %s", j, i, action.Code, pattern),
+					OffendingIndex: intPointer(j),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateContract runs contractValidator as a middleware.
+var validateContract = validatorMiddleware(contractValidator{})
+
+// contractWhitelistValidator checks that every action acts on a whitelisted contract.
+// It is skipped when the whitelist is empty, and the blacklist still applies to whitelisted contracts.
+type contractWhitelistValidator struct{}
+
+func (contractWhitelistValidator) Name() string {
+	return "validateContractWhitelist"
+}
+
+func (contractWhitelistValidator) Validate(transactions []Transaction, r *http.Request) error {
+	config := getConfig()
+	if len(config.ContractWhiteList) > 0 {
+		for i, transaction := range transactions {
+			for j, action := range transaction.getActions() {
+				if !config.ContractWhiteList[action.Code] {
+					return &ErrorMessage{
+						Message:        batchMessage(r, "WHITELIST_VIOLATION", i),
+						Detail:         fmt.Sprintf("action %d of transaction %d uses contract %s, which is not whitelisted", j, i, action.Code),
+						OffendingIndex: intPointer(j),
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateContractWhitelist runs contractWhitelistValidator as a middleware.
+var validateContractWhitelist = validatorMiddleware(contractWhitelistValidator{})
+
+// actionRuleSeparator separates the contract and action in an actionBlackList rule.
+const actionRuleSeparator = "::"
+
+// parseActionRule splits a "contract::action" rule into its contract and action.
+func parseActionRule(rule string) (string, string, error) {
+	parts := strings.Split(rule, actionRuleSeparator)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%q is not in the form contract::action", rule)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// matchActionRule returns the first entry of the actionBlackList that matches the action, or an empty string.
+// Either side of an entry can be * to match any contract or action.
+func matchActionRule(entries []string, action Action) string {
+	for _, entry := range entries {
+		rule, err := actionBlackListRule(entry)
+		if err == nil && rule.matches(action, nil) {
+			return entry
+		}
+	}
+
+	return ""
+}
+
+// actionValidator checks that the transaction does not contain a blacklisted contract::action pair.
+type actionValidator struct{}
+
+func (actionValidator) Name() string {
+	return "validateAction"
+}
+
+func (actionValidator) Validate(transactions []Transaction, r *http.Request) error {
+	config := getConfig()
+	for i, transaction := range transactions {
+		for j, action := range transaction.getActions() {
+			if rule := matchActionRule(config.ActionBlackList, action); rule != "" {
+				return &ErrorMessage{
+					Message:        batchMessage(r, "BLACKLISTED_ACTION:"+rule, i),
+					Detail:         fmt.Sprintf("action %d of transaction %d calls %s::%s", j, i, action.Code, action.Type),
+					OffendingIndex: intPointer(j),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateAction runs actionValidator as a middleware.
+var validateAction = validatorMiddleware(actionValidator{})
+
+// actorValidator checks that the transaction is not authorized by a blacklisted account.
+type actorValidator struct{}
+
+func (actorValidator) Name() string {
+	return "validateActor"
+}
+
+func (actorValidator) Validate(transactions []Transaction, r *http.Request) error {
+	config := getConfig()
+	for i, transaction := range transactions {
+		authorizations := append([]Authorization{}, transaction.Authorizations...)
+		for _, action := range transaction.getActions() {
+			authorizations = append(authorizations, action.Authorization...)
+		}
+
+		for _, authorization := range authorizations {
+			if config.AccountBlackList[authorization.Actor] {
+				return &ErrorMessage{
+					Message: batchMessage(r, "BLACKLISTED_ACCOUNT", i),
+					Detail:  fmt.Sprintf("transaction %d is authorized by blacklisted account %s", i, authorization.Actor),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateActor runs actorValidator as a middleware.
+var validateActor = validatorMiddleware(actorValidator{})
+
+// pushEndpoints are the nodeos endpoints that accept transactions.
+var pushEndpoints = map[string]bool{
+	"/v1/chain/push_transaction":  true,
+	"/v1/chain/push_transactions": true,
+	"/v1/chain/send_transaction":  true,
+}
+
+// isPushEndpoint reports whether the request is sent to an endpoint that accepts transactions.
+func isPushEndpoint(r *http.Request) bool {
+	return pushEndpoints[path.Clean("/"+r.URL.Path)]
+}
+
+// batchEndpoint is the push endpoint that accepts an array of transactions.
+const batchEndpoint = "/v1/chain/push_transactions"
+
+// isBatchEndpoint reports whether the request is sent to the batch endpoint.
+func isBatchEndpoint(r *http.Request) bool {
+	return path.Clean("/"+r.URL.Path) == batchEndpoint
+}
+
+// batchMessage adds the index of the offending transaction to the reason of a failure on the batch
+// endpoint, as in BLACKLISTED_CONTRACT[3] or BLACKLISTED_CONTRACT[3]:spam*, so clients can fix that element.
+func batchMessage(r *http.Request, message string, index int) string {
+	if !isBatchEndpoint(r) {
+		return message
+	}
+
+	parts := strings.SplitN(message, ":", 2)
+	parts[0] += fmt.Sprintf("[%d]", index)
+	return strings.Join(parts, ":")
+}
+
+// validateStrictParsing rejects POST requests to the push endpoints unless their body parses into
+// at least one transaction with actions, so bodies the middleware cannot inspect are never forwarded.
+// It runs ahead of filterEndpoints when strictParsing is enabled.
+func validateStrictParsing(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" || !isPushEndpoint(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		transactions, ctx, err := getTransactions(r)
+		if err != nil {
+			logError(err, w, r)
+			return
+		}
+
+		if len(transactions) == 0 {
+			logFailureDetails(ErrorMessage{Message: "PARSE_ERROR", Detail: "the request has no transactions"}, w, r, 0)
+			return
+		}
+
+		for i, transaction := range transactions {
+			if len(transaction.getActions()) == 0 {
+				logFailureDetails(ErrorMessage{
+					Message:        batchMessage(r, "PARSE_ERROR", i),
+					Detail:         fmt.Sprintf("transaction %d has no actions or packed_trx", i),
+					OffendingIndex: intPointer(i),
+				}, w, r, 0)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// validateNotEmpty checks that requests to the push endpoints contain transactions
+// with at least one action and one signature. Other endpoints are not checked.
+func validateNotEmpty(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if !isPushEndpoint(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		transactions, ctx, err := getTransactions(r)
+		if err != nil {
+			logError(err, w, r)
+			return
+		}
+
+		if len(transactions) == 0 {
+			logFailureDetails(ErrorMessage{Message: "EMPTY_TRANSACTION", Detail: "the request has no transactions"}, w, r, 0)
+			return
+		}
+
+		for i, transaction := range transactions {
+			actions := transaction.getActions()
+			if len(actions) == 0 || len(transaction.Signatures) == 0 {
+				logFailureDetails(ErrorMessage{
+					Message:        batchMessage(r, "EMPTY_TRANSACTION", i),
+					Detail:         fmt.Sprintf("transaction %d has %d actions and %d signatures", i, len(actions), len(transaction.Signatures)),
+					OffendingIndex: intPointer(i),
+				}, w, r, 0)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// expirationFormats are the layouts nodeos accepts for expirations, without and with milliseconds.
+var expirationFormats = []string{expirationFormat, expirationFormat + ".000"}
+
+// parseExpiration parses a transaction expiration in either of the expirationFormats, as UTC.
+func parseExpiration(value string) (time.Time, error) {
+	var expiration time.Time
+	var err error
+	for _, format := range expirationFormats {
+		expiration, err = time.Parse(format, value)
+		if err == nil {
+			break
+		}
+	}
+
+	return expiration, err
+}
+
+// getMaxExpirationAhead returns how far in the future a transaction may expire: maxExpirationAheadSeconds
+// when it is set, otherwise maxExpirationSeconds. 0 means there is no limit.
+func getMaxExpirationAhead(config *Config) int {
+	if config.MaxExpirationAheadSeconds > 0 {
+		return config.MaxExpirationAheadSeconds
+	}
+
+	return config.MaxExpirationSeconds
+}
+
+// validateExpiration checks that transactions sent to the push endpoints have not expired
+// and do not expire more than maxExpirationAheadSeconds, or maxExpirationSeconds, in the future,
+// allowing expirationSkewSeconds of clock skew.
+// It is skipped if neither maxExpirationSeconds nor maxExpirationAheadSeconds is configured.
+func validateExpiration(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		config := getConfig()
+		maxAhead := getMaxExpirationAhead(config)
+		if maxAhead <= 0 || !isPushEndpoint(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		transactions, ctx, err := getTransactions(r)
+		if err != nil {
+			logError(err, w, r)
+			return
+		}
+
+		now := time.Now().UTC()
+		skew := time.Duration(config.ExpirationSkewSeconds) * time.Second
+		window := time.Duration(maxAhead) * time.Second
+
+		for i, transaction := range transactions {
+			expiration, err := parseExpiration(transaction.Expiration)
+			if err != nil {
+				logFailureDetails(ErrorMessage{
+					Message:        batchMessage(r, "PARSE_ERROR", i),
+					Detail:         fmt.Sprintf("transaction %d has an invalid expiration %q", i, transaction.Expiration),
+					OffendingIndex: intPointer(i),
+				}, w, r, 0)
+				return
+			}
+
+			if expiration.Before(now.Add(-skew)) {
+				logFailureDetails(ErrorMessage{
+					Message:        batchMessage(r, "EXPIRED_TRANSACTION", i),
+					Detail:         fmt.Sprintf("transaction %d expired at %s", i, transaction.Expiration),
+					OffendingIndex: intPointer(i),
+				}, w, r, 0)
+				return
+			}
+
+			if expiration.After(now.Add(window + skew)) {
+				logFailureDetails(ErrorMessage{
+					Message:        batchMessage(r, "EXPIRATION_TOO_FAR", i),
+					Detail:         fmt.Sprintf("transaction %d expires at %s, more than %d seconds from now", i, transaction.Expiration, maxAhead),
+					Limit:          intPointer(maxAhead),
+					Observed:       intPointer(int(expiration.Sub(now) / time.Second)),
+					OffendingIndex: intPointer(i),
+				}, w, r, 0)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// validateDelay checks that transactions sent to the push endpoints are not delayed by more than maxDelaySec seconds.
+// A maxDelaySec of 0 only accepts immediate transactions. It is skipped if maxDelaySec is not configured.
+func validateDelay(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		config := getConfig()
+		if config.MaxDelaySec == nil || !isPushEndpoint(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		transactions, ctx, err := getTransactions(r)
+		if err != nil {
+			logError(err, w, r)
+			return
+		}
+
+		maxDelaySec := *config.MaxDelaySec
+		for i, transaction := range transactions {
+			if int64(transaction.DelaySec) > int64(maxDelaySec) {
+				logFailureDetails(ErrorMessage{
+					Message:        batchMessage(r, "DELAY_NOT_ALLOWED", i),
+					Detail:         fmt.Sprintf("transaction %d is delayed by %d seconds, the limit is %d", i, transaction.DelaySec, maxDelaySec),
+					Limit:          intPointer(maxDelaySec),
+					Observed:       intPointer(int(transaction.DelaySec)),
+					OffendingIndex: intPointer(i),
+				}, w, r, 0)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// maxTransactionsValidator checks that the number of transactions in the request does not exceed the defined maximum.
+type maxTransactionsValidator struct{}
+
+func (maxTransactionsValidator) Name() string {
+	return "validateMaxTransactions"
+}
+
+func (maxTransactionsValidator) Validate(transactions []Transaction, r *http.Request) error {
+	// Skip this check if MaxTransactions is not configured, or set to 0
+	config := getConfig()
+	if config.MaxTransactions > 0 && len(transactions) > config.MaxTransactions {
+		return &ErrorMessage{
+			Message:  "TOO_MANY_TRANSACTIONS",
+			Detail:   fmt.Sprintf("the request has %d transactions, the limit is %d", len(transactions), config.MaxTransactions),
+			Limit:    intPointer(config.MaxTransactions),
+			Observed: intPointer(len(transactions)),
+		}
+	}
+
+	return nil
+}
+
+// validateMaxTransactions runs maxTransactionsValidator as a middleware.
+var validateMaxTransactions = validatorMiddleware(maxTransactionsValidator{})
+
+// maxActionsValidator checks that no transaction has more actions than the defined maximum.
+type maxActionsValidator struct{}
+
+func (maxActionsValidator) Name() string {
+	return "validateMaxActions"
+}
+
+func (maxActionsValidator) Validate(transactions []Transaction, r *http.Request) error {
+	// Skip this check if MaxActions is not configured, or set to 0
+	config := getConfig()
+	if config.MaxActions > 0 {
+		for i, transaction := range transactions {
+			if actions := len(transaction.getActions()); actions > config.MaxActions {
+				return &ErrorMessage{
+					Message:        batchMessage(r, "TOO_MANY_ACTIONS", i),
+					Detail:         fmt.Sprintf("transaction %d has %d actions, the limit is %d", i, actions, config.MaxActions),
+					Limit:          intPointer(config.MaxActions),
+					Observed:       intPointer(actions),
+					OffendingIndex: intPointer(i),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateMaxActions runs maxActionsValidator as a middleware.
+var validateMaxActions = validatorMiddleware(maxActionsValidator{})
+
+// maxAuthorizationsValidator checks that no transaction, and no action within it, has more authorizations than the defined maximum.
+type maxAuthorizationsValidator struct{}
+
+func (maxAuthorizationsValidator) Name() string {
+	return "validateMaxAuthorizations"
+}
+
+func (maxAuthorizationsValidator) Validate(transactions []Transaction, r *http.Request) error {
+	// Skip this check if MaxAuthorizations is not configured, or set to 0
+	config := getConfig()
+	if config.MaxAuthorizations > 0 {
+		for i, transaction := range transactions {
+			if len(transaction.Authorizations) > config.MaxAuthorizations {
+				return &ErrorMessage{
+					Message:        batchMessage(r, "TOO_MANY_AUTHORIZATIONS", i),
+					Detail:         fmt.Sprintf("transaction %d has %d authorizations, the limit is %d", i, len(transaction.Authorizations), config.MaxAuthorizations),
+					Limit:          intPointer(config.MaxAuthorizations),
+					Observed:       intPointer(len(transaction.Authorizations)),
+					OffendingIndex: intPointer(i),
+				}
+			}
+
+			for j, action := range transaction.getActions() {
+				if len(action.Authorization) > config.MaxAuthorizations {
+					return &ErrorMessage{
+						Message:        batchMessage(r, "TOO_MANY_AUTHORIZATIONS", i),
+						Detail:         fmt.Sprintf("action %d of transaction %d has %d authorizations, the limit is %d", j, i, len(action.Authorization), config.MaxAuthorizations),
+						Limit:          intPointer(config.MaxAuthorizations),
+						Observed:       intPointer(len(action.Authorization)),
+						OffendingIndex: intPointer(j),
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateMaxAuthorizations runs maxAuthorizationsValidator as a middleware.
+var validateMaxAuthorizations = validatorMiddleware(maxAuthorizationsValidator{})
+
+// transactionSizeValidator checks that the transaction data does not exceed the max allowed size.
+// Contracts listed in maxTransactionSizePerContract use their own limit instead of maxTransactionSize,
+// and the data of all actions in a transaction together must not exceed maxTotalTransactionSize.
+type transactionSizeValidator struct{}
+
+func (transactionSizeValidator) Name() string {
+	return "validateTransactionSize"
+}
+
+func (transactionSizeValidator) Validate(transactions []Transaction, r *http.Request) error {
+	config := getConfig()
+	for i, transaction := range transactions {
+		totalSize := 0
+		for j, action := range transaction.getActions() {
+			message, limit := "INVALID_TRANSACTION_SIZE", config.MaxTransactionSize
+			if contractLimit, exists := config.MaxTransactionSizePerContract[action.Code]; exists {
+				message, limit = "INVALID_TRANSACTION_SIZE:"+action.Code, contractLimit
+			}
+
+			if len(action.Data) > limit {
+				return &ErrorMessage{
+					Message:        batchMessage(r, message, i),
+					Detail:         fmt.Sprintf("action %d of transaction %d has data length %d, the limit is %d", j, i, len(action.Data), limit),
+					Limit:          intPointer(limit),
+					Observed:       intPointer(len(action.Data)),
+					OffendingIndex: intPointer(j),
+				}
+			}
+			totalSize += len(action.Data)
+		}
+
+		// Skip the total if MaxTotalTransactionSize is not configured, or set to 0
+		if config.MaxTotalTransactionSize > 0 && totalSize > config.MaxTotalTransactionSize {
+			return &ErrorMessage{
+				Message:        batchMessage(r, "INVALID_TRANSACTION_SIZE:TOTAL", i),
+				Detail:         fmt.Sprintf("the actions of transaction %d have data length %d, the limit is %d", i, totalSize, config.MaxTotalTransactionSize),
+				Limit:          intPointer(config.MaxTotalTransactionSize),
+				Observed:       intPointer(totalSize),
+				OffendingIndex: intPointer(i),
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateTransactionSize runs transactionSizeValidator as a middleware.
+var validateTransactionSize = validatorMiddleware(transactionSizeValidator{})
+
+// actionDataValidator checks that the data of every action is a hex string of even length,
+// or a JSON object as accepted by nodeos for unpacked actions.
+type actionDataValidator struct{}
+
+func (actionDataValidator) Name() string {
+	return "validateActionData"
+}
+
+func (actionDataValidator) Validate(transactions []Transaction, r *http.Request) error {
+	for i, transaction := range transactions {
+		for j, action := range transaction.getActions() {
+			if !isActionData(action.Data) {
+				return &ErrorMessage{
+					Message:        batchMessage(r, "INVALID_ACTION_DATA", i),
+					Detail:         fmt.Sprintf("the data of action %d of transaction %d is neither hex nor a JSON object", j, i),
+					OffendingIndex: intPointer(j),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateActionData runs actionDataValidator as a middleware.
+var validateActionData = validatorMiddleware(actionDataValidator{})
+
+// isActionData reports whether data is a hex string of even length or a JSON object.
+// Actions unmarshal object data as compacted JSON text, so it starts with a brace.
+func isActionData(data string) bool {
+	if strings.HasPrefix(data, "{") {
+		return json.Valid([]byte(data))
+	}
+
+	if len(data)%2 != 0 {
+		return false
+	}
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parsedBody is the request body and the transactions parsed from it, read once per request.
+type parsedBody struct {
+	raw          []byte
+	readErr      error
+	transactions []Transaction
+	err          error
+}
+
+// describeJSONError explains why the body did not unmarshal into transactions, including where.
+func describeJSONError(err error) string {
+	switch jsonErr := err.(type) {
+	case *json.UnmarshalTypeError:
+		return fmt.Sprintf("%s expects %s but got a %s at offset %d", jsonErr.Field, jsonErr.Type, jsonErr.Value, jsonErr.Offset)
+	case *json.SyntaxError:
+		return fmt.Sprintf("%s at offset %d", jsonErr, jsonErr.Offset)
+	}
+
+	return err.Error()
+}
+
+// parseBody reads the request body and parses the transactions in it.
+// The body is left readable for handlers that read it directly.
+func parseBody(r *http.Request) *parsedBody {
+	parsed := &parsedBody{}
+
+	jsonBytes, err := ioutil.ReadAll(r.Body)
+	jsonBytes = trimByteOrderMark(jsonBytes)
+	r.Body = ioutil.NopCloser(bytes.NewReader(jsonBytes))
+	parsed.raw, parsed.readErr = jsonBytes, err
+
+	// Check the complexity before anything is decoded, in case validateJSON is not configured
+	if err := checkJSONComplexity(jsonBytes, getConfig()); err != nil {
+		parsed.err = err
+		return parsed
+	}
+
+	// Determine if JSON is a single object or an array of objects. The push endpoints
+	// decide by their path: only the batch endpoint takes an array.
+	body := bytes.TrimLeft(jsonBytes, " \t\r\n")
+	if isPushEndpoint(r) && len(body) > 0 && bytes.HasPrefix(body, []byte("[")) != isBatchEndpoint(r) {
+		detail := "the body must be a single transaction object"
+		if isBatchEndpoint(r) {
+			detail = "the body must be an array of transactions"
+		}
+		parsed.err = &ErrorMessage{Message: "PARSE_ERROR", Detail: detail}
+		return parsed
+	}
+
+	var transactions []Transaction
+	if bytes.HasPrefix(body, []byte("{")) {
+		// Single Object
+		var transaction Transaction
+		err := json.Unmarshal(jsonBytes, &transaction)
+
+		if err != nil {
+			parsed.err = &ErrorMessage{Message: "PARSE_ERROR", Detail: "PARSE_ERROR_OBJECT: " + describeJSONError(err)}
+			return parsed
+		}
+
+		transactions = append(transactions, transaction)
+	} else if bytes.HasPrefix(body, []byte("[")) {
+		// Array of Objects
+		err := json.Unmarshal(jsonBytes, &transactions)
+
+		if err != nil {
+			parsed.err = &ErrorMessage{Message: "PARSE_ERROR", Detail: "PARSE_ERROR_ARRAY: " + describeJSONError(err)}
+			return parsed
+		}
+	} else if len(body) > 0 && isPushEndpoint(r) {
+		// Strings, numbers and literals cannot be transactions
+		parsed.err = &ErrorMessage{Message: "PARSE_ERROR", Detail: "the body is not a JSON object or array"}
+		return parsed
+	}
+
+	// Decode packed transactions so their actions are validated like any other
+	for i := range transactions {
+		err := unpackTransaction(&transactions[i])
+		if err != nil {
+			parsed.err = errors.New(batchMessage(r, err.Error(), i))
+			return parsed
+		}
+	}
+
+	parsed.transactions = transactions
+	return parsed
+}
+
+// getParsedBody returns the body parsed by parseTransactions, or parses it when the
+// middleware runs on its own. The returned context holds the parsed body for the next handler.
+func getParsedBody(r *http.Request) (*parsedBody, context.Context) {
+	if parsed, exists := r.Context().Value(bodyKey).(*parsedBody); exists {
+		return parsed, r.Context()
+	}
+
+	parsed := parseBody(r)
+	return parsed, context.WithValue(r.Context(), bodyKey, parsed)
+}
+
+// parseTransactions reads and parses the body once, at the head of the chain, so the
+// middleware and forwardCallToNodeos all use the same copy. Parse errors are reported
+// by the first middleware that asks for the transactions.
+func parseTransactions(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, ctx := getParsedBody(r)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// getTransactions returns the transactions in the request body
+func getTransactions(r *http.Request) ([]Transaction, context.Context, error) {
+	parsed, ctx := getParsedBody(r)
+	if parsed.err != nil {
+		return nil, nil, parsed.err
+	}
+
+	return parsed.transactions, ctx, nil
+}
+
+// Walks through the middleware list in reverse order and
+// pass the return value into the function before it so they are called
+// in the correct order.
+// Middleware pattern inspired by https://hackernoon.com/simple-http-middleware-with-go-79a4ad62889b
+func chainMiddleware(mw ...middleware) middleware {
+	return func(final http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			last := final
+			for i := len(mw) - 1; i >= 0; i-- {
+				last = mw[i](last)
+			}
+			last(w, r)
+		}
+	}
+}
+
+// hopByHopHeaders only apply to a single connection, so the proxy never forwards them (RFC 7230, section 6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// isHopByHopHeader reports whether the header only applies to the connection it was received on:
+// one of the hopByHopHeaders, or one listed in the Connection header.
+func isHopByHopHeader(key string, headers http.Header) bool {
+	for _, header := range hopByHopHeaders {
+		if key == header {
+			return true
+		}
+	}
+
+	for _, value := range headers["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if http.CanonicalHeaderKey(strings.TrimSpace(name)) == key {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// copyHeaders copies the end-to-end headers between the client and nodeos, in either direction.
+func copyHeaders(response http.Header, request http.Header) {
+	for key, value := range request {
+		if isHopByHopHeader(key, request) {
+			continue
+		}
+
+		for _, header := range value {
+			response.Add(key, header)
+		}
+	}
+}
+
+// isSafePath reports whether the request path, once decoded, has no parent directory segments and no null bytes.
+func isSafePath(requestURL *url.URL) bool {
+	if strings.ContainsRune(requestURL.Path, 0) {
+		return false
+	}
+
+	for _, segment := range strings.Split(requestURL.Path, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// If the request passes all middleware validations
+// we forward it to the node to be processed. The validated body is sent from
+// the parsed copy and the response is streamed back to the client.
+func forwardCallToNodeos(w http.ResponseWriter, r *http.Request) {
+	// The path is forwarded as is, so it must not be able to escape nodeosUpstream
+	if !isSafePath(r.URL) {
+		logFailure("INVALID_PATH", w, r, 0)
+		return
+	}
+
+	// Nodeos does not answer OPTIONS, so the allowed methods are sent by patroneos
+	if r.Method == "OPTIONS" {
+		writeOptions(w, r)
+		return
+	}
+
+	config := getConfig()
+	parsed, _ := getParsedBody(r)
+
+	cacheKey := ""
+	if isCacheable(config, r) {
+		cacheKey = getCacheKey(r, parsed.raw)
+		if cached := responses.get(cacheKey); cached != nil {
+			logSuccess("SUCCESS", r, 0)
+			setResponseHeaders(w, r, cached.header)
+			w.Header().Set(cacheHeader, "HIT")
+			w.WriteHeader(cached.statusCode)
+			if _, err := w.Write(cached.body); err != nil {
+				log.Printf("Error writing response body %s", err)
+			}
+			return
+		}
+	}
+
+	start := time.Now()
+	res, err := doUpstreamRequest(config, r, parsed.raw)
+	upstreamDuration := time.Since(start)
+
+	// Nobody is left to answer when the client disconnected, and neither nodeos nor the client is at fault
+	if err != nil && errors.Is(r.Context().Err(), context.Canceled) {
+		log.Printf("Client disconnected: %s %s%s", getHost(r), r.URL.Path, requestIDSuffix(r))
+		return
+	}
+
+	if err != nil {
+		logUpstreamFailure(err, w, r)
+		return
+	}
+
+	// Closing the body before the end also closes the connection to nodeos
+	defer res.Body.Close()
+
+	// The credentials of patroneos were refused, which the client cannot do anything about
+	if res.StatusCode == http.StatusUnauthorized {
+		logUpstreamFailure(errUpstreamUnauthorized, w, r)
+		return
+	}
+
+	body := io.Reader(res.Body)
+	maxResponseBytes := int64(config.MaxResponseBytes)
+	if maxResponseBytes > 0 && r.Method != "HEAD" {
+		if res.ContentLength > maxResponseBytes {
+			logUpstreamFailure(fmt.Errorf("%w: the response to %s is %d bytes, the limit is %d", errResponseTooLarge, r.URL.Path, res.ContentLength, config.MaxResponseBytes), w, r)
+			return
+		}
+		body = io.LimitReader(res.Body, maxResponseBytes)
+	}
+
+	upstreamLatency.record(upstreamDuration)
+
+	if res.StatusCode == 200 {
+		logSuccess("SUCCESS", r, upstreamDuration)
+	} else if res.StatusCode < 500 {
+		logFailure("TRANSACTION_FAILED", nil, r, 0)
+	} else {
+		var errorCode string
+		if len(config.PenalizedNodeosErrors) > 0 {
+			errorCode, body = peekNodeosErrorCode(body)
+		}
+
+		// Nodeos answers with a 5xx when it is overloaded or restarting, which is not the fault of the client
+		if isPenalizedNodeosError(config, errorCode) {
+			logFailure("TRANSACTION_FAILED", nil, r, 0)
+		} else {
+			log.Printf("Upstream failure: %s UPSTREAM_ERROR (nodeos answered %d)%s", getHost(r), res.StatusCode, requestIDSuffix(r))
+		}
+	}
+
+	setResponseHeaders(w, r, res.Header)
+	if config.UpstreamDurationHeader {
+		w.Header().Set("X-Upstream-Duration-Ms", strconv.FormatInt(upstreamDuration.Milliseconds(), 10))
+	}
+
+	// Successful responses to cached paths are kept while they are relayed
+	var capture *cacheCapture
+	output := io.Writer(w)
+	if cacheKey != "" {
+		w.Header().Set(cacheHeader, "MISS")
+		if res.StatusCode == 200 {
+			capture = &cacheCapture{}
+			output = io.MultiWriter(w, capture)
+		}
+	}
+
+	w.WriteHeader(res.StatusCode)
+
+	// Responses to HEAD only have headers, whatever nodeos sent
+	if r.Method == "HEAD" {
+		return
+	}
+
+	// Stream the response so large blocks and history queries are never held in memory
+	written, err := io.Copy(output, body)
+	if err != nil {
+		log.Printf("Error writing response body %s", err)
+		return
+	}
+
+	// Responses without a Content-Length are only found to be too large once the headers are sent,
+	// so the connection is dropped to let the client know the response is incomplete
+	if maxResponseBytes > 0 && written == maxResponseBytes && isTruncated(res.Body) {
+		logUpstreamFailure(fmt.Errorf("%w: the response to %s is larger than the limit of %d bytes", errResponseTooLarge, r.URL.Path, config.MaxResponseBytes), nil, r)
+		panic(http.ErrAbortHandler)
+	}
+
+	if capture != nil && !capture.overflow {
+		responses.store(config, &cachedResponse{key: cacheKey, statusCode: res.StatusCode, header: res.Header.Clone(), body: capture.body})
+	}
+}
+
+// setResponseHeaders sets the headers of a nodeos response on the response to the client,
+// with the request ID, our CORS headers and the injected headers.
+func setResponseHeaders(w http.ResponseWriter, r *http.Request, header http.Header) {
+	copyHeaders(w.Header(), header)
+	if id := getRequestID(r); id != "" {
+		w.Header().Set(requestIDHeader, id)
+	}
+
+	// Our CORS headers replace any set by nodeos
+	setCORSHeaders(w.Header(), r)
+
+	// Inject configured headers
+	injectHeaders(w.Header())
+}
+
+// maxErrorPeekBytes bounds how much of an error response is read to find its nodeos error code.
+const maxErrorPeekBytes = 64 * 1024
+
+// peekNodeosErrorCode returns the code of the nodeos error in a response body, such as 3080004 for
+// tx_cpu_usage_exceeded, or "" when it has none. The returned reader still reads the whole body.
+func peekNodeosErrorCode(body io.Reader) (string, io.Reader) {
+	peeked, _ := ioutil.ReadAll(io.LimitReader(body, maxErrorPeekBytes))
+	body = io.MultiReader(bytes.NewReader(peeked), body)
+
+	var response struct {
+		Error struct {
+			Code json.Number `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(peeked, &response) != nil {
+		return "", body
+	}
+
+	return response.Error.Code.String(), body
+}
+
+// isPenalizedNodeosError reports whether a nodeos error code starts with one of penalizedNodeosErrors,
+// so "3080" matches every resource exhaustion error.
+func isPenalizedNodeosError(config *Config, errorCode string) bool {
+	if errorCode == "" {
+		return false
+	}
+
+	for _, code := range config.PenalizedNodeosErrors {
+		if strings.HasPrefix(errorCode, code) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTruncated reports whether the body has more to read.
+func isTruncated(body io.Reader) bool {
+	n, _ := io.ReadFull(body, make([]byte, 1))
+	return n > 0
+}
+
+func relay(w http.ResponseWriter, r *http.Request) {
+	message := "Patroneos cannot receive fail2ban relay requests when running in filter mode. Please check your config."
+	log.Printf("%s", message)
+
+	errorBody, _ := json.Marshal(ErrorMessage{Message: message, Code: 403})
+
+	w.WriteHeader(http.StatusForbidden)
+	_, err := w.Write(errorBody)
 
 	if err != nil {
 		log.Printf("Error writing response body %s", err)
@@ -370,16 +1782,508 @@ func relay(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// filterMiddlewares maps the names accepted in filterEndpoints to their middleware.
+var filterMiddlewares = map[string]middleware{
+	"validateContentType":       validateContentType,
+	"validateJSON":              validateJSON,
+	"validateMaxTransactions":   validateMaxTransactions,
+	"validateMaxActions":        validateMaxActions,
+	"validateMaxAuthorizations": validateMaxAuthorizations,
+	"validateTransactionSize":   validateTransactionSize,
+	"validateActionData":        validateActionData,
+	"validateMaxSignatures":     validateMaxSignatures,
+	"validateSignatureFormat":   validateSignatureFormat,
+	"validateContract":          validateContract,
+	"validateContractWhitelist": validateContractWhitelist,
+	"validateActor":             validateActor,
+	"validateRecipients":        validateRecipients,
+	"validateAction":            validateAction,
+	"validateRules":             validateRules,
+	"validateSystemActions":     validateSystemActions,
+	"validateNotEmpty":          validateNotEmpty,
+	"validateExpiration":        validateExpiration,
+	"validateDelay":             validateDelay,
+	"validateDuplicate":         validateDuplicate,
+	"validateActorRate":         validateActorRate,
+}
+
+// defaultFilterEndpoints is the middleware chain used when filterEndpoints is empty.
+var defaultFilterEndpoints = []string{
+	"validateContentType",
+	"validateJSON",
+	"validateMaxTransactions",
+	"validateMaxActions",
+	"validateMaxAuthorizations",
+	"validateTransactionSize",
+	"validateActionData",
+	"validateMaxSignatures",
+	"validateSignatureFormat",
+	"validateContract",
+	"validateContractWhitelist",
+	"validateActor",
+	"validateRecipients",
+	"validateAction",
+	"validateRules",
+	"validateSystemActions",
+	"validateNotEmpty",
+	"validateExpiration",
+	"validateDelay",
+	"validateDuplicate",
+	"validateActorRate",
+}
+
+// getMiddlewareChain builds the chain for the named middleware, in order.
+func getMiddlewareChain(names []string) (middleware, error) {
+	mw, err := getMiddlewares(names)
+	if err != nil {
+		return nil, err
+	}
+
+	return chainMiddleware(mw...), nil
+}
+
+// getMiddlewares returns the named middleware, in order.
+func getMiddlewares(names []string) ([]middleware, error) {
+	if len(names) == 0 {
+		names = defaultFilterEndpoints
+	}
+
+	var mw []middleware
+	for _, name := range names {
+		filter, exists := filterMiddlewares[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		mw = append(mw, filter)
+	}
+
+	return mw, nil
+}
+
+// auditWriter stands in for the response writer of a middleware in audit mode.
+// logFailure marks it as rejected instead of writing an error response.
+type auditWriter struct {
+	header   http.Header
+	rejected bool
+}
+
+func (writer *auditWriter) Header() http.Header {
+	return writer.header
+}
+
+func (writer *auditWriter) Write(body []byte) (int, error) {
+	return len(body), nil
+}
+
+func (writer *auditWriter) WriteHeader(statusCode int) {}
+
+// auditMiddlewares wraps each middleware with auditMiddleware.
+func auditMiddlewares(mw []middleware) []middleware {
+	audited := make([]middleware, len(mw))
+	for i, filter := range mw {
+		audited[i] = auditMiddleware(filter)
+	}
+
+	return audited
+}
+
+// auditMiddleware runs a middleware without letting it reject the request.
+// When the middleware does not call the next handler, the request is passed on anyway.
+func auditMiddleware(filter middleware) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			writer := &auditWriter{header: make(http.Header)}
+			called := false
+
+			filter(func(_ http.ResponseWriter, request *http.Request) {
+				called = true
+				next.ServeHTTP(w, request)
+			})(writer, r)
+
+			if !called {
+				next.ServeHTTP(w, r)
+			}
+		}
+	}
+}
+
+// matchPathPrefix reports whether the path starts with one of the prefixes.
+// A trailing * on a prefix is ignored, so /v1/chain/* and /v1/chain/ are equivalent.
+func matchPathPrefix(prefixes []string, requestPath string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(requestPath, strings.TrimSuffix(prefix, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateURLLength rejects requests whose path and query are longer than maxURLLength with 414.
+// It is skipped when maxURLLength is not configured, or set to 0.
+func validateURLLength(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		maxURLLength := getConfig().MaxURLLength
+		if length := len(r.URL.RequestURI()); maxURLLength > 0 && length > maxURLLength {
+			logFailureDetails(ErrorMessage{
+				Message:  "URL_TOO_LONG",
+				Detail:   fmt.Sprintf("the URL is %d characters, the limit is %d", length, maxURLLength),
+				Limit:    intPointer(maxURLLength),
+				Observed: intPointer(length),
+			}, w, r, http.StatusRequestURITooLong)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// validateHeaders rejects requests with more than maxHeaderFields header values, or a header value
+// longer than maxHeaderValueLength, with 431. Limits that are 0 are not checked.
+func validateHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		if config.MaxHeaderFields <= 0 && config.MaxHeaderValueLength <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		fields := 0
+		for name, values := range r.Header {
+			fields += len(values)
+			if config.MaxHeaderFields > 0 && fields > config.MaxHeaderFields {
+				logFailureDetails(ErrorMessage{
+					Message: "OVERSIZED_HEADERS",
+					Detail:  fmt.Sprintf("the request has more than %d header fields", config.MaxHeaderFields),
+					Limit:   intPointer(config.MaxHeaderFields),
+				}, w, r, http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+
+			for _, value := range values {
+				if config.MaxHeaderValueLength > 0 && len(value) > config.MaxHeaderValueLength {
+					logFailureDetails(ErrorMessage{
+						Message:  "OVERSIZED_HEADERS",
+						Detail:   fmt.Sprintf("the %s header is %d characters, the limit is %d", name, len(value), config.MaxHeaderValueLength),
+						Limit:    intPointer(config.MaxHeaderValueLength),
+						Observed: intPointer(len(value)),
+					}, w, r, http.StatusRequestHeaderFieldsTooLarge)
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// headerPatterns holds the map[string][]*regexp.Regexp compiled from blockedHeaderPatterns in the running configuration,
+// keyed by canonical header name.
+var headerPatterns atomic.Value
+
+// compileHeaderPatterns compiles the valid blockedHeaderPatterns. Invalid patterns are rejected by validateConfig.
+func compileHeaderPatterns(patterns map[string][]string) map[string][]*regexp.Regexp {
+	compiled := map[string][]*regexp.Regexp{}
+	for header, expressions := range patterns {
+		name := http.CanonicalHeaderKey(header)
+		for _, expression := range expressions {
+			pattern, err := regexp.Compile(expression)
+			if err != nil {
+				log.Printf("Ignoring invalid header pattern %s %s", expression, err)
+				continue
+			}
+			compiled[name] = append(compiled[name], pattern)
+		}
+	}
+
+	return compiled
+}
+
+// validateClient rejects requests with a header matching one of the blockedHeaderPatterns
+// for that header with 403 BLOCKED_CLIENT. Header names are matched case-insensitively.
+func validateClient(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		patterns, _ := headerPatterns.Load().(map[string][]*regexp.Regexp)
+
+		for name, expressions := range patterns {
+			for _, value := range r.Header[name] {
+				for _, expression := range expressions {
+					if expression.MatchString(value) {
+						logFailureDetails(ErrorMessage{
+							Message: "BLOCKED_CLIENT",
+							Detail:  fmt.Sprintf("the %s header matches %s", name, expression),
+						}, w, r, http.StatusForbidden)
+						return
+					}
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// isMaintenancePath reports whether the path is rejected in maintenance mode: one starting with
+// an entry of maintenancePaths, or one of the push endpoints when maintenancePaths is not set.
+func isMaintenancePath(config *Config, r *http.Request) bool {
+	if len(config.MaintenancePaths) == 0 {
+		return isPushEndpoint(r)
+	}
+
+	return matchPathPrefix(config.MaintenancePaths, path.Clean("/"+r.URL.Path))
+}
+
+// rejectInMaintenance answers requests to the write paths with 503 MAINTENANCE while maintenanceMode is on.
+// Reads keep reaching nodeos. It applies to trusted sources and bypass tokens too.
+func rejectInMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		if config.MaintenanceMode && isMaintenancePath(config, r) {
+			logFailure("MAINTENANCE", w, r, http.StatusServiceUnavailable)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// validatePath checks that the request path is allowed to reach nodeos.
+// Paths must start with an entry of allowedPaths, when it is set, and must not start with an entry of blockedPaths.
+func validatePath(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		requestPath := path.Clean("/" + r.URL.Path)
+
+		if (len(config.AllowedPaths) > 0 && !matchPathPrefix(config.AllowedPaths, requestPath)) ||
+			matchPathPrefix(config.BlockedPaths, requestPath) {
+			logFailure("FORBIDDEN_ENDPOINT", w, r, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// defaultAllowedMethods are the methods accepted on paths without an allowedMethods entry.
+var defaultAllowedMethods = []string{"GET", "POST"}
+
+// getAllowedMethods returns the methods allowed for the path, using the longest matching prefix in allowedMethods.
+func getAllowedMethods(config *Config, requestPath string) []string {
+	methods := defaultAllowedMethods
+	longest := -1
+
+	for prefix, prefixMethods := range config.AllowedMethods {
+		trimmed := strings.TrimSuffix(prefix, "*")
+		if strings.HasPrefix(requestPath, trimmed) && len(trimmed) > longest {
+			methods = prefixMethods
+			longest = len(trimmed)
+		}
+	}
+
+	return methods
+}
+
+// containsMethod reports whether the method is in the list, ignoring case.
+func containsMethod(methods []string, method string) bool {
+	for _, allowed := range methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isMethodAllowed reports whether the method is allowed by the list. HEAD is allowed wherever GET is,
+// and OPTIONS always is since patroneos answers it itself.
+func isMethodAllowed(methods []string, method string) bool {
+	return containsMethod(methods, method) || strings.EqualFold(method, "OPTIONS") ||
+		(strings.EqualFold(method, "HEAD") && containsMethod(methods, "GET"))
+}
+
+// getAllowHeader returns the Allow header listing the allowed methods, with HEAD and OPTIONS.
+func getAllowHeader(methods []string) string {
+	allowed := append([]string{}, methods...)
+	if containsMethod(methods, "GET") && !containsMethod(methods, "HEAD") {
+		allowed = append(allowed, "HEAD")
+	}
+	if !containsMethod(methods, "OPTIONS") {
+		allowed = append(allowed, "OPTIONS")
+	}
+
+	return strings.Join(allowed, ", ")
+}
+
+// writeOptions answers an OPTIONS request that is not a CORS preflight with the methods allowed for the path.
+func writeOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", getAllowHeader(getAllowedMethods(getConfig(), path.Clean("/"+r.URL.Path))))
+	injectHeaders(w.Header())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateMethod checks that the request method is allowed for the path.
+// CORS preflight requests pass when the method they ask for is allowed.
+func validateMethod(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		methods := getAllowedMethods(getConfig(), path.Clean("/"+r.URL.Path))
+
+		method := r.Method
+		if preflight := r.Header.Get("Access-Control-Request-Method"); method == "OPTIONS" && preflight != "" {
+			method = preflight
+		}
+
+		if !isMethodAllowed(methods, method) {
+			w.Header().Set("Allow", getAllowHeader(methods))
+			logFailure("METHOD_NOT_ALLOWED", w, r, http.StatusMethodNotAllowed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// limitBodySize reads at most maxBodyBytes of the request body before any other middleware parses it.
+// Larger bodies are rejected with 413. It is skipped when maxBodyBytes is not configured, or set to 0.
+func limitBodySize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		maxBodyBytes := int64(getConfig().MaxBodyBytes)
+		if maxBodyBytes > 0 {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+			if err != nil {
+				if int64(len(body)) >= maxBodyBytes {
+					logFailureDetails(ErrorMessage{
+						Message: "BODY_TOO_LARGE",
+						Detail:  fmt.Sprintf("the body is larger than %d bytes", maxBodyBytes),
+						Limit:   intPointer(int(maxBodyBytes)),
+					}, w, r, http.StatusRequestEntityTooLarge)
+				} else {
+					log.Printf("Error reading request body %s", err)
+					logFailure("BODY_NOT_READ", w, r, 0)
+				}
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// defaultMaxDecodedBodyBytes bounds decompressed bodies when maxBodyBytes is not set, so a few
+// kilobytes of gzip cannot expand into gigabytes in memory.
+const defaultMaxDecodedBodyBytes = 10 * 1024 * 1024
+
+// decodeBody decompresses gzip and deflate request bodies so the middleware validates the decompressed JSON.
+// The decompressed body is forwarded to nodeos without the Content-Encoding header, and is limited to maxBodyBytes,
+// or to defaultMaxDecodedBodyBytes when it is not set.
+func decodeBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var decompressor io.ReadCloser
+		var err error
+		switch encoding {
+		case "gzip", "x-gzip":
+			decompressor, err = gzip.NewReader(r.Body)
+		case "deflate":
+			decompressor, err = zlib.NewReader(r.Body)
+		default:
+			logFailure("UNSUPPORTED_CONTENT_ENCODING", w, r, http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			logFailure("INVALID_CONTENT_ENCODING", w, r, 0)
+			return
+		}
+		defer decompressor.Close()
+
+		maxBodyBytes := int64(getConfig().MaxBodyBytes)
+		if maxBodyBytes <= 0 {
+			maxBodyBytes = defaultMaxDecodedBodyBytes
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(decompressor, maxBodyBytes+1))
+		if err != nil {
+			logFailure("INVALID_CONTENT_ENCODING", w, r, 0)
+			return
+		}
+		if int64(len(body)) > maxBodyBytes {
+			logFailureDetails(ErrorMessage{
+				Message: "BODY_TOO_LARGE",
+				Detail:  fmt.Sprintf("the decompressed body is larger than %d bytes", maxBodyBytes),
+				Limit:   intPointer(int(maxBodyBytes)),
+			}, w, r, http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// configuredMiddleware runs the middleware chain named in filterEndpoints.
+// The chain is resolved on every request so config updates take effect immediately.
+func configuredMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Bypass tokens are never forwarded to nodeos
+		token := r.Header.Get(bypassHeader)
+		r.Header.Del(bypassHeader)
+
+		config := getConfig()
+		trusted := isTrustedSource(r)
+		if !trusted && token != "" && len(config.BypassTokens) > 0 {
+			label, valid := matchBypassToken(config.BypassTokens, token)
+			if !valid {
+				logFailure("BAD_BYPASS_TOKEN", w, r, 0)
+				return
+			}
+
+			log.Printf("Bypass: %s %s", getHost(r), label)
+			trusted = true
+		}
+
+		// Trusted sources and bypass tokens skip the transaction filters and the client check,
+		// not the path and method checks
+		var filters []middleware
+		access := []middleware{validatePath, validateMethod}
+		if !trusted {
+			var err error
+			filters, err = getMiddlewares(config.FilterEndpoints)
+			if err != nil {
+				log.Printf("Error building middleware chain %s", err)
+				logFailure("INVALID_FILTER_CONFIG", w, r, 500)
+				return
+			}
+
+			if config.StrictParsing {
+				filters = append([]middleware{validateStrictParsing}, filters...)
+			}
+
+			access = append([]middleware{validateClient}, access...)
+		}
+
+		if config.AuditMode {
+			access = auditMiddlewares(access)
+			filters = auditMiddlewares(filters)
+		}
+
+		// The URL, header and body limits protect patroneos itself, so they are enforced even in audit mode
+		filters = append(append(append([]middleware{validateURLLength, validateHeaders}, access...), limitBodySize, decodeBody, parseTransactions), filters...)
+
+		chainMiddleware(filters...)(next)(w, r)
+	}
+}
+
 func addFilterHandlers(mux *http.ServeMux) {
-	// Middleware are executed in the order that they are passed to chainMiddleware.
-	middlewareChain := chainMiddleware(
-		validateJSON,
-		validateMaxTransactions,
-		validateTransactionSize,
-		validateMaxSignatures,
-		validateContract,
-	)
-
-	mux.HandleFunc("/", middlewareChain(forwardCallToNodeos))
+	// Middleware are executed in the order that they are listed in filterEndpoints.
+	mux.HandleFunc("/", assignRequestID(limitConcurrency(handleCORS(rejectInMaintenance(configuredMiddleware(forwardCallToNodeos))))))
 	mux.HandleFunc("/patroneos/fail2ban-relay", relay)
 }
@@ -4,11 +4,20 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type TestStruct struct {
@@ -20,11 +29,14 @@ type TestStruct struct {
 }
 
 func setConfig() {
-	appConfig = Config{}
-	appConfig.ContractBlackList = map[string]bool{"currency": true}
-	appConfig.MaxSignatures = 1
-	appConfig.MaxTransactionSize = 50
-	appConfig.MaxTransactions = 2
+	config := Config{}
+	config.ContractBlackList = map[string]bool{"currency": true}
+	config.AccountBlackList = map[string]bool{"spammer": true}
+	config.MaxSignatures = 1
+	config.MaxTransactionSize = 50
+	config.MaxTransactions = 2
+	config.MaxActions = 2
+	storeConfig(config)
 }
 
 func getTestHandler() http.HandlerFunc {
@@ -65,8 +77,15 @@ func verifyMiddleware(t *testing.T, ts *httptest.Server, tc TestStruct) {
 }
 
 func TestGetHostHeader(t *testing.T) {
-	host := "testing"
+	setConfig()
+	config := *getConfig()
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	storeConfig(config)
+	defer setConfig()
+
+	host := "198.51.100.7"
 	req, _ := http.NewRequest("GET", "localhost", nil)
+	req.RemoteAddr = "10.0.0.2:8080"
 	req.Header.Set("X-Forwarded-For", host)
 
 	if getHost(req) != host {
@@ -74,6 +93,43 @@ func TestGetHostHeader(t *testing.T) {
 	}
 }
 
+func TestGetHostSpoofed(t *testing.T) {
+	setConfig()
+	config := *getConfig()
+	config.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::/32"}
+	storeConfig(config)
+	defer setConfig()
+
+	tests := []struct {
+		description  string
+		remoteAddr   string
+		forwardedFor []string
+		expected     string
+	}{
+		{"untrusted peer", "192.0.2.1:1234", []string{"10.0.0.5"}, "192.0.2.1"},
+		{"untrusted IPv6 peer", "[2001:db9::1]:1234", []string{"198.51.100.7"}, "2001:db9::1"},
+		{"forged entries left of the client", "10.0.0.2:8080", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.2:8080", []string{"198.51.100.7, 10.0.0.3, 2001:db8::3"}, "198.51.100.7"},
+		{"repeated headers", "10.0.0.2:8080", []string{"203.0.113.9", "198.51.100.7, 10.0.0.3"}, "198.51.100.7"},
+		{"entry with a port", "10.0.0.2:8080", []string{"198.51.100.7:5555"}, "198.51.100.7"},
+		{"only trusted proxies", "10.0.0.2:8080", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"garbage entry", "10.0.0.2:8080", []string{"198.51.100.7, evil, 10.0.0.3"}, "10.0.0.3"},
+		{"trusted proxy without header", "10.0.0.2:8080", nil, "10.0.0.2"},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/v1/chain/get_info", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for _, header := range tc.forwardedFor {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+
+		if host := getHost(req); host != tc.expected {
+			t.Errorf("%s: expected host to be %s and got %s.", tc.description, tc.expected, host)
+		}
+	}
+}
+
 func TestGetHostRemoteAddr(t *testing.T) {
 	host := "192.168.0.1"
 	req, _ := http.NewRequest("GET", "localhost", nil)
@@ -92,6 +148,27 @@ func TestValidateJSON(t *testing.T) {
 			expectedBody: "{\"message\":\"INVALID_JSON\",\"code\":400}",
 			expectedCode: 400,
 		},
+		{
+			description:  "concatenated objects",
+			url:          "/",
+			body:         []byte(`{"name": "Tony Stark"}{"name": "Steve Rogers"}`),
+			expectedBody: "{\"message\":\"INVALID_JSON\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "newline delimited",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte("{\"actions\": []}\n{\"actions\": []}\n"),
+			expectedBody: "{\"message\":\"INVALID_JSON\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "trailing garbage",
+			url:          "/",
+			body:         []byte(`["Tony Stark"] garbage`),
+			expectedBody: "{\"message\":\"INVALID_JSON\",\"code\":400}",
+			expectedCode: 400,
+		},
 		{
 			description:  "valid",
 			url:          "/",
@@ -99,6 +176,13 @@ func TestValidateJSON(t *testing.T) {
 			expectedBody: "SUCCESS\n",
 			expectedCode: 200,
 		},
+		{
+			description:  "trailing whitespace",
+			url:          "/",
+			body:         []byte("{\"name\": \"Tony Stark\"}\r\n"),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
 	}
 
 	ts := httptest.NewServer(validateJSON(getTestHandler()))
@@ -159,8 +243,8 @@ func TestValidateContract(t *testing.T) {
 			description:  "invalid",
 			url:          "/",
 			body:         invalidBody,
-			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":400}",
-			expectedCode: 400,
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+			expectedCode: 403,
 		},
 		{
 			description:  "valid",
@@ -225,6 +309,54 @@ func TestValidateSignatures(t *testing.T) {
 	}
 }
 
+func TestValidateTotalSignatures(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "too many in total",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`[{"signatures": ["a"]}, {"signatures": ["b"]}, {"signatures": ["c"]}]`),
+			expectedBody: "{\"message\":\"INVALID_NUMBER_SIGNATURES:TOTAL\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "duplicate",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`[{"signatures": ["a"]}, {"signatures": ["a"]}]`),
+			expectedBody: "{\"message\":\"DUPLICATE_SIGNATURE[1]\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "valid",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`[{"signatures": ["a"]}, {"signatures": ["b"]}]`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateMaxSignatures(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+
+	// Duplicates are accepted unless rejectDuplicateSignatures is set
+	verifyMiddleware(t, ts, TestStruct{
+		url:          "/v1/chain/push_transactions",
+		body:         []byte(`[{"signatures": ["a"]}, {"signatures": ["a"]}, {"signatures": ["a"]}]`),
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+
+	config := *getConfig()
+	config.MaxTotalSignatures = 2
+	config.RejectDuplicateSignatures = true
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
 func TestValidateTransactionSize(t *testing.T) {
 	invalidAction := Action{
 		Code: "tokens",
@@ -249,8 +381,8 @@ func TestValidateTransactionSize(t *testing.T) {
 			description:  "invalid",
 			url:          "/",
 			body:         invalidBody,
-			expectedBody: "{\"message\":\"INVALID_TRANSACTION_SIZE\",\"code\":400}",
-			expectedCode: 400,
+			expectedBody: "{\"message\":\"INVALID_TRANSACTION_SIZE\",\"code\":413}",
+			expectedCode: 413,
 		},
 		{
 			description:  "valid",
@@ -270,4 +402,2450 @@ func TestValidateTransactionSize(t *testing.T) {
 		verifyMiddleware(t, ts, tc)
 	}
 
+	// Per-contract limits override the global limit in both directions
+	config := *getConfig()
+	config.MaxTransactionSizePerContract = map[string]int{"tokens": 200, "storage": 2}
+	storeConfig(config)
+
+	storageTransaction := validTransaction
+	storageTransaction.Actions = []Action{{Code: "storage", Data: "abcd"}}
+	storageBody, _ := json.Marshal(storageTransaction)
+
+	perContractTests := []TestStruct{
+		{
+			description:  "larger contract limit",
+			url:          "/",
+			body:         invalidBody,
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "smaller contract limit",
+			url:          "/",
+			body:         storageBody,
+			expectedBody: "{\"message\":\"INVALID_TRANSACTION_SIZE:storage\",\"code\":413}",
+			expectedCode: 413,
+		},
+	}
+
+	for _, tc := range perContractTests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	// Many actions that are each small enough can still exceed the total
+	config.MaxTotalTransactionSize = 100
+	storeConfig(config)
+
+	manyActions := validTransaction
+	manyActions.Actions = []Action{}
+	for i := 0; i < 30; i++ {
+		manyActions.Actions = append(manyActions.Actions, validAction)
+	}
+	manyActionsBody, _ := json.Marshal(manyActions)
+
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "total too large",
+		url:          "/",
+		body:         manyActionsBody,
+		expectedBody: "{\"message\":\"INVALID_TRANSACTION_SIZE:TOTAL\",\"code\":413}",
+		expectedCode: 413,
+	})
+	verifyMiddleware(t, ts, tests[1])
+}
+
+func TestConfiguredMiddleware(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "too many transactions with only validateJSON",
+			url:          "/",
+			body:         []byte(`[{"name": "Tony Stark"}, {"name": "Steve Rogers"},{"name": "Bruce Banner"}]`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "invalid json with only validateJSON",
+			url:          "/",
+			body:         []byte(`{"name"}`),
+			expectedBody: "{\"message\":\"INVALID_JSON\",\"code\":400}",
+			expectedCode: 400,
+		},
+	}
+
+	ts := httptest.NewServer(configuredMiddleware(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.FilterEndpoints = []string{"validateJSON"}
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	setConfig()
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "too many transactions with the default chain",
+		url:          "/",
+		body:         []byte(`[{"name": "Tony Stark"}, {"name": "Steve Rogers"},{"name": "Bruce Banner"}]`),
+		expectedBody: "{\"message\":\"TOO_MANY_TRANSACTIONS\",\"code\":400}",
+		expectedCode: 400,
+	})
+}
+
+func TestGetMiddlewareChainUnknown(t *testing.T) {
+	if _, err := getMiddlewareChain([]string{"validateJSON", "validateNothing"}); err == nil {
+		t.Errorf("Expected an error for an unknown middleware.")
+	}
+}
+
+func TestIsAccountName(t *testing.T) {
+	tests := map[string]bool{
+		"eosio":          true,
+		"eosio.token":    true,
+		"spamcoin1":      true,
+		"abcdefghijklj":  true,
+		"abcdefghijklz":  false,
+		"abcdefghijklmn": false,
+		"Eosio":          false,
+		"eosio6":         false,
+		"eosio.":         false,
+		"":               false,
+	}
+
+	for name, expected := range tests {
+		if isAccountName(name) != expected {
+			t.Errorf("Expected isAccountName(%q) to be %t.", name, expected)
+		}
+	}
+}
+
+func TestGetNodeosURL(t *testing.T) {
+	tests := []struct {
+		config   Config
+		request  string
+		expected string
+	}{
+		{
+			config:   Config{NodeosProtocol: "http", NodeosURL: "localhost", NodeosPort: "8888"},
+			request:  "/v1/chain/get_info",
+			expected: "http://localhost:8888/v1/chain/get_info",
+		},
+		{
+			config:   Config{NodeosProtocol: "http", NodeosURL: "localhost", NodeosPort: "8888", NodeosUpstream: "https://api.example.com:8888/nodeos"},
+			request:  "/v1/chain/get_info",
+			expected: "https://api.example.com:8888/nodeos/v1/chain/get_info",
+		},
+		{
+			config:   Config{NodeosUpstream: "https://api.example.com/nodeos/"},
+			request:  "/v1/chain/get_table_rows?scope=eosio%2Etoken&limit=10",
+			expected: "https://api.example.com/nodeos/v1/chain/get_table_rows?scope=eosio%2Etoken&limit=10",
+		},
+		{
+			config:   Config{NodeosUpstream: "http://nodeos:8888"},
+			request:  "/v1/chain/get_account%20name",
+			expected: "http://nodeos:8888/v1/chain/get_account%20name",
+		},
+		{
+			config:   Config{NodeosUpstream: "http://nodeos:8888", NodeosPathPrefix: "/eos/"},
+			request:  "/v1/chain/get_table_rows?scope=eosio%2Etoken&limit=10",
+			expected: "http://nodeos:8888/eos/v1/chain/get_table_rows?scope=eosio%2Etoken&limit=10",
+		},
+		{
+			config:   Config{NodeosUpstream: "http://nodeos:8888", StripPathPrefix: "/api"},
+			request:  "/api/v1/chain/get_account%20name?json=true",
+			expected: "http://nodeos:8888/v1/chain/get_account%20name?json=true",
+		},
+		{
+			config:   Config{NodeosUpstream: "http://nodeos:8888/", StripPathPrefix: "api/", NodeosPathPrefix: "main net"},
+			request:  "/api/v1/chain/get_info",
+			expected: "http://nodeos:8888/main%20net/v1/chain/get_info",
+		},
+		{
+			config:   Config{NodeosUpstream: "http://nodeos:8888", StripPathPrefix: "/api"},
+			request:  "/apiv1/chain/get_info",
+			expected: "http://nodeos:8888/apiv1/chain/get_info",
+		},
+		{
+			config:   Config{NodeosUpstream: "http://nodeos:8888", StripPathPrefix: "/api"},
+			request:  "/api",
+			expected: "http://nodeos:8888/",
+		},
+	}
+
+	for _, tc := range tests {
+		requestURL, _ := url.ParseRequestURI(tc.request)
+		if nodeosURL := getNodeosURL(&tc.config, requestURL); nodeosURL != tc.expected {
+			t.Errorf("Expected %s to be forwarded to %s and got %s.", tc.request, tc.expected, nodeosURL)
+		}
+	}
+}
+
+func TestValidateContractWhitelist(t *testing.T) {
+	invalidAction := Action{
+		Code: "tokens",
+		Data: "1234567890",
+	}
+	invalidTransaction := Transaction{
+		Actions:    []Action{invalidAction},
+		Signatures: []string{"12345"},
+	}
+	validTransaction := invalidTransaction
+	validAction := invalidAction
+	validAction.Code = "eosio.token"
+	validTransaction.Actions = make([]Action, 1)
+	validTransaction.Actions[0] = validAction
+
+	invalidBody, _ := json.Marshal(invalidTransaction)
+	validBody, _ := json.Marshal(validTransaction)
+	tests := []TestStruct{
+		{
+			description:  "invalid",
+			url:          "/",
+			body:         invalidBody,
+			expectedBody: "{\"message\":\"WHITELIST_VIOLATION\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "valid",
+			url:          "/",
+			body:         validBody,
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateContractWhitelist(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.ContractWhiteList = map[string]bool{"eosio.token": true}
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	// An empty whitelist allows every contract
+	setConfig()
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "no whitelist",
+		url:          "/",
+		body:         invalidBody,
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+}
+
+func TestValidateActor(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "blacklisted action authorization",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "tokens", "authorization": [{"actor": "spammer", "permission": "active"}]}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_ACCOUNT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "blacklisted authorization in array form",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "tokens", "authorization": [["spammer", "active"]]}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_ACCOUNT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "blacklisted transaction authorization",
+			url:          "/",
+			body:         []byte(`[{"authorizations": [{"actor": "spammer", "permission": "owner"}]}]`),
+			expectedBody: "{\"message\":\"BLACKLISTED_ACCOUNT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "valid",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "tokens", "authorization": [{"actor": "alice", "permission": "active"}]}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "malformed authorization",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "tokens", "authorization": [["alice"]]}]}`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400}",
+			expectedCode: 400,
+		},
+	}
+
+	ts := httptest.NewServer(validateActor(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
+func TestValidateMaxActions(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "invalid",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "tokens"}, {"code": "tokens"}, {"code": "tokens"}]}`),
+			expectedBody: "{\"message\":\"TOO_MANY_ACTIONS\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "valid",
+			url:          "/",
+			body:         []byte(`[{"actions": [{"code": "tokens"}, {"code": "tokens"}]}, {"actions": [{"code": "tokens"}]}]`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateMaxActions(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	// 0 means unlimited
+	config := *getConfig()
+	config.MaxActions = 0
+	storeConfig(config)
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "unlimited",
+		url:          "/",
+		body:         tests[0].body,
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+}
+
+func TestValidateAction(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "exact rule",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "eosio", "type": "buyrambytes"}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_ACTION:eosio::buyrambytes\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "wildcard contract",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "tokens", "type": "transfer"}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_ACTION:*::transfer\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "wildcard action",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "spamcontract", "type": "hi"}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_ACTION:spamcontract::*\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "valid",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "eosio", "type": "delegatebw"}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateAction(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.ActionBlackList = []string{"eosio::buyrambytes", "*::transfer", "spamcontract::*"}
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
+func TestLimitBodySize(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "too large",
+			url:          "/",
+			body:         bytes.Repeat([]byte("a"), 65),
+			expectedBody: "{\"message\":\"BODY_TOO_LARGE\",\"code\":413}",
+			expectedCode: 413,
+		},
+		{
+			description:  "at the limit",
+			url:          "/",
+			body:         bytes.Repeat([]byte("a"), 64),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	// The limit applies even when no filter middleware reads the body
+	ts := httptest.NewServer(configuredMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Expected the limited body to be readable and got %s.", err)
+		}
+		getTestHandler()(w, r)
+	}))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.MaxBodyBytes = 64
+	config.FilterEndpoints = []string{"validateMaxSignatures"}
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
+func TestValidatePath(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "allowed",
+			url:          "/v1/chain/get_info",
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "not allowed",
+			url:          "/v1/producer/pause",
+			expectedBody: "{\"message\":\"FORBIDDEN_ENDPOINT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "allowed but blocked",
+			url:          "/v1/chain/get_code",
+			expectedBody: "{\"message\":\"FORBIDDEN_ENDPOINT\",\"code\":403}",
+			expectedCode: 403,
+		},
+	}
+
+	ts := httptest.NewServer(validatePath(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.AllowedPaths = []string{"/v1/chain/*"}
+	config.BlockedPaths = []string{"/v1/chain/get_code"}
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	// Every path is allowed by default
+	setConfig()
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "default",
+		url:          "/v1/producer/pause",
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+}
+
+func TestValidateMethod(t *testing.T) {
+	ts := httptest.NewServer(validateMethod(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.AllowedMethods = map[string][]string{"/v1/chain/push_transaction": {"POST"}}
+	storeConfig(config)
+
+	tests := []struct {
+		description   string
+		method        string
+		url           string
+		preflight     string
+		expectedCode  int
+		expectedAllow string
+	}{
+		{"default GET", "GET", "/v1/chain/get_info", "", 200, ""},
+		{"default HEAD", "HEAD", "/v1/chain/get_info", "", 200, ""},
+		{"default PUT", "PUT", "/v1/chain/get_info", "", 405, "GET, POST, HEAD, OPTIONS"},
+		{"per path POST", "POST", "/v1/chain/push_transaction", "", 200, ""},
+		{"per path GET", "GET", "/v1/chain/push_transaction", "", 405, "POST, OPTIONS"},
+		{"per path HEAD", "HEAD", "/v1/chain/push_transaction", "", 405, "POST, OPTIONS"},
+		{"allowed preflight", "OPTIONS", "/v1/chain/push_transaction", "POST", 200, ""},
+		{"disallowed preflight", "OPTIONS", "/v1/chain/get_info", "DELETE", 405, "GET, POST, HEAD, OPTIONS"},
+		{"plain OPTIONS", "OPTIONS", "/v1/chain/get_info", "", 200, ""},
+	}
+
+	for _, tc := range tests {
+		request, _ := http.NewRequest(tc.method, ts.URL+tc.url, nil)
+		if tc.preflight != "" {
+			request.Header.Set("Origin", "https://dapp.example.com")
+			request.Header.Set("Access-Control-Request-Method", tc.preflight)
+		}
+
+		res, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("There should not be a server error.")
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tc.expectedCode {
+			t.Errorf("%s: Expected status code to be %d and got %d.", tc.description, tc.expectedCode, res.StatusCode)
+		}
+		if res.Header.Get("Allow") != tc.expectedAllow {
+			t.Errorf("%s: Expected Allow header to be %q and got %q.", tc.description, tc.expectedAllow, res.Header.Get("Allow"))
+		}
+	}
+}
+
+func TestValidateExpiration(t *testing.T) {
+	now := time.Now().UTC()
+	getBody := func(expiration string) []byte {
+		return []byte(`{"expiration": "` + expiration + `", "actions": [{"code": "tokens"}]}`)
+	}
+
+	tests := []TestStruct{
+		{
+			description:  "valid",
+			url:          "/v1/chain/push_transaction",
+			body:         getBody(now.Add(30 * time.Second).Format(expirationFormat)),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "within skew",
+			url:          "/v1/chain/push_transaction",
+			body:         getBody(now.Add(-2 * time.Second).Format(expirationFormat)),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "expired",
+			url:          "/v1/chain/push_transaction",
+			body:         getBody(now.Add(-time.Minute).Format(expirationFormat)),
+			expectedBody: "{\"message\":\"EXPIRED_TRANSACTION\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "too far",
+			url:          "/v1/chain/push_transaction",
+			body:         getBody(now.Add(time.Hour).Format(expirationFormat)),
+			expectedBody: "{\"message\":\"EXPIRATION_TOO_FAR\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "with milliseconds",
+			url:          "/v1/chain/push_transaction",
+			body:         getBody(now.Add(30 * time.Second).Format(expirationFormat + ".500")),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "expired with milliseconds",
+			url:          "/v1/chain/push_transaction",
+			body:         getBody(now.Add(-time.Minute).Format(expirationFormat + ".000")),
+			expectedBody: "{\"message\":\"EXPIRED_TRANSACTION\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "unparseable",
+			url:          "/v1/chain/push_transaction",
+			body:         getBody("tomorrow"),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "not a push endpoint",
+			url:          "/v1/chain/get_account",
+			body:         []byte(`{"account_name": "alice"}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateExpiration(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.MaxExpirationSeconds = 60
+	config.ExpirationSkewSeconds = 5
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	res, err := http.Get(ts.URL + "/v1/chain/get_info")
+	if err != nil || res.StatusCode != 200 {
+		t.Errorf("Expected GET requests without a body to pass.")
+	}
+
+	// maxExpirationAheadSeconds bounds the lookahead on its own
+	config.MaxExpirationSeconds = 0
+	config.MaxExpirationAheadSeconds = 7200
+	storeConfig(config)
+
+	verifyMiddleware(t, ts, TestStruct{
+		url:          "/v1/chain/push_transaction",
+		body:         getBody(now.Add(time.Hour).Format(expirationFormat)),
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+	verifyMiddleware(t, ts, TestStruct{
+		url:          "/v1/chain/push_transaction",
+		body:         getBody(now.Add(3 * time.Hour).Format(expirationFormat + ".000")),
+		expectedBody: "{\"message\":\"EXPIRATION_TOO_FAR\",\"code\":400}",
+		expectedCode: 400,
+	})
+	verifyMiddleware(t, ts, TestStruct{
+		url:          "/v1/chain/push_transaction",
+		body:         getBody(now.Add(-time.Minute).Format(expirationFormat)),
+		expectedBody: "{\"message\":\"EXPIRED_TRANSACTION\",\"code\":400}",
+		expectedCode: 400,
+	})
+}
+
+func TestValidateMaxAuthorizations(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "too many on an action",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "tokens", "authorization": [["alice", "active"], {"actor": "bob", "permission": "active"}, ["carol", "active"]]}]}`),
+			expectedBody: "{\"message\":\"TOO_MANY_AUTHORIZATIONS\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "too many on a transaction",
+			url:          "/",
+			body:         []byte(`{"authorizations": [["alice", "active"], ["bob", "active"], ["carol", "active"]], "actions": [{"code": "tokens"}]}`),
+			expectedBody: "{\"message\":\"TOO_MANY_AUTHORIZATIONS\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "valid at both levels",
+			url:          "/",
+			body:         []byte(`{"authorizations": [["alice", "active"], ["bob", "active"]], "actions": [{"code": "tokens", "authorization": [{"actor": "alice", "permission": "active"}, ["bob", "active"]]}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateMaxAuthorizations(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.MaxAuthorizations = 2
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
+// encodeBase58 encodes bytes with the base58 alphabet.
+func encodeBase58(data []byte) string {
+	value := new(big.Int).SetBytes(data)
+	base := big.NewInt(58)
+	remainder := new(big.Int)
+
+	encoded := []byte{}
+	for value.Sign() > 0 {
+		value.DivMod(value, base, remainder)
+		encoded = append([]byte{base58Alphabet[remainder.Int64()]}, encoded...)
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append([]byte{'1'}, encoded...)
+	}
+
+	return string(encoded)
+}
+
+func TestIsSignature(t *testing.T) {
+	signature := encodeBase58(bytes.Repeat([]byte{0x1f}, signatureLength))
+	leadingZero := encodeBase58(append([]byte{0}, bytes.Repeat([]byte{0x20}, signatureLength-1)...))
+
+	tests := []struct {
+		signature string
+		expected  bool
+	}{
+		{"SIG_K1_" + signature, true},
+		{"SIG_R1_" + signature, true},
+		{"SIG_K1_" + leadingZero, true},
+		{"SIG_XX_" + signature, false},
+		{signature, false},
+		{"SIG_K1_" + signature[:len(signature)-2], false},
+		{"SIG_K1_" + signature + "1", false},
+		{"SIG_K1_0" + signature[1:], false},
+		{"SIG_K1_", false},
+		{"12345", false},
+	}
+
+	for _, tc := range tests {
+		if isSignature(tc.signature) != tc.expected {
+			t.Errorf("Expected isSignature(%q) to be %t.", tc.signature, tc.expected)
+		}
+	}
+}
+
+func TestValidateSignatureFormat(t *testing.T) {
+	signature := "SIG_K1_" + encodeBase58(bytes.Repeat([]byte{0x1f}, signatureLength))
+	tests := []TestStruct{
+		{
+			description:  "invalid",
+			url:          "/",
+			body:         []byte(`{"signatures": ["` + signature + `", "SIG_K1_garbage"]}`),
+			expectedBody: "{\"message\":\"INVALID_SIGNATURE_FORMAT\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "oversized",
+			url:          "/",
+			body:         []byte(`{"signatures": ["SIG_K1_` + strings.Repeat("z", 100000) + `"]}`),
+			expectedBody: "{\"message\":\"INVALID_SIGNATURE_FORMAT\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "valid",
+			url:          "/",
+			body:         []byte(`{"signatures": ["` + signature + `"]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateSignatureFormat(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	config := *getConfig()
+	config.AllowAnySignatureFormat = true
+	storeConfig(config)
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "any format allowed",
+		url:          "/",
+		body:         tests[0].body,
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+}
+
+func TestValidateContentType(t *testing.T) {
+	ts := httptest.NewServer(validateContentType(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+
+	tests := []struct {
+		description  string
+		url          string
+		contentType  string
+		body         string
+		expectedCode int
+	}{
+		{"json", "/v1/chain/get_account", "application/json", `{"account_name": "alice"}`, 200},
+		{"json with charset", "/v1/chain/get_account", "application/json; charset=utf-8", `{"account_name": "alice"}`, 200},
+		{"form", "/v1/chain/get_account", "application/x-www-form-urlencoded", "account_name=alice", 415},
+		{"xml", "/v1/chain/get_account", "text/xml", "<account/>", 415},
+		{"missing", "/v1/chain/get_account", "", `{"account_name": "alice"}`, 415},
+		{"no body", "/v1/chain/get_info", "", "", 200},
+		{"not the chain api", "/v1/history/get_actions", "text/plain", "hello", 200},
+	}
+
+	for _, tc := range tests {
+		request, _ := http.NewRequest("POST", ts.URL+tc.url, bytes.NewBufferString(tc.body))
+		if tc.contentType != "" {
+			request.Header.Set("Content-Type", tc.contentType)
+		}
+
+		res, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("There should not be a server error.")
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tc.expectedCode {
+			t.Errorf("%s: Expected status code to be %d and got %d.", tc.description, tc.expectedCode, res.StatusCode)
+		}
+	}
+
+	config := *getConfig()
+	config.AllowMissingContentType = true
+	storeConfig(config)
+
+	request, _ := http.NewRequest("POST", ts.URL+"/v1/chain/get_account", bytes.NewBufferString(`{"account_name": "alice"}`))
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("There should not be a server error.")
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 200 {
+		t.Errorf("Expected a missing Content-Type to be allowed and got %d.", res.StatusCode)
+	}
+}
+
+func TestAuditMode(t *testing.T) {
+	events := make(chan Log, 10)
+	logServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Log
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer logServer.Close()
+
+	ts := httptest.NewServer(configuredMiddleware(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.AuditMode = true
+	config.FilterEndpoints = []string{"validateJSON", "validateContract"}
+	config.LogEndpoints = []string{logServer.URL}
+	storeConfig(config)
+
+	body, _ := json.Marshal(Transaction{Actions: []Action{{Code: "currency"}}})
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "blacklisted contract in audit mode",
+		url:          "/",
+		body:         body,
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+
+	logEvents.flush(time.Second)
+	select {
+	case event := <-events:
+		if event.Message != "WOULD_REJECT:BLACKLISTED_CONTRACT" || !event.Success || !event.Audit {
+			t.Errorf("Expected a WOULD_REJECT:BLACKLISTED_CONTRACT audit event and got %+v.", event)
+		}
+	default:
+		t.Errorf("Expected an audit event to be logged.")
+	}
+
+	// Switching audit mode off enforces the same rules again
+	config.AuditMode = false
+	storeConfig(config)
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "blacklisted contract",
+		url:          "/",
+		body:         body,
+		expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+		expectedCode: 403,
+	})
+
+	event := <-events
+	if event.Message != "BLACKLISTED_CONTRACT" || event.Success || event.Audit {
+		t.Errorf("Expected a BLACKLISTED_CONTRACT failure event and got %+v.", event)
+	}
+}
+
+func TestValidateContractPatterns(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "exact match",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "currency"}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "wildcard",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "spamcoin12"}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT:spamcoin*\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "regexp",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "junk42"}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT:/^junk[0-9]+$/\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "valid",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "myspamcoin"}, {"code": "junk"}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateContract(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.ContractBlackListPatterns = []string{"spamcoin*", "/^junk[0-9]+$/"}
+	storeConfig(config)
+	defer setConfig()
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	var forwarded []byte
+	var forwardedEncoding string
+	ts := httptest.NewServer(decodeBody(validateJSON(func(w http.ResponseWriter, r *http.Request) {
+		forwarded, _ = ioutil.ReadAll(r.Body)
+		forwardedEncoding = r.Header.Get("Content-Encoding")
+		getTestHandler()(w, r)
+	})))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.MaxBodyBytes = 64
+	storeConfig(config)
+
+	compress := func(body []byte) []byte {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(body)
+		writer.Close()
+		return compressed.Bytes()
+	}
+
+	tests := []struct {
+		description  string
+		encoding     string
+		body         []byte
+		expectedCode int
+	}{
+		{"gzip", "gzip", compress([]byte(`{"actions": []}`)), 200},
+		{"not gzip", "gzip", []byte(`{"actions": []}`), 400},
+		{"too large", "gzip", compress(bytes.Repeat([]byte(" "), 100)), 413},
+		{"unsupported", "br", []byte("abc"), 415},
+		{"identity", "identity", []byte(`{"actions": []}`), 200},
+	}
+
+	for _, tc := range tests {
+		forwarded = nil
+		request, _ := http.NewRequest("POST", ts.URL+"/v1/chain/push_transaction", bytes.NewBuffer(tc.body))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Content-Encoding", tc.encoding)
+
+		res, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("There should not be a server error.")
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tc.expectedCode {
+			t.Errorf("%s: Expected status code to be %d and got %d.", tc.description, tc.expectedCode, res.StatusCode)
+		}
+	}
+
+	request, _ := http.NewRequest("POST", ts.URL+"/v1/chain/push_transaction", bytes.NewBuffer(compress([]byte(`{"actions": []}`))))
+	request.Header.Set("Content-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("There should not be a server error.")
+	}
+	res.Body.Close()
+
+	if string(forwarded) != `{"actions": []}` || forwardedEncoding != "" {
+		t.Errorf("Expected the decompressed body to be forwarded without Content-Encoding and got %q (%q).", forwarded, forwardedEncoding)
+	}
+
+	// Without maxBodyBytes, a body that expands far beyond its compressed size is still rejected
+	config.MaxBodyBytes = 0
+	storeConfig(config)
+
+	bomb := compress(bytes.Repeat([]byte(" "), 4*defaultMaxDecodedBodyBytes))
+	request, _ = http.NewRequest("POST", ts.URL+"/v1/chain/push_transaction", bytes.NewBuffer(bomb))
+	request.Header.Set("Content-Encoding", "gzip")
+	res, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("There should not be a server error.")
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusRequestEntityTooLarge || len(bomb) > 100*1024 {
+		t.Errorf("Expected a %d byte gzip bomb to be rejected with 413 and got %d.", len(bomb), res.StatusCode)
+	}
+}
+
+func TestCheckJSONComplexity(t *testing.T) {
+	config := &Config{MaxJSONDepth: 3, MaxJSONTokens: 10, MaxJSONStringLength: 5}
+
+	tests := []struct {
+		body     string
+		expected error
+	}{
+		{`{"a": [1, 2]}`, nil},
+		{`[[[1]]]`, nil},
+		{`[[[[1]]]]`, errJSONTooComplex},
+		{`[1, 2, 3, 4, 5, 6, 7, 8, 9]`, errJSONTooComplex},
+		{`{"a": "abcdef"}`, errJSONTooComplex},
+		{`{"abcdef": 1}`, errJSONTooComplex},
+	}
+
+	for _, tc := range tests {
+		if err := checkJSONComplexity([]byte(tc.body), config); err != tc.expected {
+			t.Errorf("Expected %s to return %v and got %v.", tc.body, tc.expected, err)
+		}
+	}
+
+	// Limits of 0 are not checked
+	deep := strings.Repeat("[", 1000) + strings.Repeat("]", 1000)
+	if err := checkJSONComplexity([]byte(deep), &Config{}); err != nil {
+		t.Errorf("Expected no limits to be checked and got %v.", err)
+	}
+}
+
+func TestValidateJSONTooComplex(t *testing.T) {
+	ts := httptest.NewServer(validateJSON(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.MaxJSONDepth = 10
+	storeConfig(config)
+
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "too deep",
+		url:          "/",
+		body:         []byte(strings.Repeat("[", 100000) + strings.Repeat("]", 100000)),
+		expectedBody: "{\"message\":\"JSON_TOO_COMPLEX\",\"code\":413}",
+		expectedCode: 413,
+	})
+
+	// getTransactions checks the limits even without validateJSON
+	request := httptest.NewRequest("POST", "/", bytes.NewBufferString(strings.Repeat("[", 20)+strings.Repeat("]", 20)))
+	if _, _, err := getTransactions(request); err != errJSONTooComplex {
+		t.Errorf("Expected getTransactions to return JSON_TOO_COMPLEX and got %v.", err)
+	}
+}
+
+// BenchmarkCheckJSONComplexityDeep shows that a deeply nested body is rejected
+// after reading only as far as the depth limit.
+func BenchmarkCheckJSONComplexityDeep(b *testing.B) {
+	body := []byte(strings.Repeat("[", 100000) + strings.Repeat("]", 100000))
+	config := &Config{MaxJSONDepth: defaultMaxJSONDepth}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		checkJSONComplexity(body, config)
+	}
+}
+
+// BenchmarkUnmarshalDeep is the cost of decoding the same body without the check, for comparison.
+func BenchmarkUnmarshalDeep(b *testing.B) {
+	body := []byte(strings.Repeat("[", 100000) + strings.Repeat("]", 100000))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var transactions []Transaction
+		json.Unmarshal(body, &transactions)
+	}
+}
+
+// discardResponseWriter is a ResponseWriter that keeps nothing of the body.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+	size   int64
+}
+
+func (writer *discardResponseWriter) Header() http.Header {
+	return writer.header
+}
+
+func (writer *discardResponseWriter) Write(body []byte) (int, error) {
+	writer.size += int64(len(body))
+	return len(body), nil
+}
+
+func (writer *discardResponseWriter) WriteHeader(statusCode int) {
+	writer.status = statusCode
+}
+
+// zeroReader returns an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(buffer []byte) (int, error) {
+	for i := range buffer {
+		buffer[i] = 0
+	}
+	return len(buffer), nil
+}
+
+func TestForwardCallToNodeos(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		forwarded = string(body)
+		w.Header().Set("X-Nodeos", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("BLOCK"))
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	storeConfig(config)
+
+	// The body is sent from the parsed copy, even once the request body was consumed
+	request := httptest.NewRequest("POST", "/v1/chain/get_block", bytes.NewBufferString(`{"block_num_or_id": 1}`))
+	_, ctx := getParsedBody(request)
+	request = request.WithContext(ctx)
+	ioutil.ReadAll(request.Body)
+
+	recorder := httptest.NewRecorder()
+	forwardCallToNodeos(recorder, request)
+
+	if forwarded != `{"block_num_or_id": 1}` {
+		t.Errorf("Expected the validated body to be forwarded and got %q.", forwarded)
+	}
+	if recorder.Code != http.StatusAccepted || recorder.Body.String() != "BLOCK" || recorder.Header().Get("X-Nodeos") != "yes" {
+		t.Errorf("Expected the nodeos response to be relayed and got %d %s %v.", recorder.Code, recorder.Body.String(), recorder.Header())
+	}
+
+	setConfig()
+}
+
+func TestCopyHeaders(t *testing.T) {
+	source := http.Header{
+		"Connection":          {"close, X-Hop"},
+		"Keep-Alive":          {"timeout=5"},
+		"Transfer-Encoding":   {"chunked"},
+		"Upgrade":             {"websocket"},
+		"Proxy-Authorization": {"Basic c2VjcmV0"},
+		"Te":                  {"trailers"},
+		"X-Hop":               {"1"},
+		"Content-Type":        {"application/json"},
+		"Set-Cookie":          {"a=1", "b=2"},
+	}
+
+	copied := http.Header{}
+	copyHeaders(copied, source)
+
+	expected := http.Header{
+		"Content-Type": {"application/json"},
+		"Set-Cookie":   {"a=1", "b=2"},
+	}
+	if len(copied) != len(expected) || copied.Get("Content-Type") != "application/json" || len(copied["Set-Cookie"]) != 2 {
+		t.Errorf("Expected only the end-to-end headers %v to be copied and got %v.", expected, copied)
+	}
+}
+
+func TestForwardHopByHopHeaders(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Header().Set("Connection", "close")
+		w.Header().Set("X-Nodeos", "yes")
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	storeConfig(config)
+	defer setConfig()
+
+	request := httptest.NewRequest("GET", "/v1/chain/get_info", nil)
+	request.Header.Set("Connection", "X-Secret")
+	request.Header.Set("X-Secret", "1")
+	request.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	request.Header.Set("X-Client", "yes")
+	_, ctx := getParsedBody(request)
+
+	recorder := httptest.NewRecorder()
+	forwardCallToNodeos(recorder, request.WithContext(ctx))
+
+	if received.Get("X-Secret") != "" || received.Get("Proxy-Authorization") != "" || received.Get("X-Client") != "yes" {
+		t.Errorf("Expected only the end-to-end request headers to reach nodeos and got %v.", received)
+	}
+	if recorder.Header().Get("Connection") != "" || recorder.Header().Get("X-Nodeos") != "yes" {
+		t.Errorf("Expected only the end-to-end response headers to be relayed and got %v.", recorder.Header())
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	relayed := 0
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		relayed++
+	}))
+	defer relay.Close()
+
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the connection closing once the body was read
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	config.LogEndpoints = []string{relay.URL}
+	storeConfig(config)
+	defer setConfig()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request := httptest.NewRequest("POST", "/v1/chain/get_table_rows", bytes.NewBufferString("{}")).WithContext(ctx)
+	_, ctx = getParsedBody(request)
+
+	done := make(chan struct{})
+	go func() {
+		forwardCallToNodeos(httptest.NewRecorder(), request.WithContext(ctx))
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the nodeos request to be cancelled with the client request.")
+	}
+	<-done
+
+	logEvents.flush(time.Second)
+	if relayed != 0 {
+		t.Errorf("Expected a client disconnect not to be sent to fail2ban and got %d events.", relayed)
+	}
+}
+
+func TestUpstreamFailures(t *testing.T) {
+	relayed := 0
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		relayed++
+	}))
+	defer relay.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	closed := httptest.NewServer(getTestHandler())
+	closed.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.LogEndpoints = []string{relay.URL}
+	defer setConfig()
+
+	timeout := client.Timeout
+	client.Timeout = 50 * time.Millisecond
+	defer func() { client.Timeout = timeout }()
+
+	tests := []struct {
+		description  string
+		upstream     string
+		expectedBody string
+		expectedCode int
+	}{
+		{"unreachable", closed.URL, "{\"message\":\"UPSTREAM_UNAVAILABLE\",\"code\":502}", 502},
+		{"timeout", slow.URL, "{\"message\":\"UPSTREAM_TIMEOUT\",\"code\":504}", 504},
+		{"invalid upstream", "http://[::1", "{\"message\":\"UPSTREAM_UNAVAILABLE\",\"code\":502}", 502},
+	}
+
+	for _, tc := range tests {
+		config.NodeosUpstream = tc.upstream
+		storeConfig(config)
+
+		recorder := httptest.NewRecorder()
+		forwardCallToNodeos(recorder, httptest.NewRequest("GET", "/v1/chain/get_info", nil))
+
+		if recorder.Code != tc.expectedCode || recorder.Body.String() != tc.expectedBody {
+			t.Errorf("%s: expected %d %s and got %d %s.", tc.description, tc.expectedCode, tc.expectedBody, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	logEvents.flush(time.Second)
+	if relayed != 0 {
+		t.Errorf("Expected upstream failures not to be sent to fail2ban and got %d events.", relayed)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	var failures int32
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Log
+		json.NewDecoder(r.Body).Decode(&event)
+		if !event.Success {
+			atomic.AddInt32(&failures, 1)
+		}
+	}))
+	defer relay.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		if r.URL.Query().Get("stream") != "" {
+			// Flushing before the end sends the response without a Content-Length
+			w.(http.Flusher).Flush()
+		}
+		w.Write(bytes.Repeat([]byte("a"), size))
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	config.MaxResponseBytes = 50
+	config.LogEndpoints = []string{relay.URL}
+	storeConfig(config)
+	defer setConfig()
+
+	ts := httptest.NewServer(http.HandlerFunc(forwardCallToNodeos))
+	defer ts.Close()
+
+	tests := []struct {
+		description   string
+		query         string
+		expectedCode  int
+		expectedBody  string
+		expectedError bool
+	}{
+		{"small", "size=10", 200, strings.Repeat("a", 10), false},
+		{"at the limit", "size=50", 200, strings.Repeat("a", 50), false},
+		{"too large", "size=51", 502, "{\"message\":\"RESPONSE_TOO_LARGE\",\"code\":502}", false},
+		{"streamed at the limit", "size=50&stream=1", 200, strings.Repeat("a", 50), false},
+		{"streamed too large", "size=51&stream=1", 200, "", true},
+	}
+
+	for _, tc := range tests {
+		res, err := http.Get(ts.URL + "/v1/chain/get_table_rows?" + tc.query)
+		if err != nil {
+			if !tc.expectedError {
+				t.Errorf("%s: %s", tc.description, err)
+			}
+			continue
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if tc.expectedError {
+			if err == nil {
+				t.Errorf("%s: expected the connection to be dropped and got %d bytes.", tc.description, len(body))
+			}
+			continue
+		}
+		if err != nil || res.StatusCode != tc.expectedCode || string(body) != tc.expectedBody {
+			t.Errorf("%s: expected %d %s and got %d %s %v.", tc.description, tc.expectedCode, tc.expectedBody, res.StatusCode, body, err)
+		}
+	}
+
+	logEvents.flush(time.Second)
+	if atomic.LoadInt32(&failures) != 0 {
+		t.Errorf("Expected oversized responses not to be sent to fail2ban and got %d failures.", failures)
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	var attempts int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1)%3 != 0 {
+			// Drop the connection without answering
+			connection, _, _ := w.(http.Hijacker).Hijack()
+			connection.Close()
+			return
+		}
+		w.Write([]byte("SUCCESS"))
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	config.UpstreamRetries = 2
+	config.UpstreamRetryBackoffMs = 1
+	config.UpstreamRetryPaths = []string{"/v1/chain/get_table_rows"}
+	storeConfig(config)
+	defer setConfig()
+
+	tests := []struct {
+		description      string
+		method           string
+		url              string
+		expectedCode     int
+		expectedAttempts int32
+	}{
+		{"GET retried", "GET", "/v1/chain/get_info", 200, 3},
+		{"read-only POST retried", "POST", "/v1/chain/get_table_rows", 200, 3},
+		{"other POST not retried", "POST", "/v1/chain/get_account", 502, 1},
+		{"push not retried", "POST", "/v1/chain/push_transaction", 502, 1},
+	}
+
+	for _, tc := range tests {
+		atomic.StoreInt32(&attempts, 0)
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(tc.method, tc.url, bytes.NewBufferString("{}"))
+		_, ctx := getParsedBody(request)
+		forwardCallToNodeos(recorder, request.WithContext(ctx))
+
+		if recorder.Code != tc.expectedCode {
+			t.Errorf("%s: expected %d and got %d %s.", tc.description, tc.expectedCode, recorder.Code, recorder.Body.String())
+		}
+		if count := atomic.LoadInt32(&attempts); count != tc.expectedAttempts {
+			t.Errorf("%s: expected %d attempts and got %d.", tc.description, tc.expectedAttempts, count)
+		}
+	}
+}
+
+// BenchmarkForwardLargeResponse relays a 50MB nodeos response. The bytes allocated per
+// operation stay far below the response size because the body is streamed.
+func BenchmarkForwardLargeResponse(b *testing.B) {
+	const responseSize = 50 << 20
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.CopyN(w, zeroReader{}, responseSize)
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	storeConfig(config)
+	defer setConfig()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writer := &discardResponseWriter{header: http.Header{}}
+		forwardCallToNodeos(writer, httptest.NewRequest("GET", "/v1/chain/get_block", nil))
+		if writer.size != responseSize {
+			b.Fatalf("Expected %d bytes and got %d.", responseSize, writer.size)
+		}
+	}
+}
+
+func TestModernTransactionSchema(t *testing.T) {
+	body, err := ioutil.ReadFile("testdata/push-action.json")
+	if err != nil {
+		t.Fatalf("Error reading fixture %s", err)
+	}
+	contextFreeBody, err := ioutil.ReadFile("testdata/push-action-context-free.json")
+	if err != nil {
+		t.Fatalf("Error reading fixture %s", err)
+	}
+
+	var transaction Transaction
+	if err := json.Unmarshal(body, &transaction); err != nil {
+		t.Fatalf("Expected fixture to parse and got %s.", err)
+	}
+	action := transaction.Actions[0]
+	if action.Code != "eosio.token" || action.Type != "transfer" || action.Authorization[0].Actor != "alice" {
+		t.Errorf("Expected account and name to be read and got %+v.", action)
+	}
+
+	// Data given as an object is kept as JSON text
+	var objectAction Action
+	json.Unmarshal([]byte(`{"account": "eosio.token", "name": "transfer", "data": {"from": "alice", "to": "bob"}}`), &objectAction)
+	if objectAction.Data != `{"from":"alice","to":"bob"}` {
+		t.Errorf("Expected object data to be kept as JSON and got %s.", objectAction.Data)
+	}
+
+	setConfig()
+	config := *getConfig()
+	config.ContractBlackList = map[string]bool{"eosio.token": true}
+	storeConfig(config)
+
+	ts := httptest.NewServer(validateContract(getTestHandler()))
+	defer ts.Close()
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "blacklisted account",
+		url:          "/v1/chain/push_transaction",
+		body:         body,
+		expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+		expectedCode: 403,
+	})
+
+	// Context-free actions are checked too
+	config.ContractBlackList = map[string]bool{"currency": true}
+	config.MaxActions = 1
+	storeConfig(config)
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "blacklisted context-free action",
+		url:          "/v1/chain/push_transaction",
+		body:         contextFreeBody,
+		expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+		expectedCode: 403,
+	})
+
+	actions := httptest.NewServer(validateMaxActions(getTestHandler()))
+	defer actions.Close()
+	verifyMiddleware(t, actions, TestStruct{
+		description:  "context-free actions count",
+		url:          "/v1/chain/push_transaction",
+		body:         contextFreeBody,
+		expectedBody: "{\"message\":\"TOO_MANY_ACTIONS\",\"code\":400}",
+		expectedCode: 400,
+	})
+	verifyMiddleware(t, actions, TestStruct{
+		description:  "single action",
+		url:          "/v1/chain/push_transaction",
+		body:         body,
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+
+	signatures := httptest.NewServer(validateSignatureFormat(getTestHandler()))
+	defer signatures.Close()
+	verifyMiddleware(t, signatures, TestStruct{
+		description:  "fixture signature",
+		url:          "/v1/chain/push_transaction",
+		body:         body,
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+}
+
+func TestValidateRecipients(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "blacklisted recipient",
+			url:          "/",
+			body:         []byte(`{"actions": [{"code": "tokens", "recipients": ["alice", "victim"]}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_RECIPIENT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "blacklisted scope",
+			url:          "/",
+			body:         []byte(`{"scope": ["alice", "victim"], "actions": [{"code": "tokens"}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_SCOPE\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "valid",
+			url:          "/",
+			body:         []byte(`{"scope": ["alice"], "actions": [{"code": "tokens", "recipients": ["alice", "bob"]}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateRecipients(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.RecipientBlackList = map[string]bool{"victim": true}
+	config.ScopeBlackList = map[string]bool{"victim": true}
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
+func TestValidateNotEmpty(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "empty object",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{}`),
+			expectedBody: "{\"message\":\"EMPTY_TRANSACTION\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "no actions",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"signatures": ["SIG_K1_test"], "actions": []}`),
+			expectedBody: "{\"message\":\"EMPTY_TRANSACTION\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "no signatures",
+			url:          "/v1/chain/send_transaction",
+			body:         []byte(`{"actions": [{"code": "tokens"}]}`),
+			expectedBody: "{\"message\":\"EMPTY_TRANSACTION\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "empty batch",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`[]`),
+			expectedBody: "{\"message\":\"EMPTY_TRANSACTION\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "valid",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"signatures": ["SIG_K1_test"], "actions": [{"code": "tokens"}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "only context-free actions",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"signatures": ["SIG_K1_test"], "context_free_actions": [{"code": "tokens"}], "actions": []}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "not a push endpoint",
+			url:          "/v1/chain/get_info",
+			body:         []byte(`{}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateNotEmpty(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
+func TestValidateActionData(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "hex",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"actions": [{"account": "tokens", "data": "0000855C34"}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "object",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"actions": [{"account": "tokens", "data": {"from": "alice", "quantity": "1.0000 EOS"}}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "empty",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"actions": [{"account": "tokens", "data": ""}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "odd length",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"actions": [{"account": "tokens", "data": "abc"}]}`),
+			expectedBody: "{\"message\":\"INVALID_ACTION_DATA\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "not hex",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"context_free_actions": [{"account": "tokens", "data": "hello!"}]}`),
+			expectedBody: "{\"message\":\"INVALID_ACTION_DATA\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "array",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"actions": [{"account": "tokens", "data": [1, 2]}]}`),
+			expectedBody: "{\"message\":\"INVALID_ACTION_DATA\",\"code\":400}",
+			expectedCode: 400,
+		},
+	}
+
+	ts := httptest.NewServer(validateActionData(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
+func TestTrustedSources(t *testing.T) {
+	ts := httptest.NewServer(configuredMiddleware(getTestHandler()))
+	defer ts.Close()
+
+	tooManyTransactions := TestStruct{
+		description:  "too many transactions from a trusted source",
+		url:          "/",
+		body:         []byte(`[{"name": "Tony Stark"}, {"name": "Steve Rogers"},{"name": "Bruce Banner"}]`),
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	}
+
+	setConfig()
+	config := *getConfig()
+	config.TrustedSources = []string{"127.0.0.0/8", "::1"}
+	storeConfig(config)
+
+	verifyMiddleware(t, ts, tooManyTransactions)
+
+	// The path, method and body limits still apply to trusted sources
+	config.BlockedPaths = []string{"/v1/producer"}
+	config.MaxBodyBytes = 10
+	storeConfig(config)
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "blocked path from a trusted source",
+		url:          "/v1/producer/pause",
+		body:         []byte(`{}`),
+		expectedBody: "{\"message\":\"FORBIDDEN_ENDPOINT\",\"code\":403}",
+		expectedCode: 403,
+	})
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "large body from a trusted source",
+		url:          "/v1/chain/get_info",
+		body:         []byte(`{"account_name": "eosio"}`),
+		expectedBody: "{\"message\":\"BODY_TOO_LARGE\",\"code\":413}",
+		expectedCode: 413,
+	})
+
+	// X-Forwarded-For cannot be used to pose as a trusted source
+	request := httptest.NewRequest("POST", "/", nil)
+	request.RemoteAddr = "192.0.2.1:1234"
+	request.Header.Set("X-Forwarded-For", "127.0.0.1")
+	if isTrustedSource(request) {
+		t.Errorf("Expected %s not to be trusted.", request.RemoteAddr)
+	}
+
+	request.RemoteAddr = "[::1]:1234"
+	if !isTrustedSource(request) {
+		t.Errorf("Expected %s to be trusted.", request.RemoteAddr)
+	}
+
+	setConfig()
+	tooManyTransactions.description = "too many transactions without trusted sources"
+	tooManyTransactions.expectedBody = "{\"message\":\"TOO_MANY_TRANSACTIONS\",\"code\":400}"
+	tooManyTransactions.expectedCode = 400
+	verifyMiddleware(t, ts, tooManyTransactions)
+}
+
+func TestGetStatusCode(t *testing.T) {
+	setConfig()
+
+	tests := []struct {
+		message    string
+		statusCode int
+		expected   int
+	}{
+		{"INVALID_JSON", 0, 400},
+		{"INVALID_TRANSACTION_SIZE:eosio.token", 0, 413},
+		{"BLACKLISTED_CONTRACT", 0, 403},
+		{"METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed, 405},
+	}
+
+	for _, tc := range tests {
+		if code := getStatusCode(tc.message, tc.statusCode); code != tc.expected {
+			t.Errorf("Expected %s to be %d and got %d.", tc.message, tc.expected, code)
+		}
+	}
+
+	// The configuration overrides both the default and the caller
+	config := *getConfig()
+	config.StatusCodes = map[string]int{"BLACKLISTED_CONTRACT": 400, "METHOD_NOT_ALLOWED": 404}
+	storeConfig(config)
+
+	if code := getStatusCode("BLACKLISTED_CONTRACT:spam*", 0); code != 400 {
+		t.Errorf("Expected BLACKLISTED_CONTRACT to be 400 and got %d.", code)
+	}
+	if code := getStatusCode("METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed); code != 404 {
+		t.Errorf("Expected METHOD_NOT_ALLOWED to be 404 and got %d.", code)
+	}
+
+	setConfig()
+}
+
+func TestVerboseErrors(t *testing.T) {
+	body, _ := json.Marshal(Transaction{
+		Actions: []Action{
+			{Code: "tokens", Data: "abcd"},
+			{Code: "tokens", Data: strings.Repeat("ab", 30)},
+		},
+	})
+
+	ts := httptest.NewServer(validateTransactionSize(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "details suppressed",
+		url:          "/",
+		body:         body,
+		expectedBody: "{\"message\":\"INVALID_TRANSACTION_SIZE\",\"code\":413}",
+		expectedCode: 413,
+	})
+
+	config := *getConfig()
+	config.VerboseErrors = true
+	storeConfig(config)
+
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "details included",
+		url:          "/",
+		body:         body,
+		expectedBody: "{\"message\":\"INVALID_TRANSACTION_SIZE\",\"code\":413,\"detail\":\"action 1 of transaction 0 has data length 60, the limit is 50\",\"limit\":50,\"observed\":60,\"offendingIndex\":1}",
+		expectedCode: 413,
+	})
+
+	setConfig()
+}
+
+func TestParseErrorDetails(t *testing.T) {
+	ts := httptest.NewServer(validateContract(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.VerboseErrors = true
+	storeConfig(config)
+
+	tests := []TestStruct{
+		{
+			description:  "object",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"actions": "transfer"}`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400,\"detail\":\"PARSE_ERROR_OBJECT: actions expects []main.Action but got a string at offset 22\"}",
+			expectedCode: 400,
+		},
+		{
+			description:  "array",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`[{"delay_sec": 0}, {"ref_block_num": 70000}]`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400,\"detail\":\"PARSE_ERROR_ARRAY: 1.ref_block_num expects uint16 but got a number 70000 at offset 42\"}",
+			expectedCode: 400,
+		},
+		{
+			description:  "shape",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`{}`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400,\"detail\":\"the body must be an array of transactions\"}",
+			expectedCode: 400,
+		},
+	}
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	setConfig()
+}
+
+func TestBypassTokens(t *testing.T) {
+	var forwardedToken string
+	handler := configuredMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		forwardedToken = r.Header.Get(bypassHeader)
+		w.Write([]byte("SUCCESS\n"))
+	})
+
+	setConfig()
+	config := *getConfig()
+	config.BypassTokens = []BypassToken{{Label: "mobile", Token: "0123456789abcdef"}}
+	storeConfig(config)
+
+	tooManyTransactions := `[{"name": "Tony Stark"}, {"name": "Steve Rogers"},{"name": "Bruce Banner"}]`
+
+	tests := []struct {
+		description  string
+		url          string
+		token        string
+		expectedBody string
+		expectedCode int
+	}{
+		{"valid token", "/v1/chain/push_transactions", "0123456789abcdef", "SUCCESS\n", 200},
+		{"bad token", "/v1/chain/push_transactions", "0123456789abcdeX", "{\"message\":\"BAD_BYPASS_TOKEN\",\"code\":401}", 401},
+		{"no token", "/v1/chain/push_transactions", "", "{\"message\":\"TOO_MANY_TRANSACTIONS\",\"code\":400}", 400},
+		// A valid token does not open blocked paths
+		{"valid token on a blocked path", "/v1/producer/pause", "0123456789abcdef", "{\"message\":\"FORBIDDEN_ENDPOINT\",\"code\":403}", 403},
+	}
+
+	config.BlockedPaths = []string{"/v1/producer"}
+	storeConfig(config)
+
+	for _, tc := range tests {
+		forwardedToken = ""
+
+		request := httptest.NewRequest("POST", tc.url, strings.NewReader(tooManyTransactions))
+		request.Header.Set("Content-Type", "application/json")
+		if tc.token != "" {
+			request.Header.Set(bypassHeader, tc.token)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+
+		if recorder.Code != tc.expectedCode || recorder.Body.String() != tc.expectedBody {
+			t.Errorf("Expected %s to return %d %s and got %d %s.", tc.description, tc.expectedCode, tc.expectedBody, recorder.Code, recorder.Body.String())
+		}
+		if forwardedToken != "" || strings.Contains(recorder.Body.String(), "0123456789abcdef") {
+			t.Errorf("Expected %s not to forward or echo the token.", tc.description)
+		}
+	}
+
+	setConfig()
+}
+
+func TestGetTransactionsBodyShape(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "bare string",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`"hello"`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "number",
+			url:          "/v1/chain/send_transaction",
+			body:         []byte(` 42`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "literal",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`true`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "bare string to another endpoint",
+			url:          "/v1/chain/get_block",
+			body:         []byte(`"hello"`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "byte order mark before an object",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte("\xef\xbb\xbf\n {\"actions\": [{\"code\": \"currency\"}]}"),
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+			expectedCode: 403,
+		},
+	}
+
+	ts := httptest.NewServer(validateJSON(validateContract(getTestHandler())))
+	defer ts.Close()
+
+	setConfig()
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
+func TestParseTransactionsOnce(t *testing.T) {
+	setConfig()
+
+	// Once parsed, the middleware no longer depend on the body being readable
+	drainBody := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			next.ServeHTTP(w, r)
+		}
+	}
+
+	var forwarded []byte
+	handler := chainMiddleware(parseTransactions, drainBody, validateJSON, validateMaxTransactions)(func(w http.ResponseWriter, r *http.Request) {
+		parsed, _ := getParsedBody(r)
+		forwarded = parsed.raw
+		w.Write([]byte("SUCCESS\n"))
+	})
+
+	body := `[{"name": "Tony Stark"}, {"name": "Steve Rogers"},{"name": "Bruce Banner"}]`
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/v1/chain/push_transactions", strings.NewReader(body)))
+	if recorder.Body.String() != "{\"message\":\"TOO_MANY_TRANSACTIONS\",\"code\":400}" {
+		t.Errorf("Expected the parsed transactions to be counted and got %s.", recorder.Body.String())
+	}
+
+	body = `{"name": "Tony Stark"}`
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/v1/chain/push_transaction", strings.NewReader(body)))
+	if recorder.Code != 200 || string(forwarded) != body {
+		t.Errorf("Expected the parsed body to be forwarded and got %d %s.", recorder.Code, forwarded)
+	}
+}
+
+func TestValidateURLLength(t *testing.T) {
+	ts := httptest.NewServer(validateURLLength(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.MaxURLLength = 40
+	storeConfig(config)
+
+	tests := []TestStruct{
+		{
+			description:  "short URL",
+			url:          "/v1/chain/get_info",
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "long query string",
+			url:          "/v1/chain/get_table_rows?scope=" + strings.Repeat("a", 40),
+			expectedBody: "{\"message\":\"URL_TOO_LONG\",\"code\":414}",
+			expectedCode: 414,
+		},
+	}
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	setConfig()
+}
+
+func TestIsSafePath(t *testing.T) {
+	tests := map[string]bool{
+		"/v1/chain/get_info":              true,
+		"/v1/chain/get_account%20name":    true,
+		"/v1/chain/..data/file":           true,
+		"/v1/chain/../producer/pause":     false,
+		"/v1/chain/%2e%2e/producer/pause": false,
+		"/v1/chain/%2E%2E%2Fproducer":     false,
+		"/v1/chain/get_info%00.json":      false,
+		"/v1/chain/get_info/..":           false,
+	}
+
+	for request, expected := range tests {
+		requestURL, err := url.ParseRequestURI(request)
+		if err != nil {
+			t.Fatalf("Expected %s to parse and got %s.", request, err)
+		}
+		if safe := isSafePath(requestURL); safe != expected {
+			t.Errorf("Expected %s to be safe: %t.", request, expected)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/v1/chain/get_info", nil)
+	request.URL.Path = "/v1/chain/../producer/pause"
+	forwardCallToNodeos(recorder, request)
+	if recorder.Code != 400 || recorder.Body.String() != "{\"message\":\"INVALID_PATH\",\"code\":400}" {
+		t.Errorf("Expected a traversal to be rejected and got %d %s.", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestBatchEndpoint(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "blacklisted element",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`[{"actions": [{"code": "tokens"}]}, {"actions": [{"code": "tokens"}, {"code": "currency"}]}]`),
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT[1]\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "too many signatures in an element",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`[{"signatures": ["SIG_K1_a", "SIG_K1_b"]}]`),
+			expectedBody: "{\"message\":\"INVALID_NUMBER_SIGNATURES[0]\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "single transaction",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"actions": [{"code": "currency"}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "object sent to the batch endpoint",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`{"actions": [{"code": "tokens"}]}`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "array sent to a single transaction endpoint",
+			url:          "/v1/chain/send_transaction",
+			body:         []byte(`[{"actions": [{"code": "tokens"}]}]`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "valid batch",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`[{"actions": [{"code": "tokens"}]}, {"actions": [{"code": "tokens"}]}]`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateMaxSignatures(validateContract(getTestHandler())))
+	defer ts.Close()
+
+	setConfig()
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	if message := batchMessage(httptest.NewRequest("POST", "/v1/chain/push_transactions", nil), "BLACKLISTED_CONTRACT:spam*", 3); message != "BLACKLISTED_CONTRACT[3]:spam*" {
+		t.Errorf("Expected the index before the detail and got %s.", message)
+	}
+}
+
+func TestValidateDelay(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "immediate",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"delay_sec": 0, "actions": [{"code": "tokens"}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "within the limit",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"delay_sec": 60, "actions": [{"code": "tokens"}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "too long",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"delay_sec": 3600, "actions": [{"code": "tokens"}]}`),
+			expectedBody: "{\"message\":\"DELAY_NOT_ALLOWED\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "too long as a string",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"delay_sec": "3600", "actions": [{"code": "tokens"}]}`),
+			expectedBody: "{\"message\":\"DELAY_NOT_ALLOWED\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "not a number",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"delay_sec": "soon", "actions": [{"code": "tokens"}]}`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "second transaction of a batch",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`[{"delay_sec": 0}, {"delay_sec": 61}]`),
+			expectedBody: "{\"message\":\"DELAY_NOT_ALLOWED[1]\",\"code\":400}",
+			expectedCode: 400,
+		},
+	}
+
+	ts := httptest.NewServer(validateDelay(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+
+	// Without maxDelaySec any delay is accepted
+	verifyMiddleware(t, ts, TestStruct{
+		url:          "/v1/chain/push_transaction",
+		body:         []byte(`{"delay_sec": "3600"}`),
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+
+	config := *getConfig()
+	config.MaxDelaySec = intPointer(60)
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	config.MaxDelaySec = intPointer(0)
+	storeConfig(config)
+
+	verifyMiddleware(t, ts, TestStruct{
+		url:          "/v1/chain/push_transaction",
+		body:         []byte(`{"delay_sec": 1}`),
+		expectedBody: "{\"message\":\"DELAY_NOT_ALLOWED\",\"code\":400}",
+		expectedCode: 400,
+	})
+}
+
+func TestValidateHeaders(t *testing.T) {
+	ts := httptest.NewServer(validateHeaders(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.MaxHeaderFields = 10
+	config.MaxHeaderValueLength = 100
+	storeConfig(config)
+
+	tests := []struct {
+		description  string
+		headers      map[string]string
+		expectedCode int
+	}{
+		{"standard headers", map[string]string{"X-Forwarded-For": "203.0.113.7, 10.0.0.1"}, 200},
+		{"long value", map[string]string{"X-Forwarded-For": strings.Repeat("1", 101)}, 431},
+		{"too many fields", map[string]string{"X-A": "a", "X-B": "b", "X-C": "c", "X-D": "d", "X-E": "e", "X-F": "f", "X-G": "g", "X-H": "h", "X-I": "i", "X-J": "j"}, 431},
+	}
+
+	for _, tc := range tests {
+		request, _ := http.NewRequest("GET", ts.URL+"/v1/chain/get_info", nil)
+		for name, value := range tc.headers {
+			request.Header.Set(name, value)
+		}
+
+		res, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("There should not be a server error.")
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != tc.expectedCode {
+			t.Errorf("%s: expected status code to be %d and got %d.", tc.description, tc.expectedCode, res.StatusCode)
+		}
+		if tc.expectedCode == 431 && string(b) != "{\"message\":\"OVERSIZED_HEADERS\",\"code\":431}" {
+			t.Errorf("%s: expected OVERSIZED_HEADERS and got %s.", tc.description, b)
+		}
+	}
+}
+
+func TestValidateClient(t *testing.T) {
+	ts := httptest.NewServer(validateClient(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.BlockedHeaderPatterns = map[string][]string{
+		"user-agent":   {"^python-requests/", "(?i)scrapy"},
+		"X-Scraper-Id": {".+"},
+	}
+	storeConfig(config)
+
+	tests := []struct {
+		description  string
+		header       string
+		value        string
+		expectedCode int
+	}{
+		{"blocked user agent", "User-Agent", "python-requests/2.19.1", 403},
+		{"case insensitive pattern", "User-Agent", "ScraPy/1.5", 403},
+		{"blocked header", "X-Scraper-ID", "42", 403},
+		{"browser", "User-Agent", "Mozilla/5.0", 200},
+	}
+
+	for _, tc := range tests {
+		request, _ := http.NewRequest("GET", ts.URL+"/v1/chain/get_info", nil)
+		request.Header.Set(tc.header, tc.value)
+
+		res, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("There should not be a server error.")
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != tc.expectedCode {
+			t.Errorf("%s: expected status code to be %d and got %d.", tc.description, tc.expectedCode, res.StatusCode)
+		}
+		if tc.expectedCode == 403 && string(b) != "{\"message\":\"BLOCKED_CLIENT\",\"code\":403}" {
+			t.Errorf("%s: expected BLOCKED_CLIENT and got %s.", tc.description, b)
+		}
+	}
+}
+
+func TestStrictParsing(t *testing.T) {
+	tests := []TestStruct{
+		{
+			description:  "unknown shape",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"transaction": {"actions": [{"account": "currency"}]}}`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "empty batch",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`[]`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "invalid field type",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"actions": "currency"}`),
+			expectedBody: "{\"message\":\"PARSE_ERROR\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "empty element",
+			url:          "/v1/chain/push_transactions",
+			body:         []byte(`[{"actions": [{"account": "tokens"}]}, {}]`),
+			expectedBody: "{\"message\":\"PARSE_ERROR[1]\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "valid",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"actions": [{"account": "tokens"}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "other endpoints",
+			url:          "/v1/chain/get_block",
+			body:         []byte(`{"block_num_or_id": 1}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(configuredMiddleware(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.FilterEndpoints = []string{"validateContract"}
+	storeConfig(config)
+
+	// Without strictParsing bodies the middleware cannot inspect are forwarded
+	verifyMiddleware(t, ts, TestStruct{
+		url:          "/v1/chain/push_transaction",
+		body:         []byte(`{"transaction": {"actions": [{"account": "currency"}]}}`),
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+
+	config.StrictParsing = true
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
+func TestNodeosErrors(t *testing.T) {
+	var relayed []Log
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Log
+		json.NewDecoder(r.Body).Decode(&event)
+		relayed = append(relayed, event)
+	}))
+	defer relay.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/chain/get_account":
+			w.WriteHeader(http.StatusBadRequest)
+		case "/v1/chain/push_transaction":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"code":500,"message":"Internal Service Error","error":{"code":3080004,"name":"tx_cpu_usage_exceeded"}}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("restarting"))
+		}
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	config.LogEndpoints = []string{relay.URL}
+	storeConfig(config)
+	defer setConfig()
+
+	forward := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		forwardCallToNodeos(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder
+	}
+
+	forward("/v1/chain/get_account")
+	logEvents.flush(time.Second)
+	if len(relayed) != 1 || relayed[0].Message != "TRANSACTION_FAILED" || relayed[0].Success {
+		t.Errorf("Expected a 4xx from nodeos to be a client failure and got %+v.", relayed)
+	}
+
+	relayed = nil
+	forward("/v1/chain/get_info")
+	if recorder := forward("/v1/chain/push_transaction"); recorder.Code != 500 || !strings.Contains(recorder.Body.String(), "tx_cpu_usage_exceeded") {
+		t.Errorf("Expected the nodeos error to be relayed and got %d %s.", recorder.Code, recorder.Body.String())
+	}
+	logEvents.flush(time.Second)
+	if len(relayed) != 0 {
+		t.Errorf("Expected a 5xx from nodeos not to be sent to fail2ban and got %+v.", relayed)
+	}
+
+	config.PenalizedNodeosErrors = []string{"3080"}
+	storeConfig(config)
+
+	forward("/v1/chain/get_info")
+	if recorder := forward("/v1/chain/push_transaction"); !strings.Contains(recorder.Body.String(), "tx_cpu_usage_exceeded") {
+		t.Errorf("Expected the whole nodeos error to be relayed and got %s.", recorder.Body.String())
+	}
+	logEvents.flush(time.Second)
+	if len(relayed) != 1 || relayed[0].Message != "TRANSACTION_FAILED" {
+		t.Errorf("Expected only penalized nodeos errors to be sent to fail2ban and got %+v.", relayed)
+	}
+}
+
+func TestForwardHeadAndOptions(t *testing.T) {
+	forwarded := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		w.Header().Set("X-Method", r.Method)
+		w.Write([]byte(`{"head_block_num":1}`))
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	config.MaxResponseBytes = 4
+	config.AllowedMethods = map[string][]string{"/v1/chain/push_transaction": {"POST"}}
+	storeConfig(config)
+	defer setConfig()
+	resetUpstreams()
+
+	recorder := httptest.NewRecorder()
+	forwardCallToNodeos(recorder, httptest.NewRequest("HEAD", "/v1/chain/get_info", nil))
+	if recorder.Code != 200 || recorder.Header().Get("X-Method") != "HEAD" {
+		t.Errorf("Expected HEAD to be forwarded and got %d %v.", recorder.Code, recorder.Header())
+	}
+	if recorder.Body.Len() != 0 {
+		t.Errorf("Expected no body for HEAD and got %q.", recorder.Body.String())
+	}
+
+	tests := []struct {
+		url           string
+		expectedAllow string
+	}{
+		{"/v1/chain/get_info", "GET, POST, HEAD, OPTIONS"},
+		{"/v1/chain/push_transaction", "POST, OPTIONS"},
+	}
+
+	for _, tc := range tests {
+		recorder := httptest.NewRecorder()
+		forwardCallToNodeos(recorder, httptest.NewRequest("OPTIONS", tc.url, nil))
+		if recorder.Code != http.StatusNoContent || recorder.Header().Get("Allow") != tc.expectedAllow || recorder.Body.Len() != 0 {
+			t.Errorf("Expected OPTIONS %s to be answered with Allow %q and got %d %q.", tc.url, tc.expectedAllow, recorder.Code, recorder.Header().Get("Allow"))
+		}
+	}
+	if forwarded != 1 {
+		t.Errorf("Expected OPTIONS not to be forwarded to nodeos and got %d requests.", forwarded)
+	}
 }
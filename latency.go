@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindow is how far back the upstream latency percentiles look.
+	latencyWindow = 5 * time.Minute
+	// maxLatencySamples bounds the memory used by the window. Once it is full, the oldest samples are dropped first.
+	maxLatencySamples = 10000
+)
+
+// LatencyStats are percentiles of the time nodeos took to answer, in milliseconds
+type LatencyStats struct {
+	Samples int     `json:"samples"`
+	P50Ms   float64 `json:"p50Ms"`
+	P95Ms   float64 `json:"p95Ms"`
+	P99Ms   float64 `json:"p99Ms"`
+}
+
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// latencyRecorder keeps the latencies of the last latencyWindow in a ring buffer.
+type latencyRecorder struct {
+	mutex   sync.Mutex
+	samples []latencySample
+	next    int
+}
+
+// upstreamLatency records how long nodeos takes to answer forwarded requests.
+var upstreamLatency latencyRecorder
+
+// record adds a latency to the window.
+func (recorder *latencyRecorder) record(duration time.Duration) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	sample := latencySample{at: time.Now(), duration: duration}
+	if len(recorder.samples) < maxLatencySamples {
+		recorder.samples = append(recorder.samples, sample)
+		return
+	}
+
+	recorder.samples[recorder.next] = sample
+	recorder.next = (recorder.next + 1) % maxLatencySamples
+}
+
+// getStats returns the percentiles of the latencies recorded in the last latencyWindow.
+func (recorder *latencyRecorder) getStats() LatencyStats {
+	since := time.Now().Add(-latencyWindow)
+
+	recorder.mutex.Lock()
+	durations := make([]time.Duration, 0, len(recorder.samples))
+	for _, sample := range recorder.samples {
+		if sample.at.After(since) {
+			durations = append(durations, sample.duration)
+		}
+	}
+	recorder.mutex.Unlock()
+
+	stats := LatencyStats{Samples: len(durations)}
+	if len(durations) == 0 {
+		return stats
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	percentile := func(p int) float64 {
+		// Nearest rank
+		rank := (p*len(durations) + 99) / 100
+		return float64(durations[rank-1]) / float64(time.Millisecond)
+	}
+
+	stats.P50Ms = percentile(50)
+	stats.P95Ms = percentile(95)
+	stats.P99Ms = percentile(99)
+	return stats
+}
+
+// getMean returns the average of the latencies recorded in the last latencyWindow, or 0 when there are none.
+func (recorder *latencyRecorder) getMean() time.Duration {
+	since := time.Now().Add(-latencyWindow)
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	var total time.Duration
+	count := 0
+	for _, sample := range recorder.samples {
+		if sample.at.After(since) {
+			total += sample.duration
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0
+	}
+	return total / time.Duration(count)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLatencyRecorder(t *testing.T) {
+	var recorder latencyRecorder
+	if stats := recorder.getStats(); stats != (LatencyStats{}) {
+		t.Errorf("Expected no samples and got %+v.", stats)
+	}
+
+	for i := 100; i >= 1; i-- {
+		recorder.record(time.Duration(i) * time.Millisecond)
+	}
+
+	if stats := recorder.getStats(); stats != (LatencyStats{Samples: 100, P50Ms: 50, P95Ms: 95, P99Ms: 99}) {
+		t.Errorf("Expected the percentiles of 1 to 100ms and got %+v.", stats)
+	}
+	if mean := recorder.getMean(); mean != 50500*time.Microsecond {
+		t.Errorf("Expected a mean of 50.5ms and got %s.", mean)
+	}
+
+	// Samples older than the window are left out
+	recorder.samples[0].at = time.Now().Add(-2 * latencyWindow)
+	if stats := recorder.getStats(); stats.Samples != 99 || stats.P99Ms != 99 {
+		t.Errorf("Expected the 100ms sample to be out of the window and got %+v.", stats)
+	}
+
+	// Once full, the oldest samples are replaced
+	for i := 0; i < maxLatencySamples; i++ {
+		recorder.record(time.Second)
+	}
+	if stats := recorder.getStats(); len(recorder.samples) != maxLatencySamples || stats.P50Ms != 1000 {
+		t.Errorf("Expected the window to hold %d samples of 1s and got %d %+v.", maxLatencySamples, len(recorder.samples), stats)
+	}
+}
+
+func TestUpstreamDuration(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	config.UpstreamDurationHeader = true
+	storeConfig(config)
+	defer setConfig()
+
+	samples := upstreamLatency.getStats().Samples
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/v1/chain/get_info", nil)
+	_, ctx := getParsedBody(request)
+	forwardCallToNodeos(recorder, request.WithContext(ctx))
+
+	if duration, _ := strconv.Atoi(recorder.Header().Get("X-Upstream-Duration-Ms")); duration < 20 {
+		t.Errorf("Expected the upstream duration header to be at least 20ms and got %q.", recorder.Header().Get("X-Upstream-Duration-Ms"))
+	}
+
+	recorder = httptest.NewRecorder()
+	getStats(recorder, httptest.NewRequest("GET", "/patroneos/stats", nil))
+
+	var stats Stats
+	json.Unmarshal(recorder.Body.Bytes(), &stats)
+	if stats.UpstreamLatency.Samples != samples+1 || stats.UpstreamLatency.P99Ms < 20 {
+		t.Errorf("Expected the stats to include the request latency and got %+v.", stats.UpstreamLatency)
+	}
+}
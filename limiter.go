@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestLimiter bounds the number of requests that are handled at once.
+// The limit is read on every acquire so it follows config updates; requests
+// that are already in flight release the slot they acquired.
+type requestLimiter struct {
+	lock     sync.Mutex
+	limit    int
+	slots    chan struct{}
+	inFlight int64
+}
+
+// acquire takes a slot, waiting up to wait for one to free up when the limit is reached.
+// It returns a function that releases the slot, and false when no slot was available.
+// A limit of 0 or less is unlimited.
+func (limiter *requestLimiter) acquire(limit int, wait time.Duration) (func(), bool) {
+	slots := limiter.getSlots(limit)
+
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			if wait <= 0 {
+				return nil, false
+			}
+
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+
+			select {
+			case slots <- struct{}{}:
+			case <-timer.C:
+				return nil, false
+			}
+		}
+	}
+
+	atomic.AddInt64(&limiter.inFlight, 1)
+	return func() {
+		atomic.AddInt64(&limiter.inFlight, -1)
+		if slots != nil {
+			<-slots
+		}
+	}, true
+}
+
+// getSlots returns the semaphore for the limit, replacing it when the limit changes.
+func (limiter *requestLimiter) getSlots(limit int) chan struct{} {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if limit <= 0 {
+		limiter.limit = 0
+		limiter.slots = nil
+	} else if limit != limiter.limit {
+		limiter.limit = limit
+		limiter.slots = make(chan struct{}, limit)
+	}
+
+	return limiter.slots
+}
+
+// getInFlight returns the number of requests currently holding a slot.
+func (limiter *requestLimiter) getInFlight() int64 {
+	return atomic.LoadInt64(&limiter.inFlight)
+}
+
+// clientLimiter bounds the requests being filtered and forwarded to nodeos.
+var clientLimiter requestLimiter
+
+// upstreamLimiter bounds the requests nodeos is answering at once, whatever the number of clients.
+var upstreamLimiter requestLimiter
+
+// defaultQueueTimeoutMs is how long a queued request waits for nodeos when queueTimeoutMs is not set.
+const defaultQueueTimeoutMs = 1000
+
+var (
+	errQueueFull    = errors.New("maxQueueLength requests are already waiting for nodeos")
+	errQueueTimeout = errors.New("no maxUpstreamConcurrency slot freed up within queueTimeoutMs")
+)
+
+// upstreamQueue tracks the requests waiting for an upstreamLimiter slot when maxQueueLength is set.
+var upstreamQueue struct {
+	depth int64
+	wait  latencyRecorder
+}
+
+// acquireUpstreamSlot takes a maxUpstreamConcurrency slot before a request is sent to nodeos. Without maxQueueLength
+// a request waits up to upstreamConcurrencyWaitMs. With it, up to maxQueueLength requests wait in turn up to queueTimeoutMs.
+func acquireUpstreamSlot(config *Config) (func(), error) {
+	if config.MaxQueueLength <= 0 {
+		release, acquired := upstreamLimiter.acquire(config.MaxUpstreamConcurrency, time.Duration(config.UpstreamConcurrencyWaitMs)*time.Millisecond)
+		if !acquired {
+			return nil, errUpstreamBusy
+		}
+		return release, nil
+	}
+
+	if release, acquired := upstreamLimiter.acquire(config.MaxUpstreamConcurrency, 0); acquired {
+		return release, nil
+	}
+
+	depth := atomic.AddInt64(&upstreamQueue.depth, 1)
+	defer atomic.AddInt64(&upstreamQueue.depth, -1)
+	if depth > int64(config.MaxQueueLength) {
+		return nil, errQueueFull
+	}
+
+	timeout := time.Duration(config.QueueTimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultQueueTimeoutMs * time.Millisecond
+	}
+
+	// Waiting senders of a channel are served in the order they arrived
+	start := time.Now()
+	release, acquired := upstreamLimiter.acquire(config.MaxUpstreamConcurrency, timeout)
+	upstreamQueue.wait.record(time.Since(start))
+	if !acquired {
+		return nil, errQueueTimeout
+	}
+
+	return release, nil
+}
+
+// getQueueDepth returns the number of requests waiting in the queue.
+func getQueueDepth() int64 {
+	return atomic.LoadInt64(&upstreamQueue.depth)
+}
+
+// getRetryAfter returns how many seconds a client turned away by the queue should wait: the time nodeos
+// takes on average to serve the queued requests, with maxUpstreamConcurrency requests at a time.
+func getRetryAfter(config *Config) int {
+	queued := getQueueDepth() + 1
+	service := upstreamLatency.getMean()
+
+	slots := int64(config.MaxUpstreamConcurrency)
+	if slots <= 0 {
+		slots = 1
+	}
+
+	seconds := int((time.Duration(queued)*service/time.Duration(slots) + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+
+	return seconds
+}
+
+// releasingBody releases the upstream slot of a response once its body is closed, since nodeos is
+// busy with the request until the response has been sent.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (body *releasingBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.release)
+	return err
+}
+
+// limitConcurrency rejects requests with 503 when maxConcurrentRequests requests are already
+// in flight and no slot frees up within concurrencyWaitMs. Like upstream failures, this is not
+// the fault of the client, so it is logged but never sent to fail2ban.
+func limitConcurrency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		wait := time.Duration(config.ConcurrencyWaitMs) * time.Millisecond
+
+		release, acquired := clientLimiter.acquire(config.MaxConcurrentRequests, wait)
+		if !acquired {
+			failure := ErrorMessage{Message: "SERVER_BUSY", Code: http.StatusServiceUnavailable, RequestID: getRequestID(r)}
+			log.Printf("Server busy: %s %s (%d requests in flight)%s", getHost(r), failure.Message, clientLimiter.getInFlight(), requestIDSuffix(r))
+			writeFailure(failure, w)
+			return
+		}
+		defer release()
+
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	var limiter requestLimiter
+
+	release, acquired := limiter.acquire(1, 0)
+	if !acquired {
+		t.Fatalf("Expected the first request to acquire a slot.")
+	}
+
+	if _, acquired := limiter.acquire(1, 10*time.Millisecond); acquired {
+		t.Errorf("Expected the second request to be rejected.")
+	}
+
+	if limiter.getInFlight() != 1 {
+		t.Errorf("Expected 1 request in flight and got %d.", limiter.getInFlight())
+	}
+
+	// A waiting request gets the slot once it is released
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+
+	release, acquired = limiter.acquire(1, time.Second)
+	if !acquired {
+		t.Fatalf("Expected the waiting request to acquire the released slot.")
+	}
+	release()
+
+	if limiter.getInFlight() != 0 {
+		t.Errorf("Expected no requests in flight and got %d.", limiter.getInFlight())
+	}
+
+	// 0 is unlimited
+	for i := 0; i < 5; i++ {
+		if _, acquired := limiter.acquire(0, 0); !acquired {
+			t.Errorf("Expected an unlimited limiter to accept every request.")
+		}
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	var relayed int32
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&relayed, 1)
+	}))
+	defer relay.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.MaxConcurrentRequests = 1
+	config.LogEndpoints = []string{relay.URL}
+	storeConfig(config)
+
+	entered := make(chan bool)
+	unblock := make(chan bool)
+	handler := limitConcurrency(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-unblock
+		w.Write([]byte("SUCCESS\n"))
+	})
+
+	go handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	<-entered
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code to be %d and got %d.", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if recorder.Body.String() != "{\"message\":\"SERVER_BUSY\",\"code\":503}" {
+		t.Errorf("Expected a SERVER_BUSY error and got %s.", recorder.Body.String())
+	}
+	logEvents.flush(time.Second)
+	if atomic.LoadInt32(&relayed) != 0 {
+		t.Errorf("Expected SERVER_BUSY not to be sent to fail2ban and got %d events.", relayed)
+	}
+
+	recorder = httptest.NewRecorder()
+	getStats(recorder, httptest.NewRequest("GET", "/patroneos/stats", nil))
+
+	var stats Stats
+	json.Unmarshal(recorder.Body.Bytes(), &stats)
+	if stats.InFlightRequests != 1 || stats.MaxConcurrentRequests != 1 {
+		t.Errorf("Expected 1 of 1 requests in flight and got %+v.", stats)
+	}
+
+	unblock <- true
+}
+
+func TestLimitUpstreamConcurrency(t *testing.T) {
+	entered := make(chan bool)
+	unblock := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-unblock
+		w.Write([]byte("SUCCESS\n"))
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	config.MaxUpstreamConcurrency = 1
+	config.UpstreamConcurrencyWaitMs = 10
+	storeConfig(config)
+	defer setConfig()
+	resetUpstreams()
+
+	forward := func(recorder *httptest.ResponseRecorder) {
+		request := httptest.NewRequest("GET", "/v1/chain/get_info", nil)
+		_, ctx := getParsedBody(request)
+		forwardCallToNodeos(recorder, request.WithContext(ctx))
+	}
+
+	first := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		forward(first)
+		done <- true
+	}()
+	<-entered
+
+	recorder := httptest.NewRecorder()
+	forward(recorder)
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Body.String() != "{\"message\":\"UPSTREAM_BUSY\",\"code\":503}" {
+		t.Errorf("Expected a 503 UPSTREAM_BUSY and got %d %s.", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	getStats(recorder, httptest.NewRequest("GET", "/patroneos/stats", nil))
+
+	var stats Stats
+	json.Unmarshal(recorder.Body.Bytes(), &stats)
+	if stats.UpstreamInFlightRequests != 1 || stats.MaxUpstreamConcurrency != 1 {
+		t.Errorf("Expected 1 of 1 upstream requests in flight and got %+v.", stats)
+	}
+
+	unblock <- true
+	<-done
+	if first.Code != 200 || upstreamLimiter.getInFlight() != 0 {
+		t.Errorf("Expected the slot to be released with the response and got %d with %d in flight.", first.Code, upstreamLimiter.getInFlight())
+	}
+}
+
+func TestUpstreamQueue(t *testing.T) {
+	entered := make(chan bool)
+	unblock := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-unblock
+		w.Write([]byte("SUCCESS\n"))
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	config.MaxUpstreamConcurrency = 1
+	config.MaxQueueLength = 1
+	config.QueueTimeoutMs = 5000
+	storeConfig(config)
+	defer setConfig()
+	resetUpstreams()
+
+	forward := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/v1/chain/get_info", nil)
+		_, ctx := getParsedBody(request)
+		forwardCallToNodeos(recorder, request.WithContext(ctx))
+		return recorder
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 2)
+	go func() { done <- forward() }()
+	<-entered
+
+	// The second request waits in the queue for the first one to finish
+	go func() { done <- forward() }()
+	for getQueueDepth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	recorder := forward()
+	if recorder.Code != http.StatusTooManyRequests || recorder.Body.String() != "{\"message\":\"QUEUE_FULL\",\"code\":429}" {
+		t.Errorf("Expected a 429 QUEUE_FULL with a full queue and got %d %s.", recorder.Code, recorder.Body.String())
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter == "" || retryAfter == "0" {
+		t.Errorf("Expected a Retry-After header and got %q.", retryAfter)
+	}
+
+	recorder = httptest.NewRecorder()
+	getStats(recorder, httptest.NewRequest("GET", "/patroneos/stats", nil))
+
+	var stats Stats
+	json.Unmarshal(recorder.Body.Bytes(), &stats)
+	if stats.QueueDepth != 1 || stats.MaxQueueLength != 1 {
+		t.Errorf("Expected 1 of 1 requests queued and got %+v.", stats)
+	}
+
+	unblock <- true
+	<-entered
+	unblock <- true
+	for i := 0; i < 2; i++ {
+		if recorder := <-done; recorder.Code != 200 {
+			t.Errorf("Expected the queued requests to reach nodeos and got %d %s.", recorder.Code, recorder.Body.String())
+		}
+	}
+
+	// A request that waits longer than queueTimeoutMs is turned away
+	config.QueueTimeoutMs = 20
+	storeConfig(config)
+
+	go func() { done <- forward() }()
+	<-entered
+
+	recorder = forward()
+	if recorder.Code != http.StatusTooManyRequests || recorder.Body.String() != "{\"message\":\"QUEUE_TIMEOUT\",\"code\":429}" {
+		t.Errorf("Expected a 429 QUEUE_TIMEOUT and got %d %s.", recorder.Code, recorder.Body.String())
+	}
+
+	unblock <- true
+	<-done
+
+	recorder = httptest.NewRecorder()
+	getStats(recorder, httptest.NewRequest("GET", "/patroneos/stats", nil))
+	json.Unmarshal(recorder.Body.Bytes(), &stats)
+	if stats.QueueDepth != 0 || stats.QueueWait.Samples == 0 {
+		t.Errorf("Expected the queue to be empty and its wait to be recorded and got %+v.", stats)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLogQueueLength = 1000
+	defaultLogTimeoutMs   = 2000
+	// logWorkers is the number of log events delivered to the relays at once.
+	logWorkers = 4
+	// logFlushTimeout bounds the time spent delivering the queued events when shutting down.
+	logFlushTimeout = 5 * time.Second
+)
+
+// logQueue delivers log events to the Fail2Ban relays in the background, so a slow or unreachable
+// relay never holds up the requests. Events that do not fit in the queue are dropped and counted.
+type logQueue struct {
+	lock    sync.Mutex
+	length  int
+	events  chan []byte
+	pending int64 // events queued or being delivered
+	dropped int64
+}
+
+// logEvents queues the events sent to logEndpoints.
+var logEvents logQueue
+
+// logClient posts the log events. It does not share the transport of the nodeos client, so relays
+// are reached without the CA, client certificate or proxy configured for nodeos.
+var logClient = http.Client{Transport: &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	MaxIdleConnsPerHost: logWorkers,
+	IdleConnTimeout:     90 * time.Second,
+}}
+
+func getLogQueueLength(config *Config) int {
+	if config.LogQueueLength > 0 {
+		return config.LogQueueLength
+	}
+
+	return defaultLogQueueLength
+}
+
+func getLogTimeout(config *Config) time.Duration {
+	if config.LogTimeoutMs > 0 {
+		return time.Duration(config.LogTimeoutMs) * time.Millisecond
+	}
+
+	return defaultLogTimeoutMs * time.Millisecond
+}
+
+// enqueue queues an event, or drops it when logQueueLength events are already waiting.
+func (queue *logQueue) enqueue(config *Config, body []byte) {
+	length := getLogQueueLength(config)
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	// Start the workers with the first event, and replace the queue when logQueueLength changes.
+	// The workers of the previous queue deliver what it holds, then stop.
+	if length != queue.length {
+		if queue.events != nil {
+			close(queue.events)
+		}
+		queue.length = length
+		queue.events = make(chan []byte, length)
+		for i := 0; i < logWorkers; i++ {
+			go queue.work(queue.events)
+		}
+	}
+
+	if atomic.LoadInt64(&queue.pending) >= int64(length) {
+		queue.drop()
+		return
+	}
+
+	atomic.AddInt64(&queue.pending, 1)
+	select {
+	case queue.events <- body:
+	default:
+		atomic.AddInt64(&queue.pending, -1)
+		queue.drop()
+	}
+}
+
+// work delivers the events of a queue to every relay until the queue is closed.
+func (queue *logQueue) work(events chan []byte) {
+	for body := range events {
+		config := getConfig()
+		for _, logAgent := range config.LogEndpoints {
+			if !strings.Contains(logAgent, "/patroneos/fail2ban-relay") {
+				logAgent += "/patroneos/fail2ban-relay"
+			}
+			if err := deliverLogEvent(logAgent, body, getLogTimeout(config)); err != nil {
+				log.Print(err)
+				logRetries.add(config, logAgent, body)
+			}
+		}
+		atomic.AddInt64(&queue.pending, -1)
+	}
+}
+
+// deliverLogEvent posts an event to a relay, giving up after timeout. A relay that does not answer
+// with a 2xx, such as a proxy in front of a restarting relay, failed to log the event.
+func deliverLogEvent(logAgent string, body []byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	request, err := http.NewRequest("POST", logAgent, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	res, err := logClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", logAgent, res.Status)
+	}
+	return nil
+}
+
+// getPending returns the number of events queued or being delivered.
+func (queue *logQueue) getPending() int64 {
+	return atomic.LoadInt64(&queue.pending)
+}
+
+// drop counts an event that was not delivered.
+func (queue *logQueue) drop() {
+	atomic.AddInt64(&queue.dropped, 1)
+}
+
+// getDropped returns the number of events dropped because the queue or the retry buffer was full,
+// or because they could not be delivered within logRetrySeconds.
+func (queue *logQueue) getDropped() int64 {
+	return atomic.LoadInt64(&queue.dropped)
+}
+
+// flush waits until the queued events were delivered, for up to timeout.
+// It returns the number of events that are still pending.
+func (queue *logQueue) flush(timeout time.Duration) int64 {
+	deadline := time.Now().Add(timeout)
+	for queue.getPending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return queue.getPending()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLogQueue(t *testing.T) {
+	logEvents.flush(time.Second)
+
+	var received int32
+	release := make(chan struct{})
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt32(&received, 1)
+	}))
+	defer relay.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.LogEndpoints = []string{relay.URL}
+	config.LogQueueLength = 5
+	storeConfig(config)
+	defer setConfig()
+
+	// A relay that does not answer neither blocks the requests nor grows the queue
+	dropped := logEvents.getDropped()
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		sendLogEvent(Log{Host: "192.0.2.1", Message: "PARSE_ERROR"})
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected log events to be queued without waiting for the relay and took %s.", elapsed)
+	}
+	if pending, count := logEvents.getPending(), logEvents.getDropped()-dropped; pending != 5 || count != 15 {
+		t.Errorf("Expected 5 queued and 15 dropped events and got %d and %d.", pending, count)
+	}
+
+	close(release)
+	if pending := logEvents.flush(time.Second); pending != 0 || atomic.LoadInt32(&received) != 5 {
+		t.Errorf("Expected the queued events to be delivered and got %d delivered, %d pending.", received, pending)
+	}
+}
+
+func TestLogDeliveryTimeout(t *testing.T) {
+	logEvents.flush(time.Second)
+
+	release := make(chan struct{})
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer relay.Close()
+	defer close(release)
+
+	setConfig()
+	config := *getConfig()
+	config.LogEndpoints = []string{relay.URL}
+	config.LogTimeoutMs = 50
+	storeConfig(config)
+	defer setConfig()
+
+	sendLogEvent(Log{Host: "192.0.2.1", Message: "PARSE_ERROR"})
+	start := time.Now()
+	if pending := logEvents.flush(time.Second); pending != 0 || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected the delivery to give up after logTimeoutMs and got %d pending after %s.", pending, time.Since(start))
+	}
+}
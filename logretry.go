@@ -0,0 +1,196 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLogRetrySeconds      = 300
+	defaultLogRetryBufferLength = 1000
+	// maxLogRetryBackoff bounds the time between two attempts to deliver an event.
+	maxLogRetryBackoff = 30 * time.Second
+	// logRetryPollInterval is how often the retry buffer is checked for events that are due.
+	logRetryPollInterval = 100 * time.Millisecond
+)
+
+// logRetryBackoff is the time before the first retry. It doubles with every failed attempt.
+var logRetryBackoff = 500 * time.Millisecond
+
+// logRetry is an event that a relay failed to log.
+type logRetry struct {
+	logAgent string
+	body     []byte
+	failed   time.Time // the first failure
+	next     time.Time
+	attempts int
+}
+
+// logRetryBuffer keeps the events the relays failed to log, such as while a relay restarts, and retries
+// them with backoff for logRetrySeconds. Events that cannot be kept or delivered are appended to
+// logSpoolFile when it is set, and dropped otherwise.
+type logRetryBuffer struct {
+	lock      sync.Mutex
+	start     sync.Once
+	retries   []*logRetry
+	spoolLock sync.Mutex
+	spooled   int64
+}
+
+// logRetries holds the events waiting to be delivered again.
+var logRetries logRetryBuffer
+
+func getLogRetryDuration(config *Config) time.Duration {
+	if config.LogRetrySeconds > 0 {
+		return time.Duration(config.LogRetrySeconds) * time.Second
+	}
+
+	return defaultLogRetrySeconds * time.Second
+}
+
+func getLogRetryBufferLength(config *Config) int {
+	if config.LogRetryBufferLength > 0 {
+		return config.LogRetryBufferLength
+	}
+
+	return defaultLogRetryBufferLength
+}
+
+// getLogRetryBackoff returns the time to wait after a number of failed attempts.
+func getLogRetryBackoff(attempts int) time.Duration {
+	backoff := logRetryBackoff
+	for i := 1; i < attempts && backoff < maxLogRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxLogRetryBackoff {
+		return maxLogRetryBackoff
+	}
+
+	return backoff
+}
+
+// add keeps an event a relay failed to log, or gives up on it when logRetryBufferLength events are already kept.
+// The retries are started with the first failure.
+func (buffer *logRetryBuffer) add(config *Config, logAgent string, body []byte) {
+	buffer.start.Do(func() {
+		go buffer.work(logRetryPollInterval)
+	})
+
+	now := time.Now()
+
+	buffer.lock.Lock()
+	full := len(buffer.retries) >= getLogRetryBufferLength(config)
+	if !full {
+		buffer.retries = append(buffer.retries, &logRetry{logAgent: logAgent, body: body, failed: now, next: now.Add(getLogRetryBackoff(1)), attempts: 1})
+	}
+	buffer.lock.Unlock()
+
+	if full {
+		buffer.giveUp(config, body)
+	}
+}
+
+// work retries the events that are due every interval.
+func (buffer *logRetryBuffer) work(interval time.Duration) {
+	for range time.Tick(interval) {
+		buffer.retryDue(time.Now())
+	}
+}
+
+// retryDue delivers the events whose backoff elapsed, and gives up on those that failed for logRetrySeconds.
+func (buffer *logRetryBuffer) retryDue(now time.Time) {
+	var due []*logRetry
+
+	buffer.lock.Lock()
+	waiting := buffer.retries[:0]
+	for _, retry := range buffer.retries {
+		if now.Before(retry.next) {
+			waiting = append(waiting, retry)
+		} else {
+			due = append(due, retry)
+		}
+	}
+	buffer.retries = waiting
+	buffer.lock.Unlock()
+
+	config := getConfig()
+	for _, retry := range due {
+		if now.Sub(retry.failed) > getLogRetryDuration(config) {
+			log.Printf("Giving up on a log event for %s after %d attempts", retry.logAgent, retry.attempts)
+			buffer.giveUp(config, retry.body)
+			continue
+		}
+
+		if err := deliverLogEvent(retry.logAgent, retry.body, getLogTimeout(config)); err != nil {
+			retry.attempts++
+			retry.next = time.Now().Add(getLogRetryBackoff(retry.attempts))
+
+			buffer.lock.Lock()
+			buffer.retries = append(buffer.retries, retry)
+			buffer.lock.Unlock()
+		}
+	}
+}
+
+// giveUp appends an event that could not be delivered to logSpoolFile, or drops it.
+func (buffer *logRetryBuffer) giveUp(config *Config, body []byte) {
+	if config.LogSpoolFile != "" {
+		err := buffer.spool(config.LogSpoolFile, body)
+		if err == nil {
+			atomic.AddInt64(&buffer.spooled, 1)
+			return
+		}
+		log.Printf("Error spooling log event %s", err)
+	}
+
+	logEvents.drop()
+}
+
+// spool appends an event to the spool file. Each line is the JSON body of a POST to
+// /patroneos/fail2ban-relay, so the file can be replayed line by line.
+func (buffer *logRetryBuffer) spool(path string, body []byte) error {
+	buffer.spoolLock.Lock()
+	defer buffer.spoolLock.Unlock()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(append([]byte{}, body...), '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// giveUpAll gives up on every event still waiting for a retry, when shutting down.
+// It returns the number of events.
+func (buffer *logRetryBuffer) giveUpAll(config *Config) int {
+	buffer.lock.Lock()
+	retries := buffer.retries
+	buffer.retries = nil
+	buffer.lock.Unlock()
+
+	for _, retry := range retries {
+		buffer.giveUp(config, retry.body)
+	}
+
+	return len(retries)
+}
+
+// getDepth returns the number of events waiting for a retry.
+func (buffer *logRetryBuffer) getDepth() int {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+
+	return len(buffer.retries)
+}
+
+// getSpooled returns the number of events appended to logSpoolFile.
+func (buffer *logRetryBuffer) getSpooled() int64 {
+	return atomic.LoadInt64(&buffer.spooled)
+}
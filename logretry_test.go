@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetLogRetries forgets the events kept by previous tests and makes retries fast.
+func resetLogRetries() func() {
+	logEvents.flush(time.Second)
+
+	// Clear twice, in case a retry in flight puts its event back
+	for i := 0; i < 2; i++ {
+		logRetries.lock.Lock()
+		logRetries.retries = nil
+		logRetries.lock.Unlock()
+		time.Sleep(2 * logRetryPollInterval)
+	}
+
+	backoff := logRetryBackoff
+	logRetryBackoff = 10 * time.Millisecond
+	return func() { logRetryBackoff = backoff }
+}
+
+// waitFor polls condition for up to timeout.
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+func TestLogRetries(t *testing.T) {
+	defer resetLogRetries()()
+
+	var attempts, logged int32
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The relay is restarting for the first attempts
+		if atomic.AddInt32(&attempts, 1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&logged, 1)
+	}))
+	defer relay.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.LogEndpoints = []string{relay.URL}
+	storeConfig(config)
+	defer setConfig()
+
+	sendLogEvent(Log{Host: "192.0.2.1", Message: "PARSE_ERROR"})
+	logEvents.flush(time.Second)
+
+	if !waitFor(2*time.Second, func() bool { return atomic.LoadInt32(&logged) == 1 }) {
+		t.Fatalf("Expected the event to be retried until the relay logged it and got %d attempts.", attempts)
+	}
+	if depth := logRetries.getDepth(); depth != 0 || atomic.LoadInt32(&attempts) != 4 {
+		t.Errorf("Expected the event to leave the retry buffer after 4 attempts and got %d waiting after %d attempts.", depth, attempts)
+	}
+}
+
+func TestLogRetryBackoff(t *testing.T) {
+	defer resetLogRetries()()
+
+	if backoff := getLogRetryBackoff(1); backoff != logRetryBackoff {
+		t.Errorf("Expected the first retry after %s and got %s.", logRetryBackoff, backoff)
+	}
+	if backoff := getLogRetryBackoff(3); backoff != 4*logRetryBackoff {
+		t.Errorf("Expected the backoff to double with every attempt and got %s.", backoff)
+	}
+	if backoff := getLogRetryBackoff(100); backoff != maxLogRetryBackoff {
+		t.Errorf("Expected the backoff to be bounded to %s and got %s.", maxLogRetryBackoff, backoff)
+	}
+}
+
+func TestLogSpool(t *testing.T) {
+	defer resetLogRetries()()
+
+	directory, err := ioutil.TempDir("", "patroneos-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer relay.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.LogEndpoints = []string{relay.URL}
+	config.LogRetrySeconds = 1
+	config.LogRetryBufferLength = 1
+	storeConfig(config)
+	defer setConfig()
+
+	// Without logSpoolFile, an event that does not fit in the retry buffer is dropped
+	dropped := logEvents.getDropped()
+	sendLogEvent(Log{Host: "192.0.2.1", Message: "PARSE_ERROR"})
+	sendLogEvent(Log{Host: "192.0.2.2", Message: "PARSE_ERROR"})
+	logEvents.flush(time.Second)
+	if count := logEvents.getDropped() - dropped; count != 1 || logRetries.getDepth() != 1 {
+		t.Errorf("Expected 1 event to be kept and 1 dropped and got %d dropped, %d kept.", count, logRetries.getDepth())
+	}
+
+	// With it, events that are given up on are spooled
+	config.LogSpoolFile = filepath.Join(directory, "spool.ndjson")
+	storeConfig(config)
+
+	spooled := logRetries.getSpooled()
+	if !waitFor(3*time.Second, func() bool { return logRetries.getSpooled() == spooled+1 }) {
+		t.Fatalf("Expected the event to be spooled after logRetrySeconds and got %d waiting.", logRetries.getDepth())
+	}
+
+	sendLogEvent(Log{Host: "192.0.2.3", Message: "BLACKLISTED_CONTRACT"})
+	logEvents.flush(time.Second)
+	if count := logRetries.giveUpAll(getConfig()); count != 1 {
+		t.Errorf("Expected the waiting event to be spooled when shutting down and got %d.", count)
+	}
+
+	content, _ := ioutil.ReadFile(config.LogSpoolFile)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 spooled events and got %q.", content)
+	}
+
+	var event Log
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil || event.Host != "192.0.2.3" || event.Message != "BLACKLISTED_CONTRACT" {
+		t.Errorf("Expected each line to be a log event and got %q %v.", lines[1], err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// rotationSuffix is the layout of the timestamp appended to rotated log files.
+const rotationSuffix = "20060102T150405.000"
+
+// rotatingFile is the fail2ban log file. Once it grows past logMaxSizeMB it is renamed with a timestamp
+// suffix and a new file is opened at the same path, so fail2ban keeps reading the path it was given.
+// Backups beyond logMaxBackups or older than logMaxAgeDays are removed.
+type rotatingFile struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+// openRotatingFile opens the log file at path for appending.
+func openRotatingFile(path string) (*rotatingFile, error) {
+	file, size, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rotatingFile{path: path, file: file, size: size}, nil
+}
+
+// openLogFile opens the file at path for appending and returns its size.
+func openLogFile(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+// swap replaces the file with one that was just opened. The lock must be held.
+func (rotating *rotatingFile) swap(file *os.File, size int64) {
+	rotating.file.Close()
+	rotating.file = file
+	rotating.size = size
+}
+
+// Write appends to the file, rotating it first when the line would take it past logMaxSizeMB.
+// The line is written to the current file if the rotation fails, so fail2ban does not miss it.
+func (rotating *rotatingFile) Write(line []byte) (int, error) {
+	rotating.lock.Lock()
+	defer rotating.lock.Unlock()
+
+	config := getConfig()
+	maxSize := int64(config.LogMaxSizeMB) * 1024 * 1024
+	if maxSize > 0 && rotating.size > 0 && rotating.size+int64(len(line)) > maxSize {
+		if err := rotating.rotate(config); err != nil {
+			log.Printf("Error rotating log file %s", err)
+		}
+	}
+
+	n, err := rotating.file.Write(line)
+	rotating.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file with a timestamp suffix, opens a new one at path and prunes the backups.
+// The current file is kept when either step fails. The lock must be held.
+func (rotating *rotatingFile) rotate(config *Config) error {
+	// Files rotated within the same millisecond get the next free timestamp
+	rotated := time.Now().UTC()
+	backup := rotating.path + "." + rotated.Format(rotationSuffix)
+	for _, err := os.Stat(backup); err == nil; _, err = os.Stat(backup) {
+		rotated = rotated.Add(time.Millisecond)
+		backup = rotating.path + "." + rotated.Format(rotationSuffix)
+	}
+	if err := os.Rename(rotating.path, backup); err != nil {
+		return err
+	}
+
+	file, size, err := openLogFile(rotating.path)
+	if err != nil {
+		// Move the current file back to the path fail2ban follows
+		os.Rename(backup, rotating.path)
+		return err
+	}
+	rotating.swap(file, size)
+
+	pruneLogBackups(rotating.path, config.LogMaxBackups, time.Duration(config.LogMaxAgeDays)*24*time.Hour)
+	return nil
+}
+
+// pruneLogBackups removes the rotated files of path beyond the newest maxBackups, and those
+// older than maxAge. A limit of 0 keeps every backup.
+func pruneLogBackups(path string, maxBackups int, maxAge time.Duration) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return
+	}
+
+	var backups []string
+	for _, match := range matches {
+		if _, err := time.Parse(rotationSuffix, strings.TrimPrefix(match, path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+
+	// The suffix sorts in the order the files were rotated, newest first here
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, backup := range backups {
+		expired := false
+		if maxAge > 0 {
+			if info, err := os.Stat(backup); err == nil && time.Since(info.ModTime()) > maxAge {
+				expired = true
+			}
+		}
+
+		if (maxBackups > 0 && i >= maxBackups) || expired {
+			os.Remove(backup)
+		}
+	}
+}
+
+// reopen opens logFileLocation again, so lines are written to a new file once an external tool such
+// as logrotate renamed the current one. Writes in flight wait for the new file, and the current file
+// is kept if the new one cannot be opened.
+func (rotating *rotatingFile) reopen() error {
+	rotating.lock.Lock()
+	defer rotating.lock.Unlock()
+
+	file, size, err := openLogFile(rotating.path)
+	if err != nil {
+		return err
+	}
+
+	rotating.swap(file, size)
+	return nil
+}
+
+// reopenOnSignal reopens the log file when patroneos receives a SIGUSR1 or a SIGHUP.
+func reopenOnSignal(rotating *rotatingFile) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGHUP)
+
+	for range signals {
+		if err := rotating.reopen(); err != nil {
+			log.Printf("Error reopening log file %s", err)
+		} else {
+			log.Printf("Reopened log file %s", rotating.path)
+		}
+	}
+}
+
+// Close closes the file.
+func (rotating *rotatingFile) Close() error {
+	rotating.lock.Lock()
+	defer rotating.lock.Unlock()
+
+	return rotating.file.Close()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	directory, err := ioutil.TempDir("", "patroneos-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	setConfig()
+	config := *getConfig()
+	config.LogMaxSizeMB = 1
+	config.LogMaxBackups = 2
+	config.LogMaxAgeDays = 1
+	storeConfig(config)
+	defer setConfig()
+
+	path := filepath.Join(directory, "patroneos.log")
+
+	// A backup older than logMaxAgeDays is removed at the next rotation
+	expired := path + "." + time.Now().Add(-72*time.Hour).UTC().Format(rotationSuffix)
+	ioutil.WriteFile(expired, []byte("old\n"), 0644)
+	os.Chtimes(expired, time.Now().Add(-72*time.Hour), time.Now().Add(-72*time.Hour))
+
+	rotating, err := openRotatingFile(path)
+	if err != nil {
+		t.Fatalf("Expected the log file to open and got %s.", err)
+	}
+	defer rotating.Close()
+
+	line := append(bytes.Repeat([]byte("x"), 200*1024-1), '\n')
+	for i := 0; i < 5; i++ {
+		rotating.Write(line)
+	}
+	if backups, _ := filepath.Glob(path + ".*"); len(backups) != 1 {
+		t.Fatalf("Expected no rotation below logMaxSizeMB and got %v.", backups)
+	}
+
+	rotating.Write(line)
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(line)) {
+		t.Errorf("Expected a new file at the same path with the last line and got %v %v.", info, err)
+	}
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("Expected the expired backup to be removed and got %v.", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		rotating.Write(line)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("Expected logMaxBackups backups and got %v.", backups)
+	}
+	for _, backup := range backups {
+		if info, _ := os.Stat(backup); info.Size() != 5*int64(len(line)) {
+			t.Errorf("Expected %s to hold 5 lines and got %d bytes.", backup, info.Size())
+		}
+	}
+}
+
+func TestReopenRotatingFile(t *testing.T) {
+	directory, err := ioutil.TempDir("", "patroneos-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "patroneos.log")
+	rotating, err := openRotatingFile(path)
+	if err != nil {
+		t.Fatalf("Expected the log file to open and got %s.", err)
+	}
+	defer rotating.Close()
+
+	rotating.Write([]byte("before\n"))
+
+	// What logrotate does before it signals patroneos
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rotating.reopen(); err != nil {
+		t.Fatalf("Expected the log file to reopen and got %s.", err)
+	}
+	rotating.Write([]byte("after\n"))
+
+	if content, _ := ioutil.ReadFile(path); string(content) != "after\n" {
+		t.Errorf("Expected new lines at logFileLocation and got %q.", content)
+	}
+	if content, _ := ioutil.ReadFile(path + ".1"); string(content) != "before\n" {
+		t.Errorf("Expected the renamed file to keep the earlier lines and got %q.", content)
+	}
+}
+
+func TestRotatingFileFailure(t *testing.T) {
+	directory, err := ioutil.TempDir("", "patroneos-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	setConfig()
+	config := *getConfig()
+	config.LogMaxSizeMB = 1
+	storeConfig(config)
+	defer setConfig()
+
+	path := filepath.Join(directory, "patroneos.log")
+	rotating, err := openRotatingFile(path)
+	if err != nil {
+		t.Fatalf("Expected the log file to open and got %s.", err)
+	}
+	defer rotating.Close()
+
+	line := append(bytes.Repeat([]byte("x"), 600*1024-1), '\n')
+	rotating.Write(line)
+
+	// The file cannot be renamed once its directory is gone, the lines still go to the open file
+	if err := os.Rename(directory, directory+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory + ".moved")
+
+	if n, err := rotating.Write(line); n != len(line) || err != nil {
+		t.Errorf("Expected the line to be written to the current file when rotating fails and got %d %v.", n, err)
+	}
+	if info, err := os.Stat(filepath.Join(directory+".moved", "patroneos.log")); err != nil || info.Size() != 2*int64(len(line)) {
+		t.Errorf("Expected the current file to keep every line and got %v %v.", info, err)
+	}
+}
+
+func TestReopenRotatingFileFailure(t *testing.T) {
+	directory, err := ioutil.TempDir("", "patroneos-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "patroneos.log")
+	rotating, err := openRotatingFile(path)
+	if err != nil {
+		t.Fatalf("Expected the log file to open and got %s.", err)
+	}
+	defer rotating.Close()
+
+	// The directory of logFileLocation is gone, so the file cannot be opened again
+	if err := os.Rename(directory, directory+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory + ".moved")
+
+	if err := rotating.reopen(); err == nil {
+		t.Errorf("Expected reopening a missing directory to fail.")
+	}
+	if _, err := rotating.Write([]byte("kept\n")); err != nil {
+		t.Errorf("Expected the current file to be kept and got %s.", err)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(directory+".moved", "patroneos.log")); string(content) != "kept\n" {
+		t.Errorf("Expected the line in the current file and got %q.", content)
+	}
+}
@@ -1,72 +1,691 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
 )
 
 // Config defines the application configuration
 type Config struct {
-	ListenIP           string            `json:"listenIP"`
-	ConfigListenPort   string            `json:"configListenPort"`
-	ListenPort         string            `json:"listenPort"`
-	NodeosProtocol     string            `json:"nodeosProtocol"`
-	NodeosURL          string            `json:"nodeosUrl"`
-	NodeosPort         string            `json:"nodeosPort"`
-	ContractBlackList  map[string]bool   `json:"contractBlackList"`
-	MaxSignatures      int               `json:"maxSignatures"`
-	MaxTransactionSize int               `json:"maxTransactionSize"`
-	MaxTransactions    int               `json:"maxTransactions"`
-	LogEndpoints       []string          `json:"logEndpoints"`
-	FilterEndpoints    []string          `json:"filterEndpoints"`
-	LogFileLocation    string            `json:"logFileLocation"`
-	Headers            map[string]string `json:"headers"`
+	ListenAddress                 string              `json:"listenAddress" yaml:"listenAddress"`
+	ListenIP                      string              `json:"listenIP" yaml:"listenIP"`
+	AdminListenPort               string              `json:"adminListenPort" yaml:"adminListenPort"`
+	ConfigListenPort              string              `json:"configListenPort" yaml:"configListenPort"`
+	ListenPort                    string              `json:"listenPort" yaml:"listenPort"`
+	NodeosProtocol                string              `json:"nodeosProtocol" yaml:"nodeosProtocol"`
+	NodeosURL                     string              `json:"nodeosUrl" yaml:"nodeosUrl"`
+	NodeosPort                    string              `json:"nodeosPort" yaml:"nodeosPort"`
+	NodeosUpstream                string              `json:"nodeosUpstream" yaml:"nodeosUpstream"`
+	NodeosUpstreams               []string            `json:"nodeosUpstreams" yaml:"nodeosUpstreams"`
+	UpstreamWeights               map[string]int      `json:"upstreamWeights" yaml:"upstreamWeights"`
+	NamedUpstreams                map[string]string   `json:"namedUpstreams" yaml:"namedUpstreams"`
+	Routes                        map[string]string   `json:"routes" yaml:"routes"`
+	NodeosPathPrefix              string              `json:"nodeosPathPrefix" yaml:"nodeosPathPrefix"`
+	StripPathPrefix               string              `json:"stripPathPrefix" yaml:"stripPathPrefix"`
+	NodeosCAFile                  string              `json:"nodeosCAFile" yaml:"nodeosCAFile"`
+	NodeosTLSInsecureSkipVerify   bool                `json:"nodeosTLSInsecureSkipVerify" yaml:"nodeosTLSInsecureSkipVerify"`
+	UpstreamProxyURL              string              `json:"upstreamProxyUrl" yaml:"upstreamProxyUrl"`
+	NoProxy                       []string            `json:"noProxy" yaml:"noProxy"`
+	NodeosClientCertFile          string              `json:"nodeosClientCertFile" yaml:"nodeosClientCertFile"`
+	NodeosClientKeyFile           string              `json:"nodeosClientKeyFile" yaml:"nodeosClientKeyFile"`
+	NodeosBasicAuthUser           string              `json:"nodeosBasicAuthUser" yaml:"nodeosBasicAuthUser"`
+	NodeosBasicAuthPassword       string              `json:"nodeosBasicAuthPassword" yaml:"nodeosBasicAuthPassword"`
+	HealthCheckSeconds            int                 `json:"healthCheckSeconds" yaml:"healthCheckSeconds"`
+	DNSRefreshSeconds             int                 `json:"dnsRefreshSeconds" yaml:"dnsRefreshSeconds"`
+	UpstreamMaxIdleConns          int                 `json:"upstreamMaxIdleConns" yaml:"upstreamMaxIdleConns"`
+	UpstreamMaxIdleConnsPerHost   int                 `json:"upstreamMaxIdleConnsPerHost" yaml:"upstreamMaxIdleConnsPerHost"`
+	UpstreamMaxConnsPerHost       int                 `json:"upstreamMaxConnsPerHost" yaml:"upstreamMaxConnsPerHost"`
+	UpstreamIdleTimeoutSeconds    int                 `json:"upstreamIdleTimeoutSeconds" yaml:"upstreamIdleTimeoutSeconds"`
+	UpstreamDisableKeepAlives     bool                `json:"upstreamDisableKeepAlives" yaml:"upstreamDisableKeepAlives"`
+	UpstreamRetries               int                 `json:"upstreamRetries" yaml:"upstreamRetries"`
+	UpstreamRetryBackoffMs        int                 `json:"upstreamRetryBackoffMs" yaml:"upstreamRetryBackoffMs"`
+	UpstreamRetryPaths            []string            `json:"upstreamRetryPaths" yaml:"upstreamRetryPaths"`
+	MaxResponseBytes              int                 `json:"maxResponseBytes" yaml:"maxResponseBytes"`
+	PenalizedNodeosErrors         []string            `json:"penalizedNodeosErrors" yaml:"penalizedNodeosErrors"`
+	UpstreamDurationHeader        bool                `json:"upstreamDurationHeader" yaml:"upstreamDurationHeader"`
+	PreserveHostHeader            bool                `json:"preserveHostHeader" yaml:"preserveHostHeader"`
+	CachePaths                    []string            `json:"cachePaths" yaml:"cachePaths"`
+	CacheTTLMs                    int                 `json:"cacheTtlMs" yaml:"cacheTtlMs"`
+	CacheMaxEntries               int                 `json:"cacheMaxEntries" yaml:"cacheMaxEntries"`
+	ContractBlackList             map[string]bool     `json:"contractBlackList" yaml:"contractBlackList"`
+	ContractBlackListPatterns     []string            `json:"contractBlackListPatterns" yaml:"contractBlackListPatterns"`
+	ContractWhiteList             map[string]bool     `json:"contractWhiteList" yaml:"contractWhiteList"`
+	AccountBlackList              map[string]bool     `json:"accountBlackList" yaml:"accountBlackList"`
+	ActionBlackList               []string            `json:"actionBlackList" yaml:"actionBlackList"`
+	Rules                         []Rule              `json:"rules" yaml:"rules"`
+	SystemActionLimits            map[string]string   `json:"systemActionLimits" yaml:"systemActionLimits"`
+	RecipientBlackList            map[string]bool     `json:"recipientBlackList" yaml:"recipientBlackList"`
+	ScopeBlackList                map[string]bool     `json:"scopeBlackList" yaml:"scopeBlackList"`
+	MaxSignatures                 int                 `json:"maxSignatures" yaml:"maxSignatures"`
+	MaxTotalSignatures            int                 `json:"maxTotalSignatures" yaml:"maxTotalSignatures"`
+	RejectDuplicateSignatures     bool                `json:"rejectDuplicateSignatures" yaml:"rejectDuplicateSignatures"`
+	AllowAnySignatureFormat       bool                `json:"allowAnySignatureFormat" yaml:"allowAnySignatureFormat"`
+	MaxTransactionSize            int                 `json:"maxTransactionSize" yaml:"maxTransactionSize"`
+	MaxTransactionSizePerContract map[string]int      `json:"maxTransactionSizePerContract" yaml:"maxTransactionSizePerContract"`
+	MaxTotalTransactionSize       int                 `json:"maxTotalTransactionSize" yaml:"maxTotalTransactionSize"`
+	MaxTransactions               int                 `json:"maxTransactions" yaml:"maxTransactions"`
+	MaxActions                    int                 `json:"maxActions" yaml:"maxActions"`
+	MaxAuthorizations             int                 `json:"maxAuthorizations" yaml:"maxAuthorizations"`
+	MaxBodyBytes                  int                 `json:"maxBodyBytes" yaml:"maxBodyBytes"`
+	MaxURLLength                  int                 `json:"maxURLLength" yaml:"maxURLLength"`
+	MaxHeaderBytes                int                 `json:"maxHeaderBytes" yaml:"maxHeaderBytes"`
+	MaxHeaderFields               int                 `json:"maxHeaderFields" yaml:"maxHeaderFields"`
+	MaxHeaderValueLength          int                 `json:"maxHeaderValueLength" yaml:"maxHeaderValueLength"`
+	BlockedHeaderPatterns         map[string][]string `json:"blockedHeaderPatterns" yaml:"blockedHeaderPatterns"`
+	AllowCompressedTransactions   bool                `json:"allowCompressedTransactions" yaml:"allowCompressedTransactions"`
+	AllowMissingContentType       bool                `json:"allowMissingContentType" yaml:"allowMissingContentType"`
+	StrictParsing                 bool                `json:"strictParsing" yaml:"strictParsing"`
+	MaxExpirationSeconds          int                 `json:"maxExpirationSeconds" yaml:"maxExpirationSeconds"`
+	MaxExpirationAheadSeconds     int                 `json:"maxExpirationAheadSeconds" yaml:"maxExpirationAheadSeconds"`
+	ExpirationSkewSeconds         int                 `json:"expirationSkewSeconds" yaml:"expirationSkewSeconds"`
+	MaxDelaySec                   *int                `json:"maxDelaySec" yaml:"maxDelaySec"`
+	DedupWindowSeconds            int                 `json:"dedupWindowSeconds" yaml:"dedupWindowSeconds"`
+	DedupCacheSize                int                 `json:"dedupCacheSize" yaml:"dedupCacheSize"`
+	MaxTransactionsPerActor       int                 `json:"maxTransactionsPerActor" yaml:"maxTransactionsPerActor"`
+	MaxConcurrentRequests         int                 `json:"maxConcurrentRequests" yaml:"maxConcurrentRequests"`
+	AllowedPaths                  []string            `json:"allowedPaths" yaml:"allowedPaths"`
+	BlockedPaths                  []string            `json:"blockedPaths" yaml:"blockedPaths"`
+	AllowedMethods                map[string][]string `json:"allowedMethods" yaml:"allowedMethods"`
+	MaintenanceMode               bool                `json:"maintenanceMode" yaml:"maintenanceMode"`
+	MaintenancePaths              []string            `json:"maintenancePaths" yaml:"maintenancePaths"`
+	ConcurrencyWaitMs             int                 `json:"concurrencyWaitMs" yaml:"concurrencyWaitMs"`
+	MaxUpstreamConcurrency        int                 `json:"maxUpstreamConcurrency" yaml:"maxUpstreamConcurrency"`
+	UpstreamConcurrencyWaitMs     int                 `json:"upstreamConcurrencyWaitMs" yaml:"upstreamConcurrencyWaitMs"`
+	MaxQueueLength                int                 `json:"maxQueueLength" yaml:"maxQueueLength"`
+	QueueTimeoutMs                int                 `json:"queueTimeoutMs" yaml:"queueTimeoutMs"`
+	LogEndpoints                  []string            `json:"logEndpoints" yaml:"logEndpoints"`
+	LogQueueLength                int                 `json:"logQueueLength" yaml:"logQueueLength"`
+	LogTimeoutMs                  int                 `json:"logTimeoutMs" yaml:"logTimeoutMs"`
+	LogRetrySeconds               int                 `json:"logRetrySeconds" yaml:"logRetrySeconds"`
+	LogRetryBufferLength          int                 `json:"logRetryBufferLength" yaml:"logRetryBufferLength"`
+	LogSpoolFile                  string              `json:"logSpoolFile" yaml:"logSpoolFile"`
+	FilterEndpoints               []string            `json:"filterEndpoints" yaml:"filterEndpoints"`
+	AuditMode                     bool                `json:"auditMode" yaml:"auditMode"`
+	TrustedSources                []string            `json:"trustedSources" yaml:"trustedSources"`
+	TrustedProxies                []string            `json:"trustedProxies" yaml:"trustedProxies"`
+	StatusCodes                   map[string]int      `json:"statusCodes" yaml:"statusCodes"`
+	VerboseErrors                 bool                `json:"verboseErrors" yaml:"verboseErrors"`
+	MaxJSONDepth                  int                 `json:"maxJSONDepth" yaml:"maxJSONDepth"`
+	MaxJSONTokens                 int                 `json:"maxJSONTokens" yaml:"maxJSONTokens"`
+	MaxJSONStringLength           int                 `json:"maxJSONStringLength" yaml:"maxJSONStringLength"`
+	LogFileLocation               string              `json:"logFileLocation" yaml:"logFileLocation"`
+	LogMaxSizeMB                  int                 `json:"logMaxSizeMB" yaml:"logMaxSizeMB"`
+	LogMaxBackups                 int                 `json:"logMaxBackups" yaml:"logMaxBackups"`
+	LogMaxAgeDays                 int                 `json:"logMaxAgeDays" yaml:"logMaxAgeDays"`
+	Headers                       map[string]string   `json:"headers" yaml:"headers"`
+	CORSAllowedOrigins            []string            `json:"corsAllowedOrigins" yaml:"corsAllowedOrigins"`
+	CORSAllowedHeaders            []string            `json:"corsAllowedHeaders" yaml:"corsAllowedHeaders"`
+	CORSMaxAge                    int                 `json:"corsMaxAge" yaml:"corsMaxAge"`
+	AdminToken                    string              `json:"adminToken" yaml:"adminToken"`
+	BypassTokens                  []BypassToken       `json:"bypassTokens" yaml:"bypassTokens"`
+
+	ConfigAllowedCIDRs      []string `json:"configAllowedCIDRs" yaml:"configAllowedCIDRs"`
+	ConfigTrustForwardedFor bool     `json:"configTrustForwardedFor" yaml:"configTrustForwardedFor"`
+	ConfigHistorySize       int      `json:"configHistorySize" yaml:"configHistorySize"`
+	DisableConfigEndpoint   bool     `json:"disableConfigEndpoint" yaml:"disableConfigEndpoint"`
+	ConfigReadOnly          bool     `json:"configReadOnly" yaml:"configReadOnly"`
+
+	AuditLogLocation string `json:"auditLogLocation" yaml:"auditLogLocation"`
+	WatchConfig      bool   `json:"watchConfig" yaml:"watchConfig"`
+
+	TLSCertFile string `json:"tlsCertFile" yaml:"tlsCertFile"`
+	TLSKeyFile  string `json:"tlsKeyFile" yaml:"tlsKeyFile"`
+}
+
+// hostNamePattern matches RFC 1123 host names.
+var hostNamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// Defaults for config fields that are omitted or left at their zero value.
+// maxTransactions is not defaulted since 0 means unlimited.
+const (
+	defaultListenPort         = "8080"
+	defaultNodeosProtocol     = "http"
+	defaultNodeosPort         = "8888"
+	defaultMaxSignatures      = 10
+	defaultMaxTransactionSize = 100000
+	defaultMaxJSONDepth       = 64
+	defaultConfigHistorySize  = 10
+)
+
+// BypassToken lets requests carrying the token in the X-Patroneos-Bypass header skip the filters.
+// The label identifies the token in the logs.
+type BypassToken struct {
+	Label string `json:"label" yaml:"label"`
+	Token string `json:"token" yaml:"token"`
 }
 
+// minBypassTokenLength keeps bypass tokens long enough that they cannot be guessed before fail2ban bans the source.
+const minBypassTokenLength = 16
+
+// redactedValue replaces secrets in config responses. Posting it back keeps the current secret.
+const redactedValue = "REDACTED"
+
 var (
 	configFile    string // path to config.json
+	configFormat  string // serialization format of the config file (json or yaml)
 	operatingMode string // operating mode (filter or relay)
 	version       string // application version
 	commit        string // sha1 commit hash used to build application
 	buildDate     string // compilation date
-	appConfig     Config // configuration fields
+	fileConfig    Config // configuration fields as persisted in configFile
 )
 
-// updateConfig allows the configuration to be updated via POST requests.
-func updateConfig(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		responseBody, err := json.MarshalIndent(appConfig, "", "    ")
+// writeErrorMessage writes an ErrorMessage response with the given status code.
+func writeErrorMessage(w http.ResponseWriter, message string, statusCode int) {
+	errorBody, _ := json.Marshal(ErrorMessage{Message: message, Code: statusCode})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, err := w.Write(errorBody)
+
+	if err != nil {
+		log.Printf("Error writing response body %s", err)
+	}
+}
+
+// getAdminToken returns the token presented in the Authorization or X-Patroneos-Token header.
+func getAdminToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+
+	return r.Header.Get("X-Patroneos-Token")
+}
+
+// requireAdmin rejects requests that do not carry the configured admin token.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminToken := getConfig().AdminToken
+		if adminToken != "" {
+			token := getAdminToken(r)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				log.Printf("Unauthorized config request from %s", getHost(r))
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeErrorMessage(w, "UNAUTHORIZED", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// parseCIDRs parses a list of CIDRs, treating bare IP addresses as single host networks.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not a valid IP address or CIDR", cidr)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
 		if err != nil {
-			log.Printf("Failed to marshal config %s", err)
+			return nil, fmt.Errorf("%q is not a valid IP address or CIDR", cidr)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// containsIP reports whether the address, with or without a port, is inside any of the networks.
+func containsIP(networks []*net.IPNet, address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(host))
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireAllowedSource rejects config requests from clients outside configAllowedCIDRs.
+// An empty list allows every client.
+func requireAllowedSource(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		if len(config.ConfigAllowedCIDRs) > 0 {
+			networks, _ := parseCIDRs(config.ConfigAllowedCIDRs)
+
+			// getHost only believes X-Forwarded-For from trustedProxies
+			address := r.RemoteAddr
+			if config.ConfigTrustForwardedFor {
+				address = getHost(r)
+			}
+
+			if !containsIP(networks, address) {
+				log.Printf("Forbidden config request from %s", address)
+				writeErrorMessage(w, "FORBIDDEN", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requireConfigEnabled hides the config endpoints when disableConfigEndpoint is set
+// and only allows reads when configReadOnly is set.
+func requireConfigEnabled(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+
+		if config.DisableConfigEndpoint {
+			http.NotFound(w, r)
 			return
 		}
 
-		_, err = w.Write(responseBody)
-		if err != nil {
-			log.Printf("Error writing response body %s", err)
+		if config.ConfigReadOnly && r.Method != "GET" {
+			log.Printf("Rejected %s %s, the config is read only", r.Method, r.URL.Path)
+			writeErrorMessage(w, "CONFIG_READ_ONLY", http.StatusForbidden)
 			return
 		}
-	} else if r.Method == "POST" {
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// redactConfig returns a copy of the config that is safe to return to clients.
+func redactConfig(config Config) Config {
+	if config.AdminToken != "" {
+		config.AdminToken = redactedValue
+	}
+
+	if config.NodeosBasicAuthPassword != "" {
+		config.NodeosBasicAuthPassword = redactedValue
+	}
+
+	if len(config.BypassTokens) > 0 {
+		tokens := make([]BypassToken, len(config.BypassTokens))
+		for i, token := range config.BypassTokens {
+			tokens[i] = BypassToken{Label: token.Label, Token: redactedValue}
+		}
+		config.BypassTokens = tokens
+	}
+
+	return config
+}
+
+// restoreRedacted replaces the redacted secrets of a posted config with the current ones.
+func restoreRedacted(config *Config, current Config) {
+	if config.AdminToken == redactedValue {
+		config.AdminToken = current.AdminToken
+	}
+
+	if config.NodeosBasicAuthPassword == redactedValue {
+		config.NodeosBasicAuthPassword = current.NodeosBasicAuthPassword
+	}
+
+	for i, token := range config.BypassTokens {
+		if token.Token != redactedValue {
+			continue
+		}
+		for _, existing := range current.BypassTokens {
+			if existing.Label == token.Label {
+				config.BypassTokens[i].Token = existing.Token
+			}
+		}
+	}
+}
+
+// configError lists every problem found while validating a config.
+type configError []error
+
+func (errs configError) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// applyDefaults fills in fields that were omitted from the config.
+func applyDefaults(config *Config) {
+	if config.ListenPort == "" {
+		config.ListenPort = defaultListenPort
+	}
+
+	if config.NodeosProtocol == "" {
+		config.NodeosProtocol = defaultNodeosProtocol
+	}
+
+	if config.NodeosPort == "" {
+		config.NodeosPort = defaultNodeosPort
+	}
+
+	if config.MaxSignatures == 0 {
+		config.MaxSignatures = defaultMaxSignatures
+	}
+
+	if config.MaxTransactionSize == 0 {
+		config.MaxTransactionSize = defaultMaxTransactionSize
+	}
+
+	if config.MaxJSONDepth == 0 {
+		config.MaxJSONDepth = defaultMaxJSONDepth
+	}
+}
+
+// copyConfig returns a deep copy of the config so maps and lists are not shared.
+func copyConfig(config Config) (Config, error) {
+	var copied Config
+
+	body, err := json.Marshal(config)
+	if err != nil {
+		return copied, err
+	}
+
+	err = json.Unmarshal(body, &copied)
+	return copied, err
+}
+
+// currentConfig holds a *Config with the running configuration, including
+// environment and command-line overrides. The Config it points to is never modified; updates
+// build a new Config and swap it in with storeConfig.
+var currentConfig atomic.Value
+
+func init() {
+	storeConfig(Config{})
+}
+
+// getConfig returns the running configuration. It must be treated as read only.
+func getConfig() *Config {
+	return currentConfig.Load().(*Config)
+}
+
+// storeConfig makes config the running configuration.
+func storeConfig(config Config) {
+	contractPatterns.Store(compileContractPatterns(config.ContractBlackListPatterns))
+
+	// Invalid sources are rejected by validateConfig
+	networks, _ := parseCIDRs(config.TrustedSources)
+	trustedNetworks.Store(networks)
+	proxies, _ := parseCIDRs(config.TrustedProxies)
+	trustedProxyNetworks.Store(proxies)
+
+	headerPatterns.Store(compileHeaderPatterns(config.BlockedHeaderPatterns))
+
+	currentConfig.Store(&config)
+}
+
+// writeTempFile writes the new contents of a file being replaced. It is a variable so tests can simulate failures.
+var writeTempFile = func(file *os.File, body []byte) error {
+	_, err := file.Write(body)
+	return err
+}
+
+// writeFileAtomic replaces a file without ever leaving it partially written.
+// The body is written to a temporary file in the same directory, synced and
+// renamed over the original, keeping the original's permissions. The previous
+// version is kept as path.bak.
+func writeFileAtomic(path string, body []byte) error {
+	mode := os.FileMode(0644)
+	previous, err := ioutil.ReadFile(path)
+	if err == nil {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	err = writeTempFile(file, body)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	if previous != nil {
+		err = ioutil.WriteFile(path+".bak", previous, mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// configUpdateLock serializes config updates so read-modify-write changes are not lost.
+var configUpdateLock sync.Mutex
+
+// applyConfig makes a config read from the file or the config endpoint the
+// running config, after environment and command-line overrides and validation, and persists it.
+func applyConfig(newConfig Config) error {
+	effectiveConfig, err := copyConfig(newConfig)
+	if err != nil {
+		return err
+	}
+
+	err = applyEnvOverrides(&effectiveConfig)
+	if err != nil {
+		return err
+	}
+
+	err = applyFlagOverrides(&effectiveConfig)
+	if err != nil {
+		return err
+	}
+	applyDefaults(&effectiveConfig)
+
+	if errs := validateConfig(effectiveConfig, operatingMode); len(errs) > 0 {
+		return configError(errs)
+	}
+
+	// Persist the config without environment and command-line overrides
+	fileBody, err := marshalConfig(newConfig, configFormat)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(configFile, fileBody)
+	if err != nil {
+		return err
+	}
+
+	fileConfig = newConfig
+	storeConfig(effectiveConfig)
+	recordConfigRevision(newConfig)
+	return nil
+}
+
+// updateConfig allows the configuration to be replaced via POST requests
+// and partially updated via PATCH requests.
+func updateConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		writeJSON(w, redactConfig(*getConfig()))
+	} else if r.Method == "POST" || r.Method == "PATCH" {
 		body, _ := ioutil.ReadAll(r.Body)
 
-		err := json.Unmarshal(body, &appConfig)
+		configUpdateLock.Lock()
+		defer configUpdateLock.Unlock()
+
+		var newConfig Config
+		var err error
+
+		// PATCH merges the supplied fields into the current config
+		if r.Method == "PATCH" {
+			newConfig, err = copyConfig(fileConfig)
+			if err != nil {
+				log.Printf("Error copying current config %s", err)
+				writeErrorMessage(w, "INTERNAL_ERROR", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+
+		err = decoder.Decode(&newConfig)
 		if err != nil {
 			log.Printf("Error unmarshalling updated config %s", err)
+			writeErrorMessage(w, "INVALID_CONFIG: "+err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		err = ioutil.WriteFile(configFile, body, 0644)
-		if err != nil {
-			log.Printf("Error writing new configuration to file %s", err)
+		restoreRedacted(&newConfig, fileConfig)
+
+		previous := fileConfig
+		err = applyConfig(newConfig)
+		if errs, invalid := err.(configError); invalid {
+			log.Printf("Rejected config update: %s", errs)
+			writeErrorMessage(w, "INVALID_CONFIG: "+errs.Error(), http.StatusBadRequest)
 			return
+		} else if err != nil {
+			log.Printf("Error applying new configuration %s", err)
+			writeErrorMessage(w, "CONFIG_NOT_SAVED", http.StatusInternalServerError)
+			return
+		}
+
+		auditConfigChange(r, previous, fileConfig)
+
+		writeJSON(w, redactConfig(*getConfig()))
+	} else {
+		w.Header().Set("Allow", "GET, POST, PATCH")
+		writeErrorMessage(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+	}
+}
+
+// addAdminHandlers registers the configuration and operational endpoints.
+func addAdminHandlers(mux *http.ServeMux) {
+	configMiddleware := chainMiddleware(requireConfigEnabled, requireAllowedSource, requireAdmin)
+
+	mux.HandleFunc("/patroneos/config", configMiddleware(updateConfig))
+	mux.HandleFunc("/patroneos/config/history", configMiddleware(getConfigHistory))
+	mux.HandleFunc("/patroneos/config/rollback", configMiddleware(rollbackConfig))
+	mux.HandleFunc("/patroneos/config/audit", configMiddleware(getConfigAudit))
+	mux.HandleFunc("/patroneos/blacklist", configMiddleware(updateBlacklist))
+	mux.HandleFunc("/patroneos/blacklist/", configMiddleware(updateBlacklist))
+	mux.HandleFunc("/patroneos/stats", configMiddleware(getStats))
+	mux.HandleFunc("/patroneos/dedup", configMiddleware(flushDedupCache))
+	mux.HandleFunc("/patroneos/maintenance", configMiddleware(updateMaintenanceMode))
+	mux.HandleFunc("/patroneos/upstreams", configMiddleware(getUpstreamStatus))
+	mux.HandleFunc("/patroneos/upstream/reset", configMiddleware(resetUpstreamConnections))
+	// Alias of /patroneos/upstream/reset, kept for the clients that already use it
+	mux.HandleFunc("/patroneos/upstreams/reset", configMiddleware(resetUpstreamConnections))
+}
+
+// serve binds every server before serving any of them so a port that cannot be
+// bound is fatal at startup, then runs them until one fails or the process is
+// asked to stop, at which point they are all shut down together.
+// Servers with a TLSConfig are served over HTTPS.
+func serve(servers []*http.Server) {
+	listeners := make([]net.Listener, len(servers))
+
+	for i, server := range servers {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			log.Fatalf("Error listening on %s %s", server.Addr, err)
+		}
+		listeners[i] = listener
+	}
+
+	errs := make(chan error, len(servers))
+	for i, server := range servers {
+		go func(server *http.Server, listener net.Listener) {
+			if server.TLSConfig != nil {
+				errs <- server.ServeTLS(listener, "", "")
+			} else {
+				errs <- server.Serve(listener)
+			}
+		}(server, listeners[i])
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	var serveErr error
+	select {
+	case serveErr = <-errs:
+		log.Printf("Server stopped %s", serveErr)
+	case received := <-signals:
+		log.Printf("Received %s, shutting down", received)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("Error shutting down %s %s", server.Addr, err)
 		}
 	}
+
+	if pending := logEvents.flush(logFlushTimeout); pending > 0 {
+		log.Printf("Dropped %d log events that were not delivered before shutting down", pending)
+	}
+	if waiting := logRetries.giveUpAll(getConfig()); waiting > 0 {
+		log.Printf("Gave up on %d log events waiting for a retry when shutting down", waiting)
+	}
+
+	if serveErr != nil {
+		os.Exit(1)
+	}
 }
 
 func parseArgs() {
@@ -78,14 +697,19 @@ func parseArgs() {
 	)
 
 	var (
-		showHelp    bool
-		showVersion bool
+		showHelp        bool
+		showVersion     bool
+		validate        bool
+		validateConnect bool
 	)
 
 	flag.BoolVar(&showHelp, "h", defaultShowHelp, "shows application help")
 	flag.BoolVar(&showVersion, "v", defaultShowVersion, "show application version")
 	flag.StringVar(&configFile, "configFile", defaultConfigLocation, "location of the file used for application configuration")
 	flag.StringVar(&operatingMode, "mode", defaultOperatingMode, "mode in which the application will run")
+	flag.BoolVar(&validate, "validate", false, "validate the configuration file for the mode and exit")
+	flag.BoolVar(&validateConnect, "validateConnections", false, "with -validate, also check that nodeos and the log endpoints are reachable")
+	registerConfigFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -94,6 +718,10 @@ func parseArgs() {
 		os.Exit(0)
 	}
 
+	if validate {
+		os.Exit(validateConfigFile(validateConnect))
+	}
+
 	if showVersion {
 		var buildDateTime string
 
@@ -111,42 +739,1037 @@ func parseArgs() {
 	}
 }
 
+// getConfigFormat returns the serialization format of a config file based on its extension.
+func getConfigFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	default:
+		return "json"
+	}
+}
+
+// unmarshalConfig parses a config body in the given format.
+func unmarshalConfig(body []byte, format string, config *Config) error {
+	if format == "yaml" {
+		return yaml.UnmarshalStrict(body, config)
+	}
+
+	return json.Unmarshal(body, config)
+}
+
+// marshalConfig serializes a config in the given format.
+func marshalConfig(config Config, format string) ([]byte, error) {
+	if format == "yaml" {
+		return yaml.Marshal(config)
+	}
+
+	return json.MarshalIndent(config, "", "    ")
+}
+
+// loadConfigFile reads a config file and returns the config as written in the
+// file along with the effective config after environment and command-line overrides and defaults.
+func loadConfigFile(path string) (Config, Config, error) {
+	var config Config
+
+	fileBody, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, config, fmt.Errorf("Error reading configuration file %s", err)
+	}
+
+	err = unmarshalConfig(fileBody, getConfigFormat(path), &config)
+	if err != nil {
+		return config, config, fmt.Errorf("Error unmarshalling configuration file %s", err)
+	}
+
+	effectiveConfig, err := copyConfig(config)
+	if err != nil {
+		return config, config, fmt.Errorf("Error copying configuration %s", err)
+	}
+
+	err = applyEnvOverrides(&effectiveConfig)
+	if err != nil {
+		return config, config, fmt.Errorf("Error applying environment overrides %s", err)
+	}
+
+	err = applyFlagOverrides(&effectiveConfig)
+	if err != nil {
+		return config, config, fmt.Errorf("Error applying command-line overrides %s", err)
+	}
+
+	applyDefaults(&effectiveConfig)
+	return config, effectiveConfig, nil
+}
+
 func parseConfigFile() {
-	fileBody, err := ioutil.ReadFile(configFile)
+	configFormat = getConfigFormat(configFile)
 
+	persistedConfig, config, err := loadConfigFile(configFile)
 	if err != nil {
-		log.Fatalf("Error reading configuration file.")
+		log.Fatal(err)
 	}
 
-	err = json.Unmarshal(fileBody, &appConfig)
+	fileConfig = persistedConfig
+	storeConfig(config)
+	recordConfigRevision(fileConfig)
+}
+
+// configWatchInterval is how often configFile is checked for changes when watchConfig is set.
+const configWatchInterval = 2 * time.Second
 
+// reloadConfigFile applies configFile again if it changed, using the same
+// validation as startup. An invalid file leaves the running config untouched.
+func reloadConfigFile() (bool, error) {
+	configUpdateLock.Lock()
+	defer configUpdateLock.Unlock()
+
+	persistedConfig, config, err := loadConfigFile(configFile)
 	if err != nil {
-		log.Fatalf("Error unmarshalling configuration file.")
+		return false, err
+	}
+
+	// Skip files that match the running config, such as our own updates
+	current, _ := json.Marshal(fileConfig)
+	updated, _ := json.Marshal(persistedConfig)
+	if bytes.Equal(current, updated) {
+		return false, nil
+	}
+
+	if errs := validateConfig(config, operatingMode); len(errs) > 0 {
+		return false, configError(errs)
 	}
+
+	fileConfig = persistedConfig
+	storeConfig(config)
+	recordConfigRevision(fileConfig)
+	return true, nil
 }
 
-func main() {
-	parseArgs()
-	parseConfigFile()
+// watchConfigFile polls configFile and reloads it when it changes. The file is
+// checked by path, so it keeps working when tools replace it with a rename.
+func watchConfigFile(interval time.Duration) {
+	var lastModTime time.Time
+	var lastSize int64
 
-	mux := http.NewServeMux()
+	if info, err := os.Stat(configFile); err == nil {
+		lastModTime, lastSize = info.ModTime(), info.Size()
+	}
 
-	if operatingMode == "filter" {
-		addFilterHandlers(mux)
-		fmt.Println("Filtering node requests...")
-	} else if operatingMode == "fail2ban-relay" {
-		addLogHandlers(mux)
-		fmt.Println("Relaying log events to fail2ban...")
-	} else {
-		fmt.Printf("This mode is not supported.")
-		os.Exit(1)
+	for range time.Tick(interval) {
+		info, err := os.Stat(configFile)
+		if err != nil {
+			log.Printf("Error checking configuration file %s", err)
+			continue
+		}
+
+		if info.ModTime().Equal(lastModTime) && info.Size() == lastSize {
+			continue
+		}
+		lastModTime, lastSize = info.ModTime(), info.Size()
+
+		reloaded, err := reloadConfigFile()
+		if err != nil {
+			log.Printf("Error reloading configuration file, keeping the current configuration: %s", err)
+		} else if reloaded {
+			log.Printf("Reloaded configuration file %s", configFile)
+		}
+	}
+}
+
+// getDialAddress returns the host:port to dial for an http or https URL.
+func getDialAddress(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
 	}
 
-	go func() {
-		configMux := http.NewServeMux()
-		configMux.HandleFunc("/patroneos/config", updateConfig)
-		log.Fatal(http.ListenAndServe(appConfig.ListenIP+":"+appConfig.ConfigListenPort, configMux))
-	}()
+	port := parsed.Port()
+	if port == "" {
+		port = "80"
+		if parsed.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	return net.JoinHostPort(parsed.Hostname(), port), nil
+}
+
+// validateUpstreamURL checks that an upstream is an http or https URL without a query.
+func validateUpstreamURL(field string, upstream string) error {
+	parsed, err := url.Parse(upstream)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.RawQuery != "" {
+		return fmt.Errorf("%s: %q must be an http or https URL without a query", field, upstream)
+	}
+
+	if port := parsed.Port(); port != "" {
+		return validatePort(field, port)
+	}
+
+	return nil
+}
+
+// checkConnections attempts to connect to nodeos and the log endpoints.
+func checkConnections(config Config, mode string) []error {
+	var errs []error
+	var addresses []string
+
+	if mode == "filter" {
+		if err := checkUnixSocket(&config); err != nil {
+			errs = append(errs, fmt.Errorf("cannot connect to %s: %s", config.NodeosURL, err))
+		} else if config.NodeosProtocol != "unix" {
+			for _, upstream := range getAllUpstreams(&config) {
+				address, _ := getDialAddress(upstream)
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	for _, endpoint := range config.LogEndpoints {
+		address, err := getDialAddress(endpoint)
+		if err != nil {
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+
+	for _, address := range addresses {
+		connection, err := net.DialTimeout("tcp", address, 3*time.Second)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot connect to %s: %s", address, err))
+			continue
+		}
+		connection.Close()
+	}
+
+	return errs
+}
+
+// validateConfigFile prints a validation report for configFile and returns the exit code.
+// It uses the same validation as startup and the config endpoint.
+func validateConfigFile(connect bool) int {
+	_, config, err := loadConfigFile(configFile)
+	if err != nil {
+		fmt.Printf("%s: %s\n", configFile, err)
+		return 1
+	}
+
+	errs := validateConfig(config, operatingMode)
+	if connect && len(errs) == 0 {
+		errs = checkConnections(config, operatingMode)
+	}
+
+	if len(errs) > 0 {
+		fmt.Printf("%s: invalid configuration for %s mode\n", configFile, operatingMode)
+		for _, err := range errs {
+			fmt.Printf("    %s\n", err)
+		}
+		return 1
+	}
+
+	fmt.Printf("%s: valid configuration for %s mode\n", configFile, operatingMode)
+	return 0
+}
+
+// envName converts a json config field name to its environment variable,
+// e.g. nodeosUrl becomes PATRONEOS_NODEOS_URL.
+func envName(field string) string {
+	runes := []rune(field)
+	name := "PATRONEOS_"
+
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previousLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if previousLower || (nextLower && unicode.IsUpper(runes[i-1])) {
+				name += "_"
+			}
+		}
+		name += string(unicode.ToUpper(r))
+	}
+
+	return name
+}
+
+// splitList splits a comma separated environment value, ignoring empty entries.
+func splitList(value string) []string {
+	var items []string
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// setFieldFromEnv parses an environment or command-line value into a config field.
+// Lists and maps are comma separated; maps of values use key=value pairs,
+// while boolean maps only need the keys.
+func setFieldFromEnv(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(number))
+	case reflect.Bool:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(enabled)
+	case reflect.Ptr:
+		element := reflect.New(field.Type().Elem())
+		err := setFieldFromEnv(element.Elem(), value)
+		if err != nil {
+			return err
+		}
+		field.Set(element)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", field.Type())
+		}
+		field.Set(reflect.ValueOf(splitList(value)))
+	case reflect.Map:
+		if field.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map type %s", field.Type())
+		}
+
+		entries := reflect.MakeMap(field.Type())
+		for _, item := range splitList(value) {
+			key := item
+			element := reflect.New(field.Type().Elem()).Elem()
+
+			if element.Kind() == reflect.Bool {
+				element.SetBool(true)
+			} else {
+				pair := strings.SplitN(item, "=", 2)
+				if len(pair) != 2 {
+					return fmt.Errorf("%q is not a key=value pair", item)
+				}
+				key = strings.TrimSpace(pair[0])
+				err := setFieldFromEnv(element, strings.TrimSpace(pair[1]))
+				if err != nil {
+					return err
+				}
+			}
+
+			entries.SetMapIndex(reflect.ValueOf(key), element)
+		}
+		field.Set(entries)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+// applyEnvOverrides replaces config values with any PATRONEOS_* environment
+// variables that are set. Values are resolved in the order
+// config file < environment < command-line flag, see applyFlagOverrides.
+func applyEnvOverrides(config *Config) error {
+	return applyOverrides(config, func(name string) (string, string, bool) {
+		value, exists := os.LookupEnv(envName(name))
+		return envName(name), value, exists
+	})
+}
+
+// applyFlagOverrides replaces config values with the command-line flags named after
+// them, e.g. -nodeosUrl. It runs after applyEnvOverrides so flags take precedence.
+func applyFlagOverrides(config *Config) error {
+	return applyOverrides(config, func(name string) (string, string, bool) {
+		value, exists := flagOverrides[name]
+		return "-" + name, value, exists
+	})
+}
+
+// applyOverrides sets every config field for which lookup, given its json name, returns a value.
+// lookup also returns the name of the override for error messages.
+func applyOverrides(config *Config, lookup func(name string) (string, string, bool)) error {
+	value := reflect.ValueOf(config).Elem()
+
+	for i := 0; i < value.NumField(); i++ {
+		name := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		source, override, exists := lookup(name)
+		if !exists {
+			continue
+		}
+
+		err := setFieldFromEnv(value.Field(i), override)
+		if err != nil {
+			return fmt.Errorf("%s: %s", source, err)
+		}
+	}
+
+	return nil
+}
+
+// flagOverrides holds the config values set on the command line, by json field name.
+var flagOverrides = map[string]string{}
+
+// configFlag is a command-line flag that overrides the config field of the same name.
+type configFlag struct {
+	name    string
+	boolean bool
+}
+
+func (configFlag *configFlag) String() string {
+	return flagOverrides[configFlag.name]
+}
+
+func (configFlag *configFlag) Set(value string) error {
+	flagOverrides[configFlag.name] = value
+	return nil
+}
+
+// IsBoolFlag lets boolean fields be set with -name alone.
+func (configFlag *configFlag) IsBoolFlag() bool {
+	return configFlag.boolean
+}
+
+// registerConfigFlags adds a flag for every config field, named after its json name.
+// Values are parsed like the environment overrides.
+func registerConfigFlags(flags *flag.FlagSet) {
+	configType := reflect.TypeOf(Config{})
+
+	for i := 0; i < configType.NumField(); i++ {
+		name := strings.Split(configType.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || flags.Lookup(name) != nil {
+			continue
+		}
+
+		boolean := configType.Field(i).Type.Kind() == reflect.Bool
+		flags.Var(&configFlag{name: name, boolean: boolean}, name, "overrides "+name+" from the config file and environment")
+	}
+}
+
+// validatePort checks that a port is numeric and within the valid TCP range.
+func validatePort(field string, port string) error {
+	number, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a number", field, port)
+	}
+
+	if number < 1 || number > 65535 {
+		return fmt.Errorf("%s: %d is out of range (1-65535)", field, number)
+	}
+
+	return nil
+}
+
+// getAdminListenPort returns the port of the admin listener, or an empty string when the admin
+// endpoints are served on listenPort. configListenPort is the deprecated name of adminListenPort.
+func getAdminListenPort(config *Config) string {
+	if config.AdminListenPort != "" {
+		return config.AdminListenPort
+	}
+
+	return config.ConfigListenPort
+}
+
+// getServers returns the public server for the mux and, when adminListenPort is set, a server for the admin endpoints.
+// The admin endpoints are never served on the public listener, so they are disabled without adminListenPort.
+func getServers(config *Config, mux *http.ServeMux) []*http.Server {
+	servers := []*http.Server{
+		{Addr: net.JoinHostPort(getListenAddress(config), config.ListenPort), Handler: mux, MaxHeaderBytes: config.MaxHeaderBytes},
+	}
+
+	if getAdminListenPort(config) != "" {
+		adminMux := http.NewServeMux()
+		addAdminHandlers(adminMux)
+		servers = append(servers, &http.Server{Addr: net.JoinHostPort(getListenAddress(config), getAdminListenPort(config)), Handler: adminMux})
+	}
+
+	return servers
+}
+
+// getListenAddress returns the address patroneos listens on, or an empty string for all
+// interfaces. listenIP is the deprecated name of listenAddress.
+func getListenAddress(config *Config) string {
+	if config.ListenAddress != "" {
+		return config.ListenAddress
+	}
+
+	return config.ListenIP
+}
+
+// validateListenAddress checks that the listen address is empty (all interfaces),
+// an IPv4/IPv6 literal or a host name.
+func validateListenAddress(field string, address string) error {
+	if address == "" || net.ParseIP(address) != nil {
+		return nil
+	}
+
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		return fmt.Errorf("%s: %q must not be bracketed, use %s", field, address, strings.Trim(address, "[]"))
+	}
+
+	if !hostNamePattern.MatchString(address) {
+		return fmt.Errorf("%s: %q is not a valid IP address or host name", field, address)
+	}
+
+	return nil
+}
+
+// validateConfig checks that the configuration contains everything the given
+// operating mode needs and returns an error for every offending field.
+func validateConfig(config Config, mode string) []error {
+	var errs []error
+
+	if err := validateListenAddress("listenAddress", config.ListenAddress); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateListenAddress("listenIP", config.ListenIP); err != nil {
+		errs = append(errs, err)
+	}
+
+	if config.ListenPort == "" {
+		errs = append(errs, errors.New("listenPort: is required"))
+	} else if err := validatePort("listenPort", config.ListenPort); err != nil {
+		errs = append(errs, err)
+	}
+
+	if config.AdminListenPort != "" {
+		if err := validatePort("adminListenPort", config.AdminListenPort); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if config.ConfigListenPort != "" {
+		if err := validatePort("configListenPort", config.ConfigListenPort); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		errs = append(errs, errors.New("tlsCertFile: tlsCertFile and tlsKeyFile must be set together"))
+	} else if config.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("tlsCertFile: %s", err))
+		}
+	}
+
+	if config.MaxConcurrentRequests < 0 {
+		errs = append(errs, errors.New("maxConcurrentRequests: must not be negative"))
+	}
+
+	if config.ConcurrencyWaitMs < 0 {
+		errs = append(errs, errors.New("concurrencyWaitMs: must not be negative"))
+	}
+
+	if config.ConfigHistorySize < 0 {
+		errs = append(errs, errors.New("configHistorySize: must not be negative"))
+	}
+
+	if _, err := parseCIDRs(config.ConfigAllowedCIDRs); err != nil {
+		errs = append(errs, fmt.Errorf("configAllowedCIDRs: %s", err))
+	}
+
+	for _, endpoint := range config.LogEndpoints {
+		parsed, err := url.ParseRequestURI(endpoint)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("logEndpoints: %q is not a valid URL", endpoint))
+		}
+	}
+
+	switch mode {
+	case "filter":
+		if len(config.NodeosUpstreams) > 0 {
+			for _, upstream := range config.NodeosUpstreams {
+				if err := validateUpstreamURL("nodeosUpstreams", upstream); err != nil {
+					errs = append(errs, err)
+				}
+			}
+
+			weighted := false
+			for _, upstream := range config.NodeosUpstreams {
+				weighted = weighted || getUpstreamWeight(&config, upstream) > 0
+			}
+			if !weighted {
+				errs = append(errs, errors.New("upstreamWeights: at least one upstream must have a positive weight"))
+			}
+		} else if config.NodeosUpstream != "" {
+			if err := validateUpstreamURL("nodeosUpstream", config.NodeosUpstream); err != nil {
+				errs = append(errs, err)
+			}
+		} else {
+			if config.NodeosProtocol != "http" && config.NodeosProtocol != "https" && config.NodeosProtocol != "unix" {
+				errs = append(errs, fmt.Errorf("nodeosProtocol: %q must be http, https or unix", config.NodeosProtocol))
+			}
+
+			if config.NodeosURL == "" {
+				errs = append(errs, errors.New("nodeosUrl: is required"))
+			} else if config.NodeosProtocol == "unix" && !filepath.IsAbs(config.NodeosURL) {
+				errs = append(errs, fmt.Errorf("nodeosUrl: %q must be the absolute path of the nodeos socket", config.NodeosURL))
+			}
+
+			// The port is not used by unix sockets
+			if config.NodeosProtocol != "unix" {
+				if config.NodeosPort == "" {
+					errs = append(errs, errors.New("nodeosPort: is required"))
+				} else if err := validatePort("nodeosPort", config.NodeosPort); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+
+		if config.MaxSignatures <= 0 {
+			errs = append(errs, errors.New("maxSignatures: must be greater than 0"))
+		}
+
+		if config.MaxTransactionSize <= 0 {
+			errs = append(errs, errors.New("maxTransactionSize: must be greater than 0"))
+		}
+
+		for contract, limit := range config.MaxTransactionSizePerContract {
+			if limit <= 0 {
+				errs = append(errs, fmt.Errorf("maxTransactionSizePerContract: limit for %s must be greater than 0", contract))
+			}
+		}
+
+		for _, pattern := range config.ContractBlackListPatterns {
+			if _, err := compileContractPattern(pattern); err != nil {
+				errs = append(errs, fmt.Errorf("contractBlackListPatterns: %s", err))
+			}
+		}
+
+		for _, rule := range config.ActionBlackList {
+			if _, _, err := parseActionRule(rule); err != nil {
+				errs = append(errs, fmt.Errorf("actionBlackList: %s", err))
+			}
+		}
+
+		for _, rule := range config.Rules {
+			if err := rule.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("rules: %s", err))
+			}
+		}
+
+		for name, limit := range config.SystemActionLimits {
+			if _, err := parseSystemActionLimit(name, limit); err != nil {
+				errs = append(errs, fmt.Errorf("systemActionLimits: %s", err))
+			}
+		}
+
+		if config.MaxURLLength < 0 {
+			errs = append(errs, errors.New("maxURLLength: must not be negative"))
+		}
+
+		if config.MaxHeaderBytes < 0 {
+			errs = append(errs, errors.New("maxHeaderBytes: must not be negative"))
+		}
+
+		if config.MaxHeaderFields < 0 {
+			errs = append(errs, errors.New("maxHeaderFields: must not be negative"))
+		}
+
+		if config.MaxHeaderValueLength < 0 {
+			errs = append(errs, errors.New("maxHeaderValueLength: must not be negative"))
+		}
+
+		if config.MaxTransactionsPerActor < 0 {
+			errs = append(errs, errors.New("maxTransactionsPerActor: must not be negative"))
+		}
+
+		if config.MaxTotalSignatures < 0 {
+			errs = append(errs, errors.New("maxTotalSignatures: must not be negative"))
+		}
+
+		if config.MaxTotalTransactionSize < 0 {
+			errs = append(errs, errors.New("maxTotalTransactionSize: must not be negative"))
+		}
+
+		if config.MaxTransactions < 0 {
+			errs = append(errs, errors.New("maxTransactions: must not be negative"))
+		}
+
+		if config.MaxBodyBytes < 0 {
+			errs = append(errs, errors.New("maxBodyBytes: must not be negative"))
+		}
+
+		for _, prefix := range config.AllowedPaths {
+			if !strings.HasPrefix(prefix, "/") {
+				errs = append(errs, fmt.Errorf("allowedPaths: %q must start with /", prefix))
+			}
+		}
+
+		for _, prefix := range config.BlockedPaths {
+			if !strings.HasPrefix(prefix, "/") {
+				errs = append(errs, fmt.Errorf("blockedPaths: %q must start with /", prefix))
+			}
+		}
+
+		for header, patterns := range config.BlockedHeaderPatterns {
+			for _, pattern := range patterns {
+				if _, err := regexp.Compile(pattern); err != nil {
+					errs = append(errs, fmt.Errorf("blockedHeaderPatterns: %s: %s", header, err))
+				}
+			}
+		}
+
+		for field, value := range map[string]int{
+			"upstreamMaxIdleConns":        config.UpstreamMaxIdleConns,
+			"upstreamMaxIdleConnsPerHost": config.UpstreamMaxIdleConnsPerHost,
+			"upstreamMaxConnsPerHost":     config.UpstreamMaxConnsPerHost,
+			"upstreamIdleTimeoutSeconds":  config.UpstreamIdleTimeoutSeconds,
+		} {
+			if value < 0 {
+				errs = append(errs, fmt.Errorf("%s: must not be negative", field))
+			}
+		}
+
+		if config.NodeosBasicAuthPassword != "" && config.NodeosBasicAuthUser == "" {
+			errs = append(errs, errors.New("nodeosBasicAuthPassword: requires nodeosBasicAuthUser"))
+		}
+
+		if (config.NodeosClientCertFile == "") != (config.NodeosClientKeyFile == "") {
+			errs = append(errs, errors.New("nodeosClientCertFile: nodeosClientCertFile and nodeosClientKeyFile must be set together"))
+		} else if config.NodeosClientCertFile != "" {
+			if _, err := tls.LoadX509KeyPair(config.NodeosClientCertFile, config.NodeosClientKeyFile); err != nil {
+				errs = append(errs, fmt.Errorf("nodeosClientCertFile: %s", err))
+			}
+		}
+
+		if config.UpstreamProxyURL != "" && config.UpstreamProxyURL != "none" {
+			if _, err := parseProxyURL(config.UpstreamProxyURL); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		for _, entry := range config.NoProxy {
+			if _, _, err := net.ParseCIDR(entry); strings.Contains(entry, "/") && err != nil {
+				errs = append(errs, fmt.Errorf("noProxy: %q is not a valid CIDR", entry))
+			}
+		}
+
+		if config.NodeosCAFile != "" {
+			if _, err := newUpstreamTransport(&config); err != nil {
+				errs = append(errs, fmt.Errorf("nodeosCAFile: %s", err))
+			}
+		}
+
+		for _, prefix := range []struct{ field, value string }{{"nodeosPathPrefix", config.NodeosPathPrefix}, {"stripPathPrefix", config.StripPathPrefix}} {
+			if strings.ContainsAny(prefix.value, "?#") || !isSafePath(&url.URL{Path: prefix.value}) {
+				errs = append(errs, fmt.Errorf("%s: %q must be a path without a query or .. segments", prefix.field, prefix.value))
+			}
+		}
+
+		if config.MaxResponseBytes < 0 {
+			errs = append(errs, errors.New("maxResponseBytes: must not be negative"))
+		}
+
+		for _, code := range config.PenalizedNodeosErrors {
+			if code == "" || strings.Trim(code, "0123456789") != "" {
+				errs = append(errs, fmt.Errorf("penalizedNodeosErrors: %q is not a nodeos error code", code))
+			}
+		}
+
+		if config.MaxUpstreamConcurrency < 0 {
+			errs = append(errs, errors.New("maxUpstreamConcurrency: must not be negative"))
+		}
+
+		if config.UpstreamConcurrencyWaitMs < 0 {
+			errs = append(errs, errors.New("upstreamConcurrencyWaitMs: must not be negative"))
+		}
+
+		if config.MaxQueueLength < 0 {
+			errs = append(errs, errors.New("maxQueueLength: must not be negative"))
+		} else if config.MaxQueueLength > 0 && config.MaxUpstreamConcurrency == 0 {
+			errs = append(errs, errors.New("maxQueueLength: requires maxUpstreamConcurrency"))
+		}
+
+		if config.QueueTimeoutMs < 0 {
+			errs = append(errs, errors.New("queueTimeoutMs: must not be negative"))
+		}
+
+		if config.DNSRefreshSeconds < 0 {
+			errs = append(errs, errors.New("dnsRefreshSeconds: must not be negative"))
+		}
+
+		if config.HealthCheckSeconds < 0 {
+			errs = append(errs, errors.New("healthCheckSeconds: must not be negative"))
+		}
+
+		if config.UpstreamRetries < 0 {
+			errs = append(errs, errors.New("upstreamRetries: must not be negative"))
+		} else if config.UpstreamRetries > maxUpstreamRetries {
+			errs = append(errs, fmt.Errorf("upstreamRetries: must be at most %d", maxUpstreamRetries))
+		}
+
+		if config.UpstreamRetryBackoffMs < 0 {
+			errs = append(errs, errors.New("upstreamRetryBackoffMs: must not be negative"))
+		}
+
+		for _, upstream := range config.NamedUpstreams {
+			if err := validateUpstreamURL("namedUpstreams", upstream); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		for prefix, name := range config.Routes {
+			if !strings.HasPrefix(prefix, "/") {
+				errs = append(errs, fmt.Errorf("routes: %q must start with /", prefix))
+			}
+			if _, exists := config.NamedUpstreams[name]; !exists {
+				errs = append(errs, fmt.Errorf("routes: %q routes to %q, which is not one of namedUpstreams", prefix, name))
+			}
+		}
+
+		for upstream, weight := range config.UpstreamWeights {
+			listed := false
+			for _, configured := range config.NodeosUpstreams {
+				listed = listed || configured == upstream
+			}
+
+			if !listed {
+				errs = append(errs, fmt.Errorf("upstreamWeights: %q is not one of nodeosUpstreams", upstream))
+			} else if weight < 0 {
+				errs = append(errs, fmt.Errorf("upstreamWeights: the weight of %q must not be negative", upstream))
+			}
+		}
+
+		for _, cachedPath := range config.CachePaths {
+			if cachedPath != path.Clean("/"+cachedPath) {
+				errs = append(errs, fmt.Errorf("cachePaths: %q must be a clean path starting with /", cachedPath))
+			}
+		}
+
+		if config.CacheTTLMs < 0 {
+			errs = append(errs, errors.New("cacheTtlMs: must not be negative"))
+		}
+
+		if config.CacheMaxEntries < 0 {
+			errs = append(errs, errors.New("cacheMaxEntries: must not be negative"))
+		}
+
+		if config.LogQueueLength < 0 {
+			errs = append(errs, errors.New("logQueueLength: must not be negative"))
+		}
+
+		if config.LogTimeoutMs < 0 {
+			errs = append(errs, errors.New("logTimeoutMs: must not be negative"))
+		}
+
+		if config.LogRetrySeconds < 0 {
+			errs = append(errs, errors.New("logRetrySeconds: must not be negative"))
+		}
+
+		if config.LogRetryBufferLength < 0 {
+			errs = append(errs, errors.New("logRetryBufferLength: must not be negative"))
+		}
+
+		for _, prefix := range config.UpstreamRetryPaths {
+			if !strings.HasPrefix(prefix, "/") {
+				errs = append(errs, fmt.Errorf("upstreamRetryPaths: %q must start with /", prefix))
+			}
+		}
+
+		for _, prefix := range config.MaintenancePaths {
+			if !strings.HasPrefix(prefix, "/") {
+				errs = append(errs, fmt.Errorf("maintenancePaths: %q must start with /", prefix))
+			}
+		}
+
+		for prefix, methods := range config.AllowedMethods {
+			if !strings.HasPrefix(prefix, "/") {
+				errs = append(errs, fmt.Errorf("allowedMethods: %q must start with /", prefix))
+			}
+			if len(methods) == 0 {
+				errs = append(errs, fmt.Errorf("allowedMethods: %q must allow at least one method", prefix))
+			}
+		}
+
+		if config.MaxExpirationSeconds < 0 {
+			errs = append(errs, errors.New("maxExpirationSeconds: must not be negative"))
+		}
+
+		if config.MaxExpirationAheadSeconds < 0 {
+			errs = append(errs, errors.New("maxExpirationAheadSeconds: must not be negative"))
+		}
+
+		if config.ExpirationSkewSeconds < 0 {
+			errs = append(errs, errors.New("expirationSkewSeconds: must not be negative"))
+		}
+
+		if config.MaxDelaySec != nil && *config.MaxDelaySec < 0 {
+			errs = append(errs, errors.New("maxDelaySec: must not be negative"))
+		}
+
+		if config.DedupWindowSeconds < 0 {
+			errs = append(errs, errors.New("dedupWindowSeconds: must not be negative"))
+		}
+
+		if config.DedupCacheSize < 0 {
+			errs = append(errs, errors.New("dedupCacheSize: must not be negative"))
+		}
+
+		if config.MaxAuthorizations < 0 {
+			errs = append(errs, errors.New("maxAuthorizations: must not be negative"))
+		}
+
+		if config.MaxJSONDepth < 0 {
+			errs = append(errs, errors.New("maxJSONDepth: must not be negative"))
+		}
+
+		if config.MaxJSONTokens < 0 {
+			errs = append(errs, errors.New("maxJSONTokens: must not be negative"))
+		}
+
+		if config.MaxJSONStringLength < 0 {
+			errs = append(errs, errors.New("maxJSONStringLength: must not be negative"))
+		}
+
+		for reason, code := range config.StatusCodes {
+			if code < 400 || code > 599 {
+				errs = append(errs, fmt.Errorf("statusCodes: %s must be an error status between 400 and 599", reason))
+			}
+		}
+
+		labels := map[string]bool{}
+		for _, token := range config.BypassTokens {
+			if token.Label == "" || labels[token.Label] {
+				errs = append(errs, fmt.Errorf("bypassTokens: %q must be a unique, non-empty label", token.Label))
+			}
+			labels[token.Label] = true
+
+			if len(token.Token) < minBypassTokenLength || token.Token == redactedValue {
+				errs = append(errs, fmt.Errorf("bypassTokens: the token of %q must be at least %d characters", token.Label, minBypassTokenLength))
+			}
+		}
+
+		for _, origin := range config.CORSAllowedOrigins {
+			if !validateCORSOrigin(origin) {
+				errs = append(errs, fmt.Errorf("corsAllowedOrigins: %q must be * or a scheme and host, such as https://example.com", origin))
+			}
+		}
+
+		if config.CORSMaxAge < 0 {
+			errs = append(errs, errors.New("corsMaxAge: must not be negative"))
+		}
+
+		if _, err := parseCIDRs(config.TrustedSources); err != nil {
+			errs = append(errs, fmt.Errorf("trustedSources: %s", err))
+		}
+
+		if _, err := parseCIDRs(config.TrustedProxies); err != nil {
+			errs = append(errs, fmt.Errorf("trustedProxies: %s", err))
+		}
+
+		if config.MaxActions < 0 {
+			errs = append(errs, errors.New("maxActions: must not be negative"))
+		}
+
+		if _, err := getMiddlewareChain(config.FilterEndpoints); err != nil {
+			errs = append(errs, fmt.Errorf("filterEndpoints: %s", err))
+		}
+	case "fail2ban-relay":
+		if config.LogFileLocation == "" {
+			errs = append(errs, errors.New("logFileLocation: is required"))
+		}
+
+		if config.LogMaxSizeMB < 0 {
+			errs = append(errs, errors.New("logMaxSizeMB: must not be negative"))
+		}
+
+		if config.LogMaxBackups < 0 {
+			errs = append(errs, errors.New("logMaxBackups: must not be negative"))
+		}
+
+		if config.LogMaxAgeDays < 0 {
+			errs = append(errs, errors.New("logMaxAgeDays: must not be negative"))
+		}
+	}
+
+	return errs
+}
+
+func main() {
+	parseArgs()
+	parseConfigFile()
+
+	config := getConfig()
+	if errs := validateConfig(*config, operatingMode); len(errs) > 0 {
+		fmt.Println("Invalid configuration:")
+		for _, err := range errs {
+			fmt.Printf("    %s\n", err)
+		}
+		os.Exit(1)
+	}
+
+	mux := http.NewServeMux()
+
+	if operatingMode == "filter" {
+		addFilterHandlers(mux)
+		fmt.Println("Filtering node requests...")
+	} else if operatingMode == "fail2ban-relay" {
+		addLogHandlers(mux)
+		fmt.Println("Relaying log events to fail2ban...")
+	} else {
+		fmt.Printf("This mode is not supported.")
+		os.Exit(1)
+	}
+
+	servers := getServers(config, mux)
+	if getAdminListenPort(config) == "" {
+		log.Printf("Warning: adminListenPort is not set, the admin endpoints such as /patroneos/config are disabled")
+	} else if config.AdminToken == "" {
+		log.Printf("Warning: adminToken is not set, anyone who can reach the config endpoint can read and replace the configuration")
+	}
+
+	if operatingMode == "filter" {
+		transport, err := newUpstreamTransport(config)
+		if err != nil {
+			log.Fatalf("Error configuring the nodeos client %s", err)
+		}
+
+		if config.NodeosClientCertFile != "" {
+			reloader, err := newCertificateReloader(config.NodeosClientCertFile, config.NodeosClientKeyFile)
+			if err != nil {
+				log.Fatalf("Error loading nodeosClientCertFile %s", err)
+			}
+			transport.TLSClientConfig.GetClientCertificate = reloader.GetClientCertificate
+			go reloadOnHangup(reloader)
+		}
+		client.Transport = transport
+
+		if err := checkUnixSocket(config); err != nil {
+			log.Printf("Warning: cannot connect to the nodeos socket %s, requests fail until nodeos is listening: %s", config.NodeosURL, err)
+		}
+
+		if config.NodeosTLSInsecureSkipVerify {
+			log.Printf("Warning: nodeosTLSInsecureSkipVerify is set, the certificate of nodeos is not verified")
+		}
+		go watchUpstreams()
+		if config.DNSRefreshSeconds > 0 {
+			go watchUpstreamDNS(time.Duration(config.DNSRefreshSeconds) * time.Second)
+		}
+	}
+
+	if config.WatchConfig {
+		go watchConfigFile(configWatchInterval)
+	}
+
+	if config.TLSCertFile != "" {
+		reloader, err := newCertificateReloader(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificate %s", err)
+		}
+		go reloader.watch(certificateReloadInterval)
+
+		for _, server := range servers {
+			server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		}
+	}
 
-	log.Fatal(http.ListenAndServe(appConfig.ListenIP+":"+appConfig.ListenPort, mux))
+	serve(servers)
 }
@@ -0,0 +1,797 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func getValidConfig() Config {
+	return Config{
+		ListenPort:         "8080",
+		AdminListenPort:    "9000",
+		NodeosProtocol:     "http",
+		NodeosURL:          "localhost",
+		NodeosPort:         "8888",
+		MaxSignatures:      10,
+		MaxTransactionSize: 1000000,
+		MaxTransactions:    32,
+		MaxJSONDepth:       32,
+		LogEndpoints:       []string{"http://localhost:8081"},
+		LogFileLocation:    "./fail2ban.log",
+		AuditLogLocation:   filepath.Join(os.TempDir(), "patroneos-audit-test.log"),
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := getValidConfig()
+
+	if errs := validateConfig(config, "filter"); len(errs) != 0 {
+		t.Errorf("Expected filter config to be valid and got %v.", errs)
+	}
+
+	if errs := validateConfig(config, "fail2ban-relay"); len(errs) != 0 {
+		t.Errorf("Expected relay config to be valid and got %v.", errs)
+	}
+}
+
+func TestValidateConfigInvalid(t *testing.T) {
+	config := getValidConfig()
+	config.ListenPort = "banana"
+	config.NodeosPort = "70000"
+	config.NodeosURL = ""
+	config.MaxSignatures = 0
+	config.LogEndpoints = []string{"not a url"}
+
+	errs := validateConfig(config, "filter")
+	if len(errs) != 5 {
+		t.Errorf("Expected 5 errors and got %d: %v.", len(errs), errs)
+	}
+
+	config = getValidConfig()
+	config.ListenIP = "bad host"
+	if errs := validateConfig(config, "filter"); len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "listenIP:") {
+		t.Errorf("Expected the deprecated listenIP to be validated and got %v.", errs)
+	}
+	config.ListenIP = "127.0.0.1"
+	if getListenAddress(&config) != "127.0.0.1" {
+		t.Errorf("Expected listenIP to be accepted for listenAddress and got %q.", getListenAddress(&config))
+	}
+	config.ListenAddress = "::1"
+	if getListenAddress(&config) != "::1" {
+		t.Errorf("Expected listenAddress to take precedence and got %q.", getListenAddress(&config))
+	}
+
+	config = getValidConfig()
+	config.AdminListenPort = ""
+	config.ConfigListenPort = "9001"
+	if errs := validateConfig(config, "filter"); len(errs) != 0 || getAdminListenPort(&config) != "9001" {
+		t.Errorf("Expected configListenPort to be accepted for adminListenPort and got %v.", errs)
+	}
+	config.AdminListenPort = "banana"
+	if errs := validateConfig(config, "filter"); len(errs) != 1 || getAdminListenPort(&config) != "banana" {
+		t.Errorf("Expected adminListenPort to take precedence and be validated and got %v.", errs)
+	}
+
+	for _, address := range []string{"127.0.0.1", "::1", "localhost"} {
+		config = getValidConfig()
+		config.ListenAddress = address
+		if errs := validateConfig(config, "filter"); len(errs) != 0 {
+			t.Errorf("Expected listen address %s to be valid and got %v.", address, errs)
+		}
+	}
+
+	for _, address := range []string{"[::1]", "127.0.0.1:80", "bad host"} {
+		config = getValidConfig()
+		config.ListenAddress = address
+		if errs := validateConfig(config, "filter"); len(errs) != 1 {
+			t.Errorf("Expected listen address %s to be invalid.", address)
+		}
+	}
+
+	config = getValidConfig()
+	config.NodeosURL = ""
+	config.NodeosUpstream = "https://api.example.com/nodeos"
+	if errs := validateConfig(config, "filter"); len(errs) != 0 {
+		t.Errorf("Expected nodeosUpstream to replace nodeosUrl and got %v.", errs)
+	}
+
+	for _, upstream := range []string{"ftp://api.example.com", "api.example.com:8888", "http://api.example.com:99999"} {
+		config.NodeosUpstream = upstream
+		if errs := validateConfig(config, "filter"); len(errs) != 1 {
+			t.Errorf("Expected nodeosUpstream %s to be invalid.", upstream)
+		}
+	}
+
+	config = getValidConfig()
+	config.LogFileLocation = ""
+	config.NodeosURL = ""
+
+	errs = validateConfig(config, "fail2ban-relay")
+	if len(errs) != 1 {
+		t.Errorf("Expected 1 error and got %d: %v.", len(errs), errs)
+	}
+}
+
+func TestValidateConfigFilterRules(t *testing.T) {
+	config := getValidConfig()
+	config.ContractBlackListPatterns = []string{"spam*", "/^junk[0-9]+$/"}
+	config.ActionBlackList = []string{"eosio::buyrambytes", "*::transfer"}
+	config.TrustedSources = []string{"10.0.0.0/8", "2001:db8::1"}
+	config.TrustedProxies = []string{"172.16.0.0/12"}
+	config.StatusCodes = map[string]int{"BLACKLISTED_CONTRACT": 451}
+	config.Rules = []Rule{{Actor: "badguy1", Contract: "eosio.token", Action: "transfer"}, {Actor: "badguy1", Effect: "allow"}}
+	config.BypassTokens = []BypassToken{{Label: "mobile", Token: "0123456789abcdef"}}
+	config.BlockedHeaderPatterns = map[string][]string{"User-Agent": {"^python-requests/"}}
+	if errs := validateConfig(config, "filter"); len(errs) != 0 {
+		t.Errorf("Expected filter rules to be valid and got %v.", errs)
+	}
+
+	config.ContractBlackListPatterns = []string{"/junk[/"}
+	config.ActionBlackList = []string{"eosio"}
+	config.TrustedSources = []string{"monitoring"}
+	config.TrustedProxies = []string{"172.16.0.0/33"}
+	config.StatusCodes = map[string]int{"BLACKLISTED_CONTRACT": 200}
+	config.Rules = []Rule{{Actor: "badguy1", Effect: "deny"}}
+	config.BypassTokens = []BypassToken{{Label: "mobile", Token: "short"}, {Label: "mobile", Token: "0123456789abcdef"}}
+	config.BlockedHeaderPatterns = map[string][]string{"User-Agent": {"(scraper"}}
+	config.NodeosPathPrefix = "/eos/../admin"
+	if errs := validateConfig(config, "filter"); len(errs) != 10 {
+		t.Errorf("Expected 10 errors and got %d: %v.", len(errs), errs)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"nodeosUrl":        "PATRONEOS_NODEOS_URL",
+		"listenIP":         "PATRONEOS_LISTEN_IP",
+		"configListenPort": "PATRONEOS_CONFIG_LISTEN_PORT",
+		"maxSignatures":    "PATRONEOS_MAX_SIGNATURES",
+	}
+
+	for field, expected := range tests {
+		if name := envName(field); name != expected {
+			t.Errorf("Expected %s to be %s and got %s.", field, expected, name)
+		}
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	config := getValidConfig()
+
+	os.Setenv("PATRONEOS_NODEOS_URL", "nodeos.internal")
+	os.Setenv("PATRONEOS_MAX_SIGNATURES", "3")
+	os.Setenv("PATRONEOS_LOG_ENDPOINTS", "http://relay1:8081, http://relay2:8081")
+	os.Setenv("PATRONEOS_CONTRACT_BLACK_LIST", "currency,spam")
+	os.Setenv("PATRONEOS_HEADERS", "Server=,X-Test=value")
+	os.Setenv("PATRONEOS_MAX_DELAY_SEC", "0")
+	defer func() {
+		for _, name := range []string{"PATRONEOS_NODEOS_URL", "PATRONEOS_MAX_SIGNATURES", "PATRONEOS_LOG_ENDPOINTS", "PATRONEOS_CONTRACT_BLACK_LIST", "PATRONEOS_HEADERS", "PATRONEOS_MAX_DELAY_SEC"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	if err := applyEnvOverrides(&config); err != nil {
+		t.Fatalf("There should not be an error: %s", err)
+	}
+
+	if config.NodeosURL != "nodeos.internal" || config.MaxSignatures != 3 {
+		t.Errorf("Expected scalar overrides to be applied and got %s %d.", config.NodeosURL, config.MaxSignatures)
+	}
+
+	if len(config.LogEndpoints) != 2 || config.LogEndpoints[1] != "http://relay2:8081" {
+		t.Errorf("Expected two log endpoints and got %v.", config.LogEndpoints)
+	}
+
+	if !config.ContractBlackList["currency"] || !config.ContractBlackList["spam"] {
+		t.Errorf("Expected blacklist overrides and got %v.", config.ContractBlackList)
+	}
+
+	if value, exists := config.Headers["Server"]; !exists || value != "" || config.Headers["X-Test"] != "value" {
+		t.Errorf("Expected header overrides and got %v.", config.Headers)
+	}
+
+	if config.MaxDelaySec == nil || *config.MaxDelaySec != 0 {
+		t.Errorf("Expected maxDelaySec to be set to 0 and got %v.", config.MaxDelaySec)
+	}
+
+	os.Setenv("PATRONEOS_MAX_SIGNATURES", "many")
+	if err := applyEnvOverrides(&config); err == nil {
+		t.Errorf("Expected an error for a non numeric override.")
+	}
+}
+
+func TestApplyFlagOverrides(t *testing.T) {
+	flags := flag.NewFlagSet("patroneos", flag.ContinueOnError)
+	registerConfigFlags(flags)
+	defer func() {
+		flagOverrides = map[string]string{}
+	}()
+
+	if err := flags.Parse([]string{"-nodeosUrl", "http://flag:8888", "-watchConfig", "-contractBlackList", "spam"}); err != nil {
+		t.Fatalf("There should not be an error: %s", err)
+	}
+
+	os.Setenv("PATRONEOS_NODEOS_URL", "http://env:8888")
+	os.Setenv("PATRONEOS_MAX_SIGNATURES", "3")
+	defer os.Unsetenv("PATRONEOS_NODEOS_URL")
+	defer os.Unsetenv("PATRONEOS_MAX_SIGNATURES")
+
+	// config file < environment < command-line flag
+	config := getValidConfig()
+	if err := applyEnvOverrides(&config); err != nil {
+		t.Fatalf("There should not be an error: %s", err)
+	}
+	if err := applyFlagOverrides(&config); err != nil {
+		t.Fatalf("There should not be an error: %s", err)
+	}
+
+	if config.NodeosURL != "http://flag:8888" || config.MaxSignatures != 3 || !config.WatchConfig || !config.ContractBlackList["spam"] {
+		t.Errorf("Expected the flags to override the environment and got %s %d %t %v.", config.NodeosURL, config.MaxSignatures, config.WatchConfig, config.ContractBlackList)
+	}
+
+	if err := flags.Parse([]string{"-maxSignatures", "many"}); err != nil {
+		t.Fatalf("There should not be an error: %s", err)
+	}
+	if err := applyFlagOverrides(&config); err == nil || !strings.HasPrefix(err.Error(), "-maxSignatures:") {
+		t.Errorf("Expected an error for a non numeric flag and got %v.", err)
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	config := getValidConfig()
+	config.ListenAddress = "127.0.0.1"
+	config.ContractBlackList = map[string]bool{"currency": true, "spam": false}
+	config.FilterEndpoints = []string{"validateJSON"}
+	config.Headers = map[string]string{"Server": "", "X-Test": "value"}
+
+	for _, format := range []string{"json", "yaml"} {
+		body, err := marshalConfig(config, format)
+		if err != nil {
+			t.Fatalf("There should not be an error marshalling %s: %s", format, err)
+		}
+
+		var parsed Config
+		err = unmarshalConfig(body, format, &parsed)
+		if err != nil {
+			t.Fatalf("There should not be an error unmarshalling %s: %s", format, err)
+		}
+
+		// Compare serialized forms since YAML does not distinguish nil and empty lists
+		roundTrip, err := marshalConfig(parsed, format)
+		if err != nil {
+			t.Fatalf("There should not be an error marshalling %s: %s", format, err)
+		}
+
+		if !bytes.Equal(body, roundTrip) {
+			t.Errorf("Expected %s round trip to preserve\n%s\nand got\n%s", format, body, roundTrip)
+		}
+
+		if !reflect.DeepEqual(config.ContractBlackList, parsed.ContractBlackList) || !reflect.DeepEqual(config.Headers, parsed.Headers) {
+			t.Errorf("Expected %s round trip to preserve maps and got %+v.", format, parsed)
+		}
+	}
+}
+
+func TestGetConfigFormat(t *testing.T) {
+	tests := map[string]string{
+		"./config.json":       "json",
+		"/etc/patroneos.yaml": "yaml",
+		"/etc/patroneos.YML":  "yaml",
+		"./config":            "json",
+	}
+
+	for path, expected := range tests {
+		if format := getConfigFormat(path); format != expected {
+			t.Errorf("Expected %s to be %s and got %s.", path, expected, format)
+		}
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	config := getValidConfig()
+	config.AdminToken = "secret"
+	storeConfig(config)
+
+	ts := httptest.NewServer(requireAdmin(updateConfig))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("There should not be a server error.")
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status code to be %d and got %d.", http.StatusUnauthorized, res.StatusCode)
+	}
+
+	headers := []map[string]string{
+		{"Authorization": "Bearer secret"},
+		{"X-Patroneos-Token": "secret"},
+	}
+
+	for _, header := range headers {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("There should not be a server error.")
+		}
+
+		var config Config
+		err = json.NewDecoder(res.Body).Decode(&config)
+		res.Body.Close()
+
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Errorf("Expected %v to be authorized and got %d.", header, res.StatusCode)
+		}
+
+		if config.AdminToken != redactedValue {
+			t.Errorf("Expected admin token to be redacted and got %s.", config.AdminToken)
+		}
+	}
+}
+
+func TestRequireAllowedSource(t *testing.T) {
+	config := getValidConfig()
+	config.ConfigAllowedCIDRs = []string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.10"}
+	config.TrustedProxies = []string{"172.16.0.0/12"}
+
+	tests := []struct {
+		remoteAddr    string
+		forwardedFor  string
+		trustForwards bool
+		expectedCode  int
+	}{
+		{"10.1.2.3:5000", "", false, http.StatusOK},
+		{"[2001:db8::1]:5000", "", false, http.StatusOK},
+		{"192.168.1.10:5000", "", false, http.StatusOK},
+		{"192.168.1.11:5000", "", false, http.StatusForbidden},
+		{"[2001:db9::1]:5000", "", false, http.StatusForbidden},
+		{"172.16.0.1:5000", "10.1.2.3", false, http.StatusForbidden},
+		{"172.16.0.1:5000", "10.1.2.3, 172.16.0.1", true, http.StatusOK},
+		// Entries sent by the client are ignored, and so is the header of a client that is not a proxy
+		{"172.16.0.1:5000", "10.1.2.3, 192.168.1.11", true, http.StatusForbidden},
+		{"192.168.1.11:5000", "10.1.2.3", true, http.StatusForbidden},
+	}
+
+	handler := requireAllowedSource(getTestHandler())
+
+	for _, tc := range tests {
+		config.ConfigTrustForwardedFor = tc.trustForwards
+		storeConfig(config)
+
+		req := httptest.NewRequest("GET", "/patroneos/config", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+
+		if recorder.Code != tc.expectedCode {
+			t.Errorf("Expected %s to get status code %d and got %d.", tc.remoteAddr, tc.expectedCode, recorder.Code)
+		}
+	}
+
+	config.ConfigAllowedCIDRs = nil
+	storeConfig(config)
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/patroneos/config", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected an empty list to allow all clients and got %d.", recorder.Code)
+	}
+}
+
+// setConfigFile points configFile at a temporary file containing the config.
+func setConfigFile(t *testing.T, config Config) func() {
+	file, err := ioutil.TempFile("", "patroneos-config")
+	if err != nil {
+		t.Fatalf("There should not be an error creating a config file: %s", err)
+	}
+	file.Close()
+
+	configFile = file.Name()
+	configFormat = "json"
+	operatingMode = "filter"
+	storeConfig(config)
+	fileConfig = config
+
+	body, _ := marshalConfig(config, configFormat)
+	ioutil.WriteFile(configFile, body, 0644)
+
+	return func() {
+		os.Remove(configFile)
+		os.Remove(configFile + ".bak")
+		os.Remove(getValidConfig().AuditLogLocation)
+	}
+}
+
+func readConfigFile(t *testing.T) Config {
+	var config Config
+
+	body, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		t.Fatalf("There should not be an error reading the config file: %s", err)
+	}
+
+	err = unmarshalConfig(body, configFormat, &config)
+	if err != nil {
+		t.Fatalf("There should not be an error unmarshalling the config file: %s", err)
+	}
+
+	return config
+}
+
+func TestUpdateConfigPatch(t *testing.T) {
+	config := getValidConfig()
+	config.ContractBlackList = map[string]bool{"currency": true}
+	defer setConfigFile(t, config)()
+
+	req := httptest.NewRequest("PATCH", "/patroneos/config", bytes.NewBufferString(`{"maxSignatures": 5}`))
+	updateConfig(httptest.NewRecorder(), req)
+
+	if getConfig().MaxSignatures != 5 || getConfig().NodeosURL != "localhost" {
+		t.Errorf("Expected patch to merge into the running config and got %+v.", getConfig())
+	}
+
+	saved := readConfigFile(t)
+	if saved.MaxSignatures != 5 || saved.NodeosURL != "localhost" || !saved.ContractBlackList["currency"] {
+		t.Errorf("Expected the full merged config to be persisted and got %+v.", saved)
+	}
+}
+
+func TestUpdateConfigPost(t *testing.T) {
+	defer setConfigFile(t, getValidConfig())()
+
+	config := getValidConfig()
+	config.MaxSignatures = 3
+	body, _ := json.Marshal(config)
+
+	req := httptest.NewRequest("POST", "/patroneos/config", bytes.NewBuffer(body))
+	updateConfig(httptest.NewRecorder(), req)
+
+	if saved := readConfigFile(t); saved.MaxSignatures != 3 {
+		t.Errorf("Expected the posted config to be persisted and got %+v.", saved)
+	}
+
+	// POST replaces the whole config, so a partial body fails validation
+	req = httptest.NewRequest("POST", "/patroneos/config", bytes.NewBufferString(`{"maxSignatures": 5}`))
+	updateConfig(httptest.NewRecorder(), req)
+
+	if getConfig().MaxSignatures != 3 || readConfigFile(t).MaxSignatures != 3 {
+		t.Errorf("Expected a partial POST to be rejected and got %+v.", getConfig())
+	}
+}
+
+func TestUpdateConfigInvalid(t *testing.T) {
+	defer setConfigFile(t, getValidConfig())()
+
+	tests := []struct {
+		method string
+		body   string
+	}{
+		{"POST", `{"maxSignatres": 5}`},
+		{"PATCH", `{"maxTransactions": -1, "listenPort": "banana"}`},
+		{"PATCH", `{"maxSignatures": "five"}`},
+	}
+
+	for _, tc := range tests {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, "/patroneos/config", bytes.NewBufferString(tc.body))
+		updateConfig(recorder, req)
+
+		var errorMessage ErrorMessage
+		json.Unmarshal(recorder.Body.Bytes(), &errorMessage)
+
+		if recorder.Code != http.StatusBadRequest || errorMessage.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s %s to be rejected and got %d.", tc.method, tc.body, recorder.Code)
+		}
+
+		if !strings.HasPrefix(errorMessage.Message, "INVALID_CONFIG") {
+			t.Errorf("Expected an INVALID_CONFIG message and got %s.", errorMessage.Message)
+		}
+	}
+
+	errorMessage := ErrorMessage{}
+	recorder := httptest.NewRecorder()
+	updateConfig(recorder, httptest.NewRequest("PATCH", "/patroneos/config", bytes.NewBufferString(`{"maxTransactions": -1, "listenPort": "banana"}`)))
+	json.Unmarshal(recorder.Body.Bytes(), &errorMessage)
+
+	if !strings.Contains(errorMessage.Message, "maxTransactions") || !strings.Contains(errorMessage.Message, "listenPort") {
+		t.Errorf("Expected the message to name every invalid field and got %s.", errorMessage.Message)
+	}
+
+	if !reflect.DeepEqual(*getConfig(), getValidConfig()) || !reflect.DeepEqual(readConfigFile(t), getValidConfig()) {
+		t.Errorf("Expected the running config and the file to be untouched.")
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	var config Config
+	applyDefaults(&config)
+
+	if config.ListenPort != defaultListenPort || config.NodeosProtocol != defaultNodeosProtocol || config.NodeosPort != defaultNodeosPort {
+		t.Errorf("Expected connection defaults and got %+v.", config)
+	}
+
+	if config.MaxSignatures != defaultMaxSignatures || config.MaxTransactionSize != defaultMaxTransactionSize || config.MaxJSONDepth != defaultMaxJSONDepth {
+		t.Errorf("Expected limit defaults and got %+v.", config)
+	}
+
+	if config.MaxTransactions != 0 {
+		t.Errorf("Expected maxTransactions to stay unlimited and got %d.", config.MaxTransactions)
+	}
+
+	config = getValidConfig()
+	applyDefaults(&config)
+
+	if !reflect.DeepEqual(config, getValidConfig()) {
+		t.Errorf("Expected configured values to be kept and got %+v.", config)
+	}
+}
+
+func TestUpdateConfigStatusCodes(t *testing.T) {
+	defer setConfigFile(t, getValidConfig())()
+
+	recorder := httptest.NewRecorder()
+	updateConfig(recorder, httptest.NewRequest("PATCH", "/patroneos/config", bytes.NewBufferString(`{"maxSignatures": 4}`)))
+
+	var echoed Config
+	json.Unmarshal(recorder.Body.Bytes(), &echoed)
+
+	if recorder.Code != http.StatusOK || echoed.MaxSignatures != 4 {
+		t.Errorf("Expected the applied config to be echoed with a 200 and got %d %+v.", recorder.Code, echoed)
+	}
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		recorder = httptest.NewRecorder()
+		updateConfig(recorder, httptest.NewRequest(method, "/patroneos/config", nil))
+
+		if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") == "" {
+			t.Errorf("Expected %s to return 405 with an Allow header and got %d.", method, recorder.Code)
+		}
+	}
+
+	originalFile := configFile
+	configFile = "/nonexistent/patroneos/config.json"
+	defer func() { configFile = originalFile }()
+
+	recorder = httptest.NewRecorder()
+	updateConfig(recorder, httptest.NewRequest("PATCH", "/patroneos/config", bytes.NewBufferString(`{"maxSignatures": 6}`)))
+
+	if recorder.Code != http.StatusInternalServerError || getConfig().MaxSignatures != 4 {
+		t.Errorf("Expected a failed write to return 500 and keep the config and got %d %+v.", recorder.Code, getConfig())
+	}
+}
+
+func TestConfigUpdateConcurrentRequests(t *testing.T) {
+	defer setConfigFile(t, getValidConfig())()
+
+	ts := httptest.NewServer(validateContract(validateMaxSignatures(getTestHandler())))
+	defer ts.Close()
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			res, err := http.Post(ts.URL, "application/json", bytes.NewBufferString(`{"actions": [{"code": "currency"}], "signatures": ["1"]}`))
+			if err == nil {
+				res.Body.Close()
+			}
+		}
+		done <- true
+	}()
+
+	for i := 0; i < 20; i++ {
+		body := `{"contractBlackList": {"currency": true, "spam": true}}`
+		updateConfig(httptest.NewRecorder(), httptest.NewRequest("PATCH", "/patroneos/config", bytes.NewBufferString(body)))
+	}
+	<-done
+}
+
+func TestRequireConfigEnabled(t *testing.T) {
+	tests := []struct {
+		disabled     bool
+		readOnly     bool
+		method       string
+		expectedCode int
+	}{
+		{true, false, "GET", http.StatusNotFound},
+		{true, false, "POST", http.StatusNotFound},
+		{false, true, "GET", http.StatusOK},
+		{false, true, "POST", http.StatusForbidden},
+		{false, true, "PATCH", http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		config := getValidConfig()
+		config.DisableConfigEndpoint = tc.disabled
+		config.ConfigReadOnly = tc.readOnly
+		cleanup := setConfigFile(t, config)
+
+		mux := http.NewServeMux()
+		addAdminHandlers(mux)
+
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(tc.method, "/patroneos/config", bytes.NewBufferString(`{"maxSignatures": 1}`)))
+
+		if recorder.Code != tc.expectedCode {
+			t.Errorf("Expected %s with disabled %t and read only %t to return %d and got %d.", tc.method, tc.disabled, tc.readOnly, tc.expectedCode, recorder.Code)
+		}
+
+		if getConfig().MaxSignatures != config.MaxSignatures || readConfigFile(t).MaxSignatures != config.MaxSignatures {
+			t.Errorf("Expected %s with disabled %t and read only %t to leave the config untouched.", tc.method, tc.disabled, tc.readOnly)
+		}
+
+		cleanup()
+	}
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	defer setConfigFile(t, getValidConfig())()
+
+	if code := validateConfigFile(false); code != 0 {
+		t.Errorf("Expected a valid config file to exit with 0 and got %d.", code)
+	}
+
+	ioutil.WriteFile(configFile, []byte(`{"listenPort": "banana"}`), 0644)
+	if code := validateConfigFile(false); code != 1 {
+		t.Errorf("Expected an invalid config file to exit with 1 and got %d.", code)
+	}
+
+	ioutil.WriteFile(configFile, []byte(`{"listenPort": `), 0644)
+	if code := validateConfigFile(false); code != 1 {
+		t.Errorf("Expected an unparseable config file to exit with 1 and got %d.", code)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "patroneos-write")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(path, []byte("original"), 0600)
+
+	err := writeFileAtomic(path, []byte("updated"))
+	if err != nil {
+		t.Fatalf("There should not be an error writing the file: %s", err)
+	}
+
+	body, _ := ioutil.ReadFile(path)
+	backup, _ := ioutil.ReadFile(path + ".bak")
+	info, _ := os.Stat(path)
+
+	if string(body) != "updated" || string(backup) != "original" {
+		t.Errorf("Expected the file to be replaced and backed up and got %s and %s.", body, backup)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the file permissions to be preserved and got %s.", info.Mode())
+	}
+
+	// Simulate a full disk part way through the write
+	originalWrite := writeTempFile
+	writeTempFile = func(file *os.File, body []byte) error {
+		file.Write(body[:len(body)/2])
+		return errors.New("no space left on device")
+	}
+	defer func() { writeTempFile = originalWrite }()
+
+	err = writeFileAtomic(path, []byte("truncated"))
+	if err == nil {
+		t.Errorf("Expected the simulated write failure to be returned.")
+	}
+
+	body, _ = ioutil.ReadFile(path)
+	files, _ := ioutil.ReadDir(dir)
+
+	if string(body) != "updated" || len(files) != 2 {
+		t.Errorf("Expected the original file to be untouched and no temporary file left and got %s and %d files.", body, len(files))
+	}
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	defer setConfigFile(t, getValidConfig())()
+
+	reloaded, err := reloadConfigFile()
+	if reloaded || err != nil {
+		t.Errorf("Expected an unchanged file not to be reloaded and got %t %v.", reloaded, err)
+	}
+
+	config := getValidConfig()
+	config.MaxSignatures = 2
+	body, _ := marshalConfig(config, configFormat)
+	ioutil.WriteFile(configFile+".new", body, 0644)
+	os.Rename(configFile+".new", configFile)
+
+	reloaded, err = reloadConfigFile()
+	if !reloaded || err != nil || getConfig().MaxSignatures != 2 {
+		t.Errorf("Expected the replaced file to be reloaded and got %t %v %d.", reloaded, err, getConfig().MaxSignatures)
+	}
+
+	ioutil.WriteFile(configFile, []byte(`{"listenPort": "banana"}`), 0644)
+
+	reloaded, err = reloadConfigFile()
+	if reloaded || err == nil || getConfig().MaxSignatures != 2 {
+		t.Errorf("Expected an invalid file to be rejected and the config kept and got %t %v %d.", reloaded, err, getConfig().MaxSignatures)
+	}
+}
+
+func TestRedactBypassTokens(t *testing.T) {
+	config := getValidConfig()
+	config.BypassTokens = []BypassToken{{Label: "mobile", Token: "0123456789abcdef"}}
+
+	redacted := redactConfig(config)
+	if redacted.BypassTokens[0].Token != redactedValue || redacted.BypassTokens[0].Label != "mobile" {
+		t.Errorf("Expected the bypass token to be redacted and got %+v.", redacted.BypassTokens)
+	}
+	if config.BypassTokens[0].Token != "0123456789abcdef" {
+		t.Errorf("Expected redacting not to change the running config.")
+	}
+
+	restoreRedacted(&redacted, config)
+	if redacted.BypassTokens[0].Token != "0123456789abcdef" {
+		t.Errorf("Expected the redacted token to be restored and got %s.", redacted.BypassTokens[0].Token)
+	}
+}
+
+func TestRedactNodeosBasicAuthPassword(t *testing.T) {
+	config := getValidConfig()
+	config.NodeosBasicAuthUser = "patroneos"
+	config.NodeosBasicAuthPassword = "secret"
+
+	redacted := redactConfig(config)
+	if redacted.NodeosBasicAuthPassword != redactedValue || redacted.NodeosBasicAuthUser != "patroneos" {
+		t.Errorf("Expected the nodeos password to be redacted and got %s.", redacted.NodeosBasicAuthPassword)
+	}
+
+	restoreRedacted(&redacted, config)
+	if redacted.NodeosBasicAuthPassword != "secret" {
+		t.Errorf("Expected the redacted password to be restored and got %s.", redacted.NodeosBasicAuthPassword)
+	}
+
+	config.NodeosBasicAuthUser = ""
+	if errs := validateConfig(config, "filter"); len(errs) != 1 {
+		t.Errorf("Expected a password without a user to be rejected and got %v.", errs)
+	}
+}
+
+func TestGetServers(t *testing.T) {
+	config := getValidConfig()
+	config.AdminListenPort = ""
+	config.ConfigListenPort = ""
+
+	// Without an admin port the admin endpoints are not served at all
+	mux := http.NewServeMux()
+	servers := getServers(&config, mux)
+	if len(servers) != 1 || servers[0].Handler != mux {
+		t.Fatalf("Expected only the public server and got %d servers.", len(servers))
+	}
+	if _, pattern := mux.Handler(httptest.NewRequest("GET", "/patroneos/config", nil)); pattern != "" {
+		t.Errorf("Expected the config endpoint not to be on the public listener and got %q.", pattern)
+	}
+
+	config.ConfigListenPort = "9001"
+	servers = getServers(&config, http.NewServeMux())
+	if len(servers) != 2 || !strings.HasSuffix(servers[1].Addr, ":9001") {
+		t.Fatalf("Expected an admin server on configListenPort and got %d servers.", len(servers))
+	}
+	if _, pattern := servers[1].Handler.(*http.ServeMux).Handler(httptest.NewRequest("GET", "/patroneos/config", nil)); pattern != "/patroneos/config" {
+		t.Errorf("Expected the config endpoint on the admin listener and got %q.", pattern)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// maxPackedTransactionSize bounds a decompressed packed_trx. It matches the default
+// max_transaction_net_usage of nodeos, so larger transactions could not be accepted anyway.
+const maxPackedTransactionSize = 512 * 1024
+
+// expirationFormat is the layout nodeos uses for transaction expirations.
+const expirationFormat = "2006-01-02T15:04:05"
+
+// nameCharacters maps the 5 bit symbols of an EOSIO name to characters.
+const nameCharacters = ".12345abcdefghijklmnopqrstuvwxyz"
+
+var (
+	errInvalidPackedTransaction = errors.New("INVALID_PACKED_TRX")
+	errCompressionNotAllowed    = errors.New("COMPRESSION_NOT_ALLOWED")
+)
+
+// packedReader reads values in the EOSIO binary serialization format.
+type packedReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+// read returns the next size bytes, or nil once the data runs out.
+func (reader *packedReader) read(size int) []byte {
+	if reader.err != nil {
+		return nil
+	}
+	if size < 0 || size > len(reader.data)-reader.offset {
+		reader.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	value := reader.data[reader.offset : reader.offset+size]
+	reader.offset += size
+	return value
+}
+
+func (reader *packedReader) readUint8() uint8 {
+	if value := reader.read(1); value != nil {
+		return value[0]
+	}
+	return 0
+}
+
+func (reader *packedReader) readUint16() uint16 {
+	if value := reader.read(2); value != nil {
+		return binary.LittleEndian.Uint16(value)
+	}
+	return 0
+}
+
+func (reader *packedReader) readUint32() uint32 {
+	if value := reader.read(4); value != nil {
+		return binary.LittleEndian.Uint32(value)
+	}
+	return 0
+}
+
+func (reader *packedReader) readUint64() uint64 {
+	if value := reader.read(8); value != nil {
+		return binary.LittleEndian.Uint64(value)
+	}
+	return 0
+}
+
+// readVarUint32 reads a LEB128 encoded unsigned integer.
+func (reader *packedReader) readVarUint32() uint32 {
+	var value uint32
+	for shift := uint(0); shift < 35; shift += 7 {
+		b := reader.readUint8()
+		if reader.err != nil {
+			return 0
+		}
+
+		value |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value
+		}
+	}
+
+	reader.err = errors.New("varuint32 is too long")
+	return 0
+}
+
+// readName reads a 64 bit EOSIO name and returns its string form.
+func (reader *packedReader) readName() string {
+	value := reader.readUint64()
+	if reader.err != nil {
+		return ""
+	}
+
+	return nameToString(value)
+}
+
+// readBytes reads a length prefixed byte array.
+func (reader *packedReader) readBytes() []byte {
+	return reader.read(int(reader.readVarUint32()))
+}
+
+// readCount reads a vector length, rejecting lengths that cannot fit in the remaining data.
+func (reader *packedReader) readCount() int {
+	count := int(reader.readVarUint32())
+	if reader.err == nil && count > len(reader.data)-reader.offset {
+		reader.err = io.ErrUnexpectedEOF
+		return 0
+	}
+
+	return count
+}
+
+// readActions reads a vector of actions.
+func (reader *packedReader) readActions() []Action {
+	count := reader.readCount()
+
+	actions := make([]Action, 0, count)
+	for i := 0; i < count && reader.err == nil; i++ {
+		action := Action{
+			Code: reader.readName(),
+			Type: reader.readName(),
+		}
+
+		authorizations := reader.readCount()
+		for j := 0; j < authorizations && reader.err == nil; j++ {
+			action.Authorization = append(action.Authorization, Authorization{
+				Actor:      reader.readName(),
+				Permission: reader.readName(),
+			})
+		}
+
+		action.Data = hex.EncodeToString(reader.readBytes())
+		actions = append(actions, action)
+	}
+
+	return actions
+}
+
+// nameToString converts a 64 bit EOSIO name to its string form.
+func nameToString(value uint64) string {
+	name := make([]byte, 13)
+
+	// The last character only has 4 bits, the others have 5
+	name[12] = nameCharacters[value&0x0f]
+	value >>= 4
+	for i := 11; i >= 0; i-- {
+		name[i] = nameCharacters[value&0x1f]
+		value >>= 5
+	}
+
+	return string(bytes.TrimRight(name, "."))
+}
+
+// unpackTransaction decodes packed_trx into the transaction header and actions so
+// the middleware can inspect them. Transactions without packed_trx are left untouched.
+func unpackTransaction(transaction *Transaction) error {
+	if transaction.PackedTrx == "" {
+		return nil
+	}
+
+	packed, err := hex.DecodeString(transaction.PackedTrx)
+	if err != nil {
+		return errInvalidPackedTransaction
+	}
+
+	switch transaction.Compression {
+	case "", "none":
+	case "zlib":
+		if !getConfig().AllowCompressedTransactions {
+			return errCompressionNotAllowed
+		}
+
+		packed, err = decompressTransaction(packed)
+		if err != nil {
+			return errInvalidPackedTransaction
+		}
+	default:
+		return errInvalidPackedTransaction
+	}
+
+	reader := &packedReader{data: packed}
+
+	expiration := reader.readUint32()
+	transaction.Expiration = time.Unix(int64(expiration), 0).UTC().Format(expirationFormat)
+	transaction.RefBlockNum = reader.readUint16()
+	transaction.RefBlockPrefix = reader.readUint32()
+	transaction.MaxNetUsageWords = reader.readVarUint32()
+	transaction.MaxCPUUsageMs = reader.readUint8()
+	transaction.DelaySec = jsonUint32(reader.readVarUint32())
+
+	transaction.ContextFreeActions = reader.readActions()
+	transaction.Actions = reader.readActions()
+
+	// Transaction extensions are pairs of a uint16 type and a byte array
+	extensions := reader.readCount()
+	transaction.TransactionExtensions = nil
+	for i := 0; i < extensions && reader.err == nil; i++ {
+		extension, _ := json.Marshal([]interface{}{reader.readUint16(), hex.EncodeToString(reader.readBytes())})
+		transaction.TransactionExtensions = append(transaction.TransactionExtensions, extension)
+	}
+
+	if reader.err != nil {
+		return errInvalidPackedTransaction
+	}
+
+	return nil
+}
+
+// decompressTransaction inflates a zlib compressed packed_trx, up to maxPackedTransactionSize.
+func decompressTransaction(packed []byte) ([]byte, error) {
+	inflater, err := zlib.NewReader(bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	defer inflater.Close()
+
+	unpacked, err := ioutil.ReadAll(io.LimitReader(inflater, maxPackedTransactionSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(unpacked) > maxPackedTransactionSize {
+		return nil, errors.New("packed transaction is too large")
+	}
+
+	return unpacked, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// stringToName converts an EOSIO name to its 64 bit form.
+func stringToName(name string) uint64 {
+	var value uint64
+	for i := 0; i <= 12; i++ {
+		var symbol uint64
+		if i < len(name) {
+			symbol = uint64(bytes.IndexByte([]byte(nameCharacters), name[i]))
+		}
+
+		if i < 12 {
+			value |= (symbol & 0x1f) << uint(64-5*(i+1))
+		} else {
+			value |= symbol & 0x0f
+		}
+	}
+
+	return value
+}
+
+type packedWriter struct {
+	bytes.Buffer
+}
+
+func (writer *packedWriter) writeVarUint32(value uint32) {
+	for value >= 0x80 {
+		writer.WriteByte(byte(value) | 0x80)
+		value >>= 7
+	}
+	writer.WriteByte(byte(value))
+}
+
+func (writer *packedWriter) writeName(name string) {
+	binary.Write(writer, binary.LittleEndian, stringToName(name))
+}
+
+func (writer *packedWriter) writeActions(actions []Action) {
+	writer.writeVarUint32(uint32(len(actions)))
+	for _, action := range actions {
+		writer.writeName(action.Code)
+		writer.writeName(action.Type)
+		writer.writeVarUint32(uint32(len(action.Authorization)))
+		for _, authorization := range action.Authorization {
+			writer.writeName(authorization.Actor)
+			writer.writeName(authorization.Permission)
+		}
+		data, _ := hex.DecodeString(action.Data)
+		writer.writeVarUint32(uint32(len(data)))
+		writer.Write(data)
+	}
+}
+
+// packTransaction serializes the header and actions of a transaction.
+func packTransaction(transaction Transaction) []byte {
+	writer := &packedWriter{}
+	binary.Write(writer, binary.LittleEndian, uint32(1530000000))
+	binary.Write(writer, binary.LittleEndian, transaction.RefBlockNum)
+	binary.Write(writer, binary.LittleEndian, transaction.RefBlockPrefix)
+	writer.writeVarUint32(transaction.MaxNetUsageWords)
+	writer.WriteByte(transaction.MaxCPUUsageMs)
+	writer.writeVarUint32(uint32(transaction.DelaySec))
+	writer.writeActions(transaction.ContextFreeActions)
+	writer.writeActions(transaction.Actions)
+	writer.writeVarUint32(0)
+
+	return writer.Bytes()
+}
+
+func getPackedTransaction() Transaction {
+	return Transaction{
+		RefBlockNum:      42,
+		RefBlockPrefix:   123456,
+		MaxNetUsageWords: 300,
+		DelaySec:         0,
+		Actions: []Action{
+			{
+				Code:          "eosio.token",
+				Type:          "transfer",
+				Authorization: []Authorization{{Actor: "alice", Permission: "active"}},
+				Data:          "0000000000855c34",
+			},
+		},
+	}
+}
+
+func TestNameToString(t *testing.T) {
+	if name := nameToString(6138663577826885632); name != "eosio" {
+		t.Errorf("Expected name to be eosio and got %s.", name)
+	}
+
+	for _, name := range []string{"eosio", "eosio.token", "a", "12345abcdefgj", "alice"} {
+		if converted := nameToString(stringToName(name)); converted != name {
+			t.Errorf("Expected name to be %s and got %s.", name, converted)
+		}
+	}
+}
+
+func TestUnpackTransaction(t *testing.T) {
+	expected := getPackedTransaction()
+	transaction := Transaction{
+		Signatures:  []string{"SIG_K1_test"},
+		Compression: "none",
+		PackedTrx:   hex.EncodeToString(packTransaction(expected)),
+	}
+
+	err := unpackTransaction(&transaction)
+	if err != nil {
+		t.Fatalf("Expected packed transaction to decode and got %s.", err)
+	}
+
+	if transaction.Expiration != "2018-06-26T08:00:00" {
+		t.Errorf("Expected expiration to be 2018-06-26T08:00:00 and got %s.", transaction.Expiration)
+	}
+	if transaction.RefBlockNum != 42 || transaction.RefBlockPrefix != 123456 || transaction.MaxNetUsageWords != 300 {
+		t.Errorf("Expected header to be decoded and got %+v.", transaction)
+	}
+	if len(transaction.Actions) != 1 {
+		t.Fatalf("Expected 1 action and got %d.", len(transaction.Actions))
+	}
+
+	action := transaction.Actions[0]
+	if action.Code != "eosio.token" || action.Type != "transfer" || action.Data != "0000000000855c34" {
+		t.Errorf("Expected action to be decoded and got %+v.", action)
+	}
+	if len(action.Authorization) != 1 || action.Authorization[0] != (Authorization{Actor: "alice", Permission: "active"}) {
+		t.Errorf("Expected authorization to be decoded and got %+v.", action.Authorization)
+	}
+
+	// Truncated data is rejected
+	truncated := Transaction{PackedTrx: transaction.PackedTrx[:40]}
+	if err := unpackTransaction(&truncated); err != errInvalidPackedTransaction {
+		t.Errorf("Expected a truncated transaction to be rejected and got %v.", err)
+	}
+}
+
+func TestUnpackCompressedTransaction(t *testing.T) {
+	var compressed bytes.Buffer
+	deflater := zlib.NewWriter(&compressed)
+	deflater.Write(packTransaction(getPackedTransaction()))
+	deflater.Close()
+
+	setConfig()
+
+	transaction := Transaction{Compression: "zlib", PackedTrx: hex.EncodeToString(compressed.Bytes())}
+	if err := unpackTransaction(&transaction); err != errCompressionNotAllowed {
+		t.Errorf("Expected compressed transactions to be rejected by default and got %v.", err)
+	}
+
+	config := *getConfig()
+	config.AllowCompressedTransactions = true
+	storeConfig(config)
+
+	if err := unpackTransaction(&transaction); err != nil {
+		t.Fatalf("Expected compressed transaction to decode and got %s.", err)
+	}
+	if len(transaction.Actions) != 1 || transaction.Actions[0].Code != "eosio.token" {
+		t.Errorf("Expected action to be decoded and got %+v.", transaction.Actions)
+	}
+}
+
+func TestValidateContractPacked(t *testing.T) {
+	blacklisted := getPackedTransaction()
+	blacklisted.Actions[0].Code = "currency"
+
+	invalidBody, _ := json.Marshal(map[string]interface{}{
+		"signatures":               []string{"SIG_K1_test"},
+		"compression":              "none",
+		"packed_context_free_data": "",
+		"packed_trx":               hex.EncodeToString(packTransaction(blacklisted)),
+	})
+	validBody, _ := json.Marshal(map[string]interface{}{
+		"signatures":               []string{"SIG_K1_test"},
+		"compression":              "none",
+		"packed_context_free_data": "",
+		"packed_trx":               hex.EncodeToString(packTransaction(getPackedTransaction())),
+	})
+
+	tests := []TestStruct{
+		{
+			description:  "blacklisted packed",
+			url:          "/v1/chain/push_transaction",
+			body:         invalidBody,
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "valid packed",
+			url:          "/v1/chain/push_transaction",
+			body:         validBody,
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "invalid hex",
+			url:          "/v1/chain/push_transaction",
+			body:         []byte(`{"packed_trx": "zz"}`),
+			expectedBody: "{\"message\":\"INVALID_PACKED_TRX\",\"code\":400}",
+			expectedCode: 400,
+		},
+	}
+
+	ts := httptest.NewServer(validateContract(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// actorRateWindow is the sliding window of maxTransactionsPerActor.
+const actorRateWindow = time.Minute
+
+// rateLimiter counts events per key in a sliding window.
+type rateLimiter struct {
+	lock      sync.Mutex
+	events    map[string][]time.Time
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{events: make(map[string][]time.Time)}
+}
+
+// allow reports whether another event for the key fits in the limit for the window, and records it if so.
+func (limiter *rateLimiter) allow(key string, limit int, window time.Duration, now time.Time) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	// Forget keys without recent events once per window so the map does not grow without bound
+	if now.Sub(limiter.lastSweep) >= window {
+		for other, events := range limiter.events {
+			if len(events) == 0 || now.Sub(events[len(events)-1]) >= window {
+				delete(limiter.events, other)
+			}
+		}
+		limiter.lastSweep = now
+	}
+
+	events := limiter.events[key]
+	expired := 0
+	for expired < len(events) && now.Sub(events[expired]) >= window {
+		expired++
+	}
+	events = events[expired:]
+
+	if len(events) >= limit {
+		limiter.events[key] = events
+		return false
+	}
+
+	limiter.events[key] = append(events, now)
+	return true
+}
+
+// actorLimiter holds the transactions counted by validateActorRate.
+var actorLimiter = newRateLimiter()
+
+// getFirstActor returns the first account authorizing the transaction, or an empty string.
+// Transaction level authorizations of the legacy schema come before those of the actions.
+func getFirstActor(transaction Transaction) string {
+	if len(transaction.Authorizations) > 0 {
+		return transaction.Authorizations[0].Actor
+	}
+
+	for _, action := range transaction.getActions() {
+		if len(action.Authorization) > 0 {
+			return action.Authorization[0].Actor
+		}
+	}
+
+	return ""
+}
+
+// validateActorRate limits the transactions sent to the push endpoints by each account to
+// maxTransactionsPerActor per minute, using the first authorization of every transaction.
+// It is skipped if maxTransactionsPerActor is not configured, or set to 0.
+func validateActorRate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		config := getConfig()
+		if config.MaxTransactionsPerActor <= 0 || !isPushEndpoint(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		transactions, ctx, err := getTransactions(r)
+		if err != nil {
+			logError(err, w, r)
+			return
+		}
+
+		now := time.Now()
+		for i, transaction := range transactions {
+			actor := getFirstActor(transaction)
+			if actor == "" {
+				continue
+			}
+
+			if !actorLimiter.allow(actor, config.MaxTransactionsPerActor, actorRateWindow, now) {
+				logFailureDetails(ErrorMessage{
+					Message:        batchMessage(r, "ACTOR_RATE_LIMIT:"+actor, i),
+					Detail:         fmt.Sprintf("%s sent more than %d transactions in the last minute", actor, config.MaxTransactionsPerActor),
+					Limit:          intPointer(config.MaxTransactionsPerActor),
+					OffendingIndex: intPointer(i),
+				}, w, r, 0)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
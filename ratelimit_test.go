@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := newRateLimiter()
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("spammer", 3, time.Minute, start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("Expected event %d to be allowed.", i)
+		}
+	}
+	if limiter.allow("spammer", 3, time.Minute, start.Add(10*time.Second)) {
+		t.Errorf("Expected the 4th event within a minute to be rejected.")
+	}
+	if !limiter.allow("alice", 3, time.Minute, start.Add(10*time.Second)) {
+		t.Errorf("Expected other keys to have their own limit.")
+	}
+
+	// The window slides: the first event expires one minute after it was recorded
+	if !limiter.allow("spammer", 3, time.Minute, start.Add(time.Minute)) {
+		t.Errorf("Expected an event to be allowed once the oldest one expired.")
+	}
+	if limiter.allow("spammer", 3, time.Minute, start.Add(time.Minute)) {
+		t.Errorf("Expected the window to be full again.")
+	}
+
+	// Idle keys are swept
+	limiter.allow("bob", 3, time.Minute, start.Add(5*time.Minute))
+	if _, exists := limiter.events["alice"]; exists {
+		t.Errorf("Expected idle keys to be removed.")
+	}
+}
+
+func TestGetFirstActor(t *testing.T) {
+	modern := Transaction{Actions: []Action{{Code: "tokens"}, {Code: "tokens", Authorization: []Authorization{{Actor: "alice", Permission: "active"}}}}}
+	if actor := getFirstActor(modern); actor != "alice" {
+		t.Errorf("Expected alice and got %q.", actor)
+	}
+
+	legacy := modern
+	legacy.Authorizations = []Authorization{{Actor: "bob", Permission: "active"}}
+	if actor := getFirstActor(legacy); actor != "bob" {
+		t.Errorf("Expected bob and got %q.", actor)
+	}
+
+	if actor := getFirstActor(Transaction{}); actor != "" {
+		t.Errorf("Expected no actor and got %q.", actor)
+	}
+}
+
+func TestValidateActorRate(t *testing.T) {
+	body := []byte(`{"actions": [{"account": "tokens", "name": "transfer", "authorization": [{"actor": "spammer1", "permission": "active"}]}]}`)
+	legacyBody := []byte(`{"authorizations": [["spammer1", "active"]], "actions": [{"code": "tokens", "type": "transfer"}]}`)
+
+	allowed := TestStruct{
+		description:  "within the limit",
+		url:          "/v1/chain/push_transaction",
+		body:         body,
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	}
+
+	ts := httptest.NewServer(validateActorRate(getTestHandler()))
+	defer ts.Close()
+
+	actorLimiter = newRateLimiter()
+	setConfig()
+
+	// Disabled by default
+	for i := 0; i < 3; i++ {
+		verifyMiddleware(t, ts, allowed)
+	}
+
+	config := *getConfig()
+	config.MaxTransactionsPerActor = 2
+	storeConfig(config)
+
+	verifyMiddleware(t, ts, allowed)
+	verifyMiddleware(t, ts, allowed)
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "over the limit with the legacy schema",
+		url:          "/v1/chain/push_transaction",
+		body:         legacyBody,
+		expectedBody: "{\"message\":\"ACTOR_RATE_LIMIT:spammer1\",\"code\":429}",
+		expectedCode: 429,
+	})
+	verifyMiddleware(t, ts, TestStruct{
+		description:  "not a push endpoint",
+		url:          "/v1/chain/get_info",
+		body:         body,
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+
+	actorLimiter = newRateLimiter()
+	setConfig()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// requestIDHeader carries the request ID from the client, to nodeos and back.
+const requestIDHeader = "X-Request-ID"
+
+var (
+	requestIDKey = contextKey("requestID")
+
+	// requestIDPattern is what an X-Request-ID sent by a client must look like to be kept,
+	// so it cannot be used to forge log lines.
+	requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+)
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// getRequestID returns the ID assigned to the request by assignRequestID, or "" if it has none.
+func getRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// requestIDSuffix returns the request ID to append to a log line.
+func requestIDSuffix(r *http.Request) string {
+	if id := getRequestID(r); id != "" {
+		return " requestId=" + id
+	}
+
+	return ""
+}
+
+// assignRequestID gives every request an ID, so a rejection, the patroneos and fail2ban logs and the
+// nodeos logs can be matched up. The X-Request-ID sent by the client is kept, otherwise a UUID is generated.
+// The ID is returned to the client in the X-Request-ID header.
+func assignRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestID(t *testing.T) {
+	var events []Log
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Log
+		json.NewDecoder(r.Body).Decode(&event)
+		events = append(events, event)
+	}))
+	defer relay.Close()
+
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(requestIDHeader)
+		w.Header().Set(requestIDHeader, "set-by-nodeos")
+	}))
+	defer upstream.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.NodeosUpstream = upstream.URL
+	config.LogEndpoints = []string{relay.URL}
+	storeConfig(config)
+	defer setConfig()
+
+	mux := http.NewServeMux()
+	addFilterHandlers(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// The ID sent by the client is forwarded to nodeos, returned and logged
+	request, _ := http.NewRequest("GET", ts.URL+"/v1/chain/get_info", nil)
+	request.Header.Set(requestIDHeader, "client-42")
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if id := res.Header.Get(requestIDHeader); id != "client-42" || len(res.Header.Values(requestIDHeader)) != 1 {
+		t.Errorf("Expected the client request ID to be returned once and got %v.", res.Header.Values(requestIDHeader))
+	}
+	if forwarded != "client-42" {
+		t.Errorf("Expected the request ID to be forwarded to nodeos and got %q.", forwarded)
+	}
+	logEvents.flush(time.Second)
+	if len(events) != 1 || events[0].RequestID != "client-42" {
+		t.Errorf("Expected the log event to carry the request ID and got %+v.", events)
+	}
+
+	// Rejections get a generated ID, in the header, the body and the log event
+	events = nil
+	request, _ = http.NewRequest("POST", ts.URL+"/v1/chain/push_transaction", bytes.NewBufferString("{"))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(requestIDHeader, "forged Failure: 10.0.0.1")
+	res, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	var failure ErrorMessage
+	json.Unmarshal(body, &failure)
+
+	id := res.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) || len(id) != 36 {
+		t.Fatalf("Expected a UUID to replace the invalid request ID and got %q.", id)
+	}
+	if failure.RequestID != id {
+		t.Errorf("Expected the error to carry the request ID %s and got %s.", id, body)
+	}
+	logEvents.flush(time.Second)
+	if len(events) != 1 || events[0].RequestID != id || events[0].Success {
+		t.Errorf("Expected the failure event to carry the request ID %s and got %+v.", id, events)
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	first, second := newRequestID(), newRequestID()
+	if first == second {
+		t.Errorf("Expected request IDs to be unique and got %s twice.", first)
+	}
+	if len(first) != 36 || first[14] != '4' {
+		t.Errorf("Expected a version 4 UUID and got %s.", first)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Rule effects, an empty effect rejects.
+const (
+	ruleEffectReject = "reject"
+	ruleEffectAllow  = "allow"
+)
+
+// ruleWildcard matches any actor, contract or action.
+const ruleWildcard = "*"
+
+// Rule matches actions by the accounts authorizing them, their contract and their name.
+// Empty fields match anything, like *.
+type Rule struct {
+	Actor    string `json:"actor" yaml:"actor"`
+	Contract string `json:"contract" yaml:"contract"`
+	Action   string `json:"action" yaml:"action"`
+	Effect   string `json:"effect" yaml:"effect"`
+
+	// message replaces BLACKLISTED_RULE for the rules translated from a blacklist
+	message string
+}
+
+// String returns the rule in the form actor@contract::action, with * for empty fields.
+func (rule Rule) String() string {
+	return fmt.Sprintf("%s@%s::%s", ruleField(rule.Actor), ruleField(rule.Contract), ruleField(rule.Action))
+}
+
+func ruleField(field string) string {
+	if field == "" {
+		return ruleWildcard
+	}
+
+	return field
+}
+
+// matchesField reports whether the rule field matches the value.
+func matchesField(field string, value string) bool {
+	return field == "" || field == ruleWildcard || field == value
+}
+
+// matches reports whether the rule matches the action authorized by the actors.
+func (rule Rule) matches(action Action, actors []string) bool {
+	if !matchesField(rule.Contract, action.Code) || !matchesField(rule.Action, action.Type) {
+		return false
+	}
+
+	if rule.Actor == "" || rule.Actor == ruleWildcard {
+		return true
+	}
+	for _, actor := range actors {
+		if actor == rule.Actor {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate checks that the rule fields are account names or wildcards and that the effect is known.
+func (rule Rule) validate() error {
+	for _, field := range []string{rule.Actor, rule.Contract, rule.Action} {
+		if field != "" && field != ruleWildcard && !isAccountName(field) {
+			return fmt.Errorf("%s: %q is not a valid name", rule, field)
+		}
+	}
+
+	switch rule.Effect {
+	case "", ruleEffectReject, ruleEffectAllow:
+		return nil
+	default:
+		return fmt.Errorf("%s: effect must be %s or %s", rule, ruleEffectReject, ruleEffectAllow)
+	}
+}
+
+// matchRules returns the first rule that matches the action, evaluating them in order.
+func matchRules(rules []Rule, action Action, actors []string) (Rule, bool) {
+	for _, rule := range rules {
+		if rule.matches(action, actors) {
+			return rule, true
+		}
+	}
+
+	return Rule{}, false
+}
+
+// getActors returns the accounts authorizing the action. The legacy transaction authorizations are
+// not enforced by nodeos and are set freely by the client, so they are not actors of the action.
+func getActors(action Action) []string {
+	actors := []string{}
+	for _, authorization := range action.Authorization {
+		actors = append(actors, authorization.Actor)
+	}
+
+	return actors
+}
+
+// actionBlackListRule translates a "contract::action" entry of actionBlackList into a rejecting rule.
+func actionBlackListRule(entry string) (Rule, error) {
+	contract, name, err := parseActionRule(entry)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	return Rule{Contract: contract, Action: name, Effect: ruleEffectReject}, nil
+}
+
+// contractBlackListRule translates a contractBlackList entry into a rejecting rule.
+func contractBlackListRule(contract string) Rule {
+	return Rule{Contract: contract, Effect: ruleEffectReject, message: "BLACKLISTED_CONTRACT"}
+}
+
+// getRules returns the contractBlackList entries followed by the rules. The blacklist comes first, as the
+// actors of an action are not checked against its signatures here and an allow rule must not exempt a
+// blacklisted contract. An empty or * entry only ever matched a contract of that name and is skipped.
+func getRules(config *Config) []Rule {
+	rules := make([]Rule, 0, len(config.ContractBlackList)+len(config.Rules))
+	for contract := range config.ContractBlackList {
+		if contract != "" && contract != ruleWildcard {
+			rules = append(rules, contractBlackListRule(contract))
+		}
+	}
+
+	return append(rules, config.Rules...)
+}
+
+// rejects reports whether the rule rejects the actions it matches.
+func (rule Rule) rejects() bool {
+	return rule.Effect != ruleEffectAllow
+}
+
+// rulesValidator checks every action against the contractBlackList and then the rules, in order.
+// The first matching rule decides, and actions that no rule matches are accepted.
+type rulesValidator struct{}
+
+func (rulesValidator) Name() string {
+	return "validateRules"
+}
+
+func (rulesValidator) Validate(transactions []Transaction, r *http.Request) error {
+	rules := getRules(getConfig())
+	for i, transaction := range transactions {
+		for j, action := range transaction.getActions() {
+			rule, matched := matchRules(rules, action, getActors(action))
+			if !matched || !rule.rejects() {
+				continue
+			}
+
+			if rule.message != "" {
+				return &ErrorMessage{
+					Message:        batchMessage(r, rule.message, i),
+					Detail:         fmt.Sprintf("action %d of transaction %d uses blacklisted contract %s", j, i, action.Code),
+					OffendingIndex: intPointer(j),
+				}
+			}
+
+			return &ErrorMessage{
+				Message:        batchMessage(r, "BLACKLISTED_RULE:"+rule.String(), i),
+				Detail:         fmt.Sprintf("action %d of transaction %d calls %s::%s", j, i, action.Code, action.Type),
+				OffendingIndex: intPointer(j),
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRules runs rulesValidator as a middleware.
+var validateRules = validatorMiddleware(rulesValidator{})
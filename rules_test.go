@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRuleMatches(t *testing.T) {
+	action := Action{
+		Code:          "eosio.token",
+		Type:          "transfer",
+		Authorization: []Authorization{{Actor: "badguy1", Permission: "active"}},
+	}
+	actors := getActors(action)
+
+	tests := []struct {
+		rule     Rule
+		expected bool
+	}{
+		{Rule{Actor: "badguy1", Contract: "eosio.token", Action: "transfer"}, true},
+		{Rule{Actor: "badguy1"}, true},
+		{Rule{Contract: "eosio.token", Action: "*"}, true},
+		{Rule{Actor: "*", Contract: "*", Action: "*"}, true},
+		{Rule{}, true},
+		{Rule{Actor: "goodguy", Contract: "eosio.token", Action: "transfer"}, false},
+		{Rule{Actor: "badguy1", Contract: "eosio.token", Action: "issue"}, false},
+		{Rule{Actor: "badguy1", Contract: "eosio"}, false},
+	}
+
+	for _, tc := range tests {
+		if matched := tc.rule.matches(action, actors); matched != tc.expected {
+			t.Errorf("Expected %s matching to be %t.", tc.rule, tc.expected)
+		}
+	}
+}
+
+func TestMatchRulesPrecedence(t *testing.T) {
+	transfer := Action{Code: "eosio.token", Type: "transfer", Authorization: []Authorization{{Actor: "badguy1"}}}
+	vote := Action{Code: "eosio", Type: "voteproducer", Authorization: []Authorization{{Actor: "badguy1"}}}
+
+	rules := []Rule{
+		{Actor: "badguy1", Contract: "eosio.token", Action: "transfer", Effect: ruleEffectAllow},
+		{Actor: "badguy1", Effect: ruleEffectReject},
+		{Contract: "eosio.token", Action: "transfer"},
+	}
+
+	rule, matched := matchRules(rules, transfer, getActors(transfer))
+	if !matched || rule != rules[0] {
+		t.Errorf("Expected the first rule to win and got %s.", rule)
+	}
+
+	rule, matched = matchRules(rules, vote, getActors(vote))
+	if !matched || rule != rules[1] {
+		t.Errorf("Expected the actor rule to match and got %s.", rule)
+	}
+
+	if _, matched := matchRules(rules, Action{Code: "eosio", Type: "voteproducer"}, nil); matched {
+		t.Errorf("Expected no rule to match an action by another account.")
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	valid := []Rule{
+		{Actor: "badguy1", Contract: "eosio.token", Action: "transfer"},
+		{Contract: "*", Effect: ruleEffectAllow},
+		{Effect: ruleEffectReject},
+	}
+	for _, rule := range valid {
+		if err := rule.validate(); err != nil {
+			t.Errorf("Expected %s to be valid and got %s.", rule, err)
+		}
+	}
+
+	invalid := []Rule{
+		{Actor: "BadGuy"},
+		{Contract: "eosio.token", Effect: "deny"},
+	}
+	for _, rule := range invalid {
+		if err := rule.validate(); err == nil {
+			t.Errorf("Expected %s to be invalid.", rule)
+		}
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	transfer := func(actor string) []byte {
+		body, _ := json.Marshal(Transaction{
+			Actions: []Action{{Code: "eosio.token", Type: "transfer", Authorization: []Authorization{{Actor: actor, Permission: "active"}}}},
+		})
+		return body
+	}
+
+	tests := []TestStruct{
+		{
+			description:  "blocked actor calling transfer",
+			url:          "/",
+			body:         transfer("badguy1"),
+			expectedBody: "{\"message\":\"BLACKLISTED_RULE:badguy1@eosio.token::transfer\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "other actor calling transfer",
+			url:          "/",
+			body:         transfer("alice"),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "blocked actor calling another action",
+			url:          "/",
+			body:         []byte(`{"actions": [{"account": "eosio", "name": "voteproducer", "authorization": [{"actor": "badguy1", "permission": "active"}]}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "allowed before a wider reject",
+			url:          "/",
+			body:         transfer("bp.monitor"),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "wider reject",
+			url:          "/",
+			body:         []byte(`{"actions": [{"account": "eosio.token", "name": "issue", "authorization": [{"actor": "bp.monitor", "permission": "active"}]}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_RULE:bp.monitor@*::*\",\"code\":403}",
+			expectedCode: 403,
+		},
+	}
+
+	ts := httptest.NewServer(validateRules(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.Rules = []Rule{
+		{Actor: "badguy1", Contract: "eosio.token", Action: "transfer", Effect: ruleEffectReject},
+		{Actor: "bp.monitor", Contract: "eosio.token", Action: "transfer", Effect: ruleEffectAllow},
+		{Actor: "bp.monitor"},
+	}
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	setConfig()
+}
+
+func TestContractBlackListRules(t *testing.T) {
+	transfer := func(actor string) []byte {
+		body, _ := json.Marshal(Transaction{
+			Actions: []Action{{Code: "eosio.token", Type: "transfer", Authorization: []Authorization{{Actor: actor, Permission: "active"}}}},
+		})
+		return body
+	}
+
+	tests := []TestStruct{
+		{
+			description:  "blacklisted contract",
+			url:          "/",
+			body:         transfer("alice"),
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "forged authorization of an allowed actor",
+			url:          "/",
+			body:         transfer("bp.monitor"),
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "forged transaction authorization",
+			url:          "/",
+			body:         []byte(`{"authorizations": [{"actor": "bp.monitor", "permission": "active"}], "actions": [{"account": "eosio.token", "name": "transfer", "authorization": [{"actor": "alice", "permission": "active"}]}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "other contract",
+			url:          "/",
+			body:         []byte(`{"actions": [{"account": "eosio", "name": "voteproducer", "authorization": [{"actor": "bp.monitor", "permission": "active"}]}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	setConfig()
+	config := *getConfig()
+	config.ContractBlackList = map[string]bool{"eosio.token": true}
+	config.Rules = []Rule{
+		{Actor: "bp.monitor", Effect: ruleEffectAllow},
+		{Contract: "eosio.token", Effect: ruleEffectAllow},
+	}
+	storeConfig(config)
+
+	// No allow rule exempts a blacklisted contract, in either middleware
+	for _, mw := range []middleware{validateRules, validateContract} {
+		ts := httptest.NewServer(mw(getTestHandler()))
+		for _, tc := range tests {
+			verifyMiddleware(t, ts, tc)
+		}
+		ts.Close()
+	}
+
+	setConfig()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// asset is an amount of a token, such as 1.0000 EOS. Plain numbers, such as a number of bytes, have no symbol.
+type asset struct {
+	amount    int64
+	precision uint8
+	symbol    string
+}
+
+// parseAsset parses "1.0000 EOS", or a plain number such as "8192".
+func parseAsset(value string) (asset, error) {
+	var parsed asset
+
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return parsed, fmt.Errorf("%q is not a quantity", value)
+	}
+
+	if len(fields) == 2 {
+		parsed.symbol = fields[1]
+		if len(parsed.symbol) > 7 || strings.Trim(parsed.symbol, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return parsed, fmt.Errorf("%q has an invalid symbol", value)
+		}
+	}
+
+	digits := fields[0]
+	if dot := strings.IndexByte(digits, '.'); dot >= 0 {
+		parsed.precision = uint8(len(digits) - dot - 1)
+		digits = digits[:dot] + digits[dot+1:]
+	}
+
+	amount, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || amount < 0 || parsed.precision > 18 || strings.HasPrefix(digits, "+") {
+		return parsed, fmt.Errorf("%q has an invalid amount", value)
+	}
+	parsed.amount = amount
+
+	return parsed, nil
+}
+
+// String formats the asset like nodeos does.
+func (value asset) String() string {
+	amount := strconv.FormatInt(value.amount, 10)
+	if value.precision > 0 {
+		if len(amount) <= int(value.precision) {
+			amount = strings.Repeat("0", int(value.precision)-len(amount)+1) + amount
+		}
+		amount = amount[:len(amount)-int(value.precision)] + "." + amount[len(amount)-int(value.precision):]
+	}
+
+	if value.symbol == "" {
+		return amount
+	}
+	return amount + " " + value.symbol
+}
+
+// scaled returns the amount expressed with the given number of decimals.
+func (value asset) scaled(precision uint8) *big.Int {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(precision)-int64(value.precision)), nil)
+	return new(big.Int).Mul(big.NewInt(value.amount), scale)
+}
+
+// exceeds reports whether the asset is larger than the limit. Assets of another symbol never exceed it.
+func (value asset) exceeds(limit asset) bool {
+	if value.symbol != limit.symbol {
+		return false
+	}
+
+	precision := value.precision
+	if limit.precision > precision {
+		precision = limit.precision
+	}
+
+	return value.scaled(precision).Cmp(limit.scaled(precision)) > 0
+}
+
+// systemAction decodes the amount of a system action that systemActionLimits can bound.
+type systemAction struct {
+	quantity bool // whether the limit is a token quantity rather than a plain number
+	decode   func(data string) (asset, error)
+}
+
+// systemActions are the actions of the eosio system contract that systemActionLimits supports.
+var systemActions = map[string]systemAction{
+	// The number of bytes of RAM bought
+	"eosio::buyrambytes": {decode: func(data string) (asset, error) {
+		var fields struct {
+			Bytes jsonUint32 `json:"bytes"`
+		}
+		err := decodeActionData(data, &fields, func(reader *packedReader) {
+			reader.readName()
+			reader.readName()
+			fields.Bytes = jsonUint32(reader.readUint32())
+		})
+
+		return asset{amount: int64(fields.Bytes)}, err
+	}},
+	// The quantity spent on RAM
+	"eosio::buyram": {quantity: true, decode: func(data string) (asset, error) {
+		var fields struct {
+			Quantity string `json:"quant"`
+		}
+		var quantity asset
+		err := decodeActionData(data, &fields, func(reader *packedReader) {
+			reader.readName()
+			reader.readName()
+			quantity = reader.readAsset()
+		})
+		if err == nil && fields.Quantity != "" {
+			quantity, err = parseAsset(fields.Quantity)
+		}
+
+		return quantity, err
+	}},
+	// The quantity staked for NET and CPU together
+	"eosio::delegatebw": {quantity: true, decode: func(data string) (asset, error) {
+		var fields struct {
+			Net string `json:"stake_net_quantity"`
+			CPU string `json:"stake_cpu_quantity"`
+		}
+		var net, cpu asset
+		err := decodeActionData(data, &fields, func(reader *packedReader) {
+			reader.readName()
+			reader.readName()
+			net = reader.readAsset()
+			cpu = reader.readAsset()
+		})
+		if err == nil && fields.Net != "" {
+			net, err = parseAsset(fields.Net)
+		}
+		if err == nil && fields.CPU != "" {
+			cpu, err = parseAsset(fields.CPU)
+		}
+		if err == nil && (net.symbol != cpu.symbol || net.precision != cpu.precision) {
+			err = errors.New("the NET and CPU quantities have different symbols")
+		}
+
+		return asset{amount: net.amount + cpu.amount, precision: net.precision, symbol: net.symbol}, err
+	}},
+}
+
+// decodeActionData decodes JSON action data into fields, and hex action data with unpack.
+func decodeActionData(data string, fields interface{}, unpack func(reader *packedReader)) error {
+	if strings.HasPrefix(data, "{") {
+		return json.Unmarshal([]byte(data), fields)
+	}
+
+	packed, err := hex.DecodeString(data)
+	if err != nil {
+		return err
+	}
+
+	reader := &packedReader{data: packed}
+	unpack(reader)
+	return reader.err
+}
+
+// readAsset reads an int64 amount followed by a precision and a 7 character symbol.
+func (reader *packedReader) readAsset() asset {
+	amount := int64(reader.readUint64())
+	precision := reader.readUint8()
+	symbol := reader.read(7)
+
+	return asset{amount: amount, precision: precision, symbol: string(bytes.TrimRight(symbol, "\x00"))}
+}
+
+// parseSystemActionLimit checks a systemActionLimits entry and parses its limit.
+func parseSystemActionLimit(name string, limit string) (asset, error) {
+	action, exists := systemActions[name]
+	if !exists {
+		return asset{}, fmt.Errorf("%q is not a supported system action", name)
+	}
+
+	parsed, err := parseAsset(limit)
+	if err != nil {
+		return parsed, err
+	}
+	if action.quantity != (parsed.symbol != "") {
+		if action.quantity {
+			return parsed, fmt.Errorf("the limit of %s must be a quantity such as \"10.0000 EOS\"", name)
+		}
+		return parsed, fmt.Errorf("the limit of %s must be a number", name)
+	}
+
+	return parsed, nil
+}
+
+// validateSystemActions checks that system actions listed in systemActionLimits stay within their limit:
+// the bytes of eosio::buyrambytes, the quantity of eosio::buyram and the NET and CPU stake of eosio::delegatebw.
+// It is skipped if systemActionLimits is not configured.
+func validateSystemActions(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		config := getConfig()
+		if len(config.SystemActionLimits) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		transactions, ctx, err := getTransactions(r)
+		if err != nil {
+			logError(err, w, r)
+			return
+		}
+
+		for i, transaction := range transactions {
+			for j, action := range transaction.getActions() {
+				name := action.Code + "::" + action.Type
+				value, limited := config.SystemActionLimits[name]
+				if !limited {
+					continue
+				}
+
+				limit, err := parseSystemActionLimit(name, value)
+				if err != nil {
+					continue
+				}
+
+				amount, err := systemActions[name].decode(action.Data)
+				if err != nil {
+					logFailureDetails(ErrorMessage{
+						Message:        batchMessage(r, "INVALID_ACTION_DATA", i),
+						Detail:         fmt.Sprintf("the data of action %d of transaction %d is not a valid %s: %s", j, i, name, err),
+						OffendingIndex: intPointer(j),
+					}, w, r, 0)
+					return
+				}
+
+				if amount.exceeds(limit) {
+					logFailureDetails(ErrorMessage{
+						Message:        batchMessage(r, "SYSTEM_ACTION_LIMIT:"+name, i),
+						Detail:         fmt.Sprintf("action %d of transaction %d calls %s with %s, the limit is %s", j, i, name, amount, limit),
+						OffendingIndex: intPointer(j),
+					}, w, r, 0)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func (writer *packedWriter) writeAsset(value asset) {
+	binary.Write(writer, binary.LittleEndian, value.amount)
+	writer.WriteByte(value.precision)
+	symbol := make([]byte, 7)
+	copy(symbol, value.symbol)
+	writer.Write(symbol)
+}
+
+func getSystemActionBody(action string, data string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"actions": []map[string]interface{}{{"account": "eosio", "name": action, "data": json.RawMessage(data)}},
+	})
+	return body
+}
+
+func TestParseAsset(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected asset
+	}{
+		{"1.0000 EOS", asset{amount: 10000, precision: 4, symbol: "EOS"}},
+		{"8192", asset{amount: 8192}},
+		{"0.5 SYS", asset{amount: 5, precision: 1, symbol: "SYS"}},
+	}
+
+	for _, tc := range tests {
+		parsed, err := parseAsset(tc.value)
+		if err != nil || parsed != tc.expected {
+			t.Errorf("Expected %s to parse to %+v and got %+v %v.", tc.value, tc.expected, parsed, err)
+		}
+		if parsed.String() != tc.value {
+			t.Errorf("Expected %s to be formatted back and got %s.", tc.value, parsed)
+		}
+	}
+
+	for _, value := range []string{"", "-1.0000 EOS", "1.0000 eos", "1.0000 EOS EOS", "lots"} {
+		if _, err := parseAsset(value); err == nil {
+			t.Errorf("Expected %q to be rejected.", value)
+		}
+	}
+
+	if !(asset{amount: 100001, precision: 4, symbol: "EOS"}).exceeds(asset{amount: 10, symbol: "EOS"}) {
+		t.Errorf("Expected 10.0001 EOS to exceed 10 EOS.")
+	}
+	if (asset{amount: 100000, precision: 4, symbol: "SYS"}).exceeds(asset{amount: 1, symbol: "EOS"}) {
+		t.Errorf("Expected other symbols not to be compared.")
+	}
+}
+
+func TestValidateSystemActions(t *testing.T) {
+	buyRAMBytes := &packedWriter{}
+	buyRAMBytes.writeName("alice")
+	buyRAMBytes.writeName("alice")
+	binary.Write(buyRAMBytes, binary.LittleEndian, uint32(100000))
+
+	delegateBW := &packedWriter{}
+	delegateBW.writeName("alice")
+	delegateBW.writeName("alice")
+	delegateBW.writeAsset(asset{amount: 60000, precision: 4, symbol: "EOS"})
+	delegateBW.writeAsset(asset{amount: 50000, precision: 4, symbol: "EOS"})
+	delegateBW.WriteByte(0)
+
+	tests := []TestStruct{
+		{
+			description:  "buyrambytes within the limit",
+			url:          "/v1/chain/push_transaction",
+			body:         getSystemActionBody("buyrambytes", `{"payer": "alice", "receiver": "alice", "bytes": 8192}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "buyrambytes over the limit",
+			url:          "/v1/chain/push_transaction",
+			body:         getSystemActionBody("buyrambytes", `{"payer": "alice", "receiver": "alice", "bytes": "8193"}`),
+			expectedBody: "{\"message\":\"SYSTEM_ACTION_LIMIT:eosio::buyrambytes\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "packed buyrambytes over the limit",
+			url:          "/v1/chain/push_transaction",
+			body:         getSystemActionBody("buyrambytes", `"`+hex.EncodeToString(buyRAMBytes.Bytes())+`"`),
+			expectedBody: "{\"message\":\"SYSTEM_ACTION_LIMIT:eosio::buyrambytes\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "buyram within the limit",
+			url:          "/v1/chain/push_transaction",
+			body:         getSystemActionBody("buyram", `{"payer": "alice", "receiver": "alice", "quant": "1.0000 EOS"}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+		{
+			description:  "delegatebw over the limit",
+			url:          "/v1/chain/push_transaction",
+			body:         getSystemActionBody("delegatebw", `{"from": "alice", "receiver": "alice", "stake_net_quantity": "6.0000 EOS", "stake_cpu_quantity": "5.0000 EOS", "transfer": false}`),
+			expectedBody: "{\"message\":\"SYSTEM_ACTION_LIMIT:eosio::delegatebw\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "packed delegatebw over the limit",
+			url:          "/v1/chain/push_transaction",
+			body:         getSystemActionBody("delegatebw", `"`+hex.EncodeToString(delegateBW.Bytes())+`"`),
+			expectedBody: "{\"message\":\"SYSTEM_ACTION_LIMIT:eosio::delegatebw\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "truncated data",
+			url:          "/v1/chain/push_transaction",
+			body:         getSystemActionBody("delegatebw", `"0000"`),
+			expectedBody: "{\"message\":\"INVALID_ACTION_DATA\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "other actions",
+			url:          "/v1/chain/push_transaction",
+			body:         getSystemActionBody("undelegatebw", `{"from": "alice", "receiver": "alice", "unstake_net_quantity": "600.0000 EOS"}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(validateSystemActions(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+
+	// Without systemActionLimits nothing is decoded
+	verifyMiddleware(t, ts, TestStruct{
+		url:          "/v1/chain/push_transaction",
+		body:         getSystemActionBody("buyrambytes", `"0000"`),
+		expectedBody: "SUCCESS\n",
+		expectedCode: 200,
+	})
+
+	config := *getConfig()
+	config.SystemActionLimits = map[string]string{
+		"eosio::buyrambytes": "8192",
+		"eosio::buyram":      "10.0000 EOS",
+		"eosio::delegatebw":  "10.0000 EOS",
+	}
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+}
+
+func TestParseSystemActionLimit(t *testing.T) {
+	if _, err := parseSystemActionLimit("eosio::buyram", "10.0000 EOS"); err != nil {
+		t.Errorf("Expected a quantity limit to be valid and got %s.", err)
+	}
+
+	for name, limit := range map[string]string{
+		"eosio::transfer":    "1",
+		"eosio::buyram":      "10",
+		"eosio::buyrambytes": "10.0000 EOS",
+	} {
+		if _, err := parseSystemActionLimit(name, limit); err == nil {
+			t.Errorf("Expected %s %q to be rejected.", name, limit)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certificateReloadInterval is how often the certificate files are checked for changes.
+const certificateReloadInterval = 30 * time.Second
+
+// certificateReloader serves a certificate loaded from disk and reloads it
+// when the files change, so renewed certificates are used without a restart.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+// newCertificateReloader loads the certificate and key, failing if they are unreadable or do not match.
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	reloader := &certificateReloader{certFile: certFile, keyFile: keyFile}
+
+	_, err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// latestModTime returns the most recent modification time of the certificate and key files.
+func (reloader *certificateReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// reload loads the certificate again if the files changed since the last load
+// and reports whether a new certificate was loaded.
+func (reloader *certificateReloader) reload() (bool, error) {
+	modTime, err := reloader.latestModTime()
+	if err != nil {
+		return false, err
+	}
+
+	reloader.mutex.RLock()
+	unchanged := reloader.certificate != nil && modTime.Equal(reloader.modTime)
+	reloader.mutex.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	reloader.mutex.Lock()
+	reloader.certificate = &certificate
+	reloader.modTime = modTime
+	reloader.mutex.Unlock()
+
+	return true, nil
+}
+
+// watch polls the certificate files and reloads them when they change.
+// A failed reload is logged and the current certificate is kept.
+func (reloader *certificateReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := reloader.reload()
+		if err != nil {
+			log.Printf("Error reloading TLS certificate %s", err)
+		} else if reloaded {
+			log.Printf("Reloaded TLS certificate %s", reloader.certFile)
+		}
+	}
+}
+
+// GetCertificate returns the current certificate for tls.Config.
+func (reloader *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+
+	return reloader.certificate, nil
+}
+
+// GetClientCertificate returns the current certificate for tls.Config, to authenticate to nodeos.
+func (reloader *certificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+
+	return reloader.certificate, nil
+}
+
+// reloadOnHangup reloads the certificates when patroneos receives a SIGHUP, so rotated
+// certificates are used without a restart. A failed reload keeps the current certificate.
+func reloadOnHangup(reloader *certificateReloader) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		reloaded, err := reloader.reload()
+		if err != nil {
+			log.Printf("Error reloading TLS certificate %s", err)
+		} else if reloaded {
+			log.Printf("Reloaded TLS certificate %s", reloader.certFile)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self signed certificate and key for commonName into dir.
+func writeTestCertificate(t *testing.T, dir string, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("There should not be an error generating a key: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{commonName},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("There should not be an error creating a certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("There should not be an error marshalling a key: %s", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+func getCommonName(t *testing.T, reloader *certificateReloader) string {
+	certificate, _ := reloader.GetCertificate(nil)
+
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("There should not be an error parsing the certificate: %s", err)
+	}
+
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "patroneos-tls")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir, "first.example.com")
+
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("There should not be an error loading the certificate: %s", err)
+	}
+
+	if name := getCommonName(t, reloader); name != "first.example.com" {
+		t.Errorf("Expected the first certificate and got %s.", name)
+	}
+
+	writeTestCertificate(t, dir, "second.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	reloaded, err := reloader.reload()
+	if err != nil || !reloaded {
+		t.Fatalf("Expected the certificate to be reloaded and got %t %v.", reloaded, err)
+	}
+
+	if name := getCommonName(t, reloader); name != "second.example.com" {
+		t.Errorf("Expected the renewed certificate and got %s.", name)
+	}
+
+	// A broken renewal keeps the current certificate
+	ioutil.WriteFile(keyFile, []byte("not a key"), 0600)
+	later := future.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+
+	if _, err := reloader.reload(); err == nil {
+		t.Errorf("Expected an error reloading a mismatched key.")
+	}
+
+	if name := getCommonName(t, reloader); name != "second.example.com" {
+		t.Errorf("Expected the current certificate to be kept and got %s.", name)
+	}
+}
+
+func TestValidateConfigTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "patroneos-tls")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir, "localhost")
+
+	config := getValidConfig()
+	config.TLSCertFile = certFile
+	config.TLSKeyFile = keyFile
+	if errs := validateConfig(config, "filter"); len(errs) != 0 {
+		t.Errorf("Expected the TLS config to be valid and got %v.", errs)
+	}
+
+	config.TLSKeyFile = ""
+	if errs := validateConfig(config, "filter"); len(errs) != 1 {
+		t.Errorf("Expected a certificate without a key to be invalid.")
+	}
+
+	config.TLSKeyFile = filepath.Join(dir, "missing.pem")
+	if errs := validateConfig(config, "filter"); len(errs) != 1 {
+		t.Errorf("Expected an unreadable key to be invalid.")
+	}
+}
+
+func TestValidateConfigNodeosClientCertificate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "patroneos-tls")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir, "patroneos")
+
+	config := getValidConfig()
+	config.NodeosClientCertFile = certFile
+	config.NodeosClientKeyFile = keyFile
+	if errs := validateConfig(config, "filter"); len(errs) != 0 {
+		t.Errorf("Expected the client certificate to be valid and got %v.", errs)
+	}
+
+	config.NodeosClientKeyFile = ""
+	if errs := validateConfig(config, "filter"); len(errs) != 1 {
+		t.Errorf("Expected a client certificate without a key to be invalid.")
+	}
+
+	config.NodeosClientKeyFile = filepath.Join(dir, "missing.pem")
+	if errs := validateConfig(config, "filter"); len(errs) != 1 {
+		t.Errorf("Expected an unreadable client key to be invalid.")
+	}
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultUpstreamRetryBackoffMs is the delay before the first retry when upstreamRetryBackoffMs is not set.
+	defaultUpstreamRetryBackoffMs = 100
+	// maxUpstreamRetries bounds upstreamRetries.
+	maxUpstreamRetries = 10
+	// maxUpstreamRetryBackoff bounds the delay before a retry, before jitter.
+	maxUpstreamRetryBackoff = 10 * time.Second
+	// defaultHealthCheckSeconds is the interval between upstream health checks when healthCheckSeconds is not set.
+	defaultHealthCheckSeconds = 5
+	// defaultUpstreamMaxIdleConns is the number of idle connections kept to every upstream when upstreamMaxIdleConnsPerHost is not set.
+	// The http.Transport default of 2 makes patroneos open a new connection to nodeos for most requests under load.
+	defaultUpstreamMaxIdleConns = 100
+	// defaultUpstreamIdleConnSeconds is how long idle connections are kept when upstreamIdleTimeoutSeconds is not set.
+	defaultUpstreamIdleConnSeconds = 90
+	// unixSocketHost is the host of the upstream URL when nodeosProtocol is unix. Connections to it are
+	// dialed to the nodeosUrl socket instead.
+	unixSocketHost = "nodeos.sock"
+	// healthCheckPath is requested on every upstream to check that it is serving.
+	healthCheckPath = "/v1/chain/get_info"
+)
+
+var errNoHealthyUpstream = errors.New("no healthy upstream")
+
+// errUpstreamBusy is returned when maxUpstreamConcurrency requests are already waiting for nodeos.
+var errUpstreamBusy = errors.New("maxUpstreamConcurrency requests are already in flight")
+
+// errUpstreamUnauthorized is returned when nodeos, or the proxy in front of it, refuses the credentials of patroneos.
+var errUpstreamUnauthorized = errors.New("nodeos answered 401 Unauthorized, check nodeosBasicAuthUser and nodeosBasicAuthPassword")
+
+// errResponseTooLarge is returned when a nodeos response is larger than maxResponseBytes.
+var errResponseTooLarge = errors.New("the response is larger than maxResponseBytes")
+
+// UpstreamStatus is the health of a nodeos upstream, as returned by GET /patroneos/upstreams
+type UpstreamStatus struct {
+	URL         string    `json:"url"`
+	Healthy     bool      `json:"healthy"`
+	LastChecked time.Time `json:"lastChecked,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+	Requests    int64     `json:"requests"`
+	// Weight is the share of the requests the upstream gets, 0 while it is down
+	Weight int `json:"weight"`
+
+	// current is the smooth weighted round-robin counter of the upstream
+	current int
+}
+
+// upstreamPool tracks the health of the upstreams and picks the next one with a smooth weighted round-robin,
+// so each upstream gets its share of upstreamWeights spread evenly. Upstreams that were never checked are considered healthy.
+type upstreamPool struct {
+	mutex  sync.Mutex
+	status map[string]*UpstreamStatus
+}
+
+var upstreams = upstreamPool{status: map[string]*UpstreamStatus{}}
+
+// newUpstreamTransport returns the transport used to reach nodeos, with the connection pool sized by the upstream settings.
+// HTTPS upstreams are verified against nodeosCAFile when it is set, instead of the system certificates.
+func newUpstreamTransport(config *Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.NodeosTLSInsecureSkipVerify}
+	if config.NodeosCAFile != "" {
+		pem, err := ioutil.ReadFile(config.NodeosCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s contains no PEM certificates", config.NodeosCAFile)
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+
+	transport.MaxIdleConnsPerHost = config.UpstreamMaxIdleConnsPerHost
+	if transport.MaxIdleConnsPerHost <= 0 {
+		transport.MaxIdleConnsPerHost = defaultUpstreamMaxIdleConns
+	}
+
+	// Enough idle connections for every upstream to keep its share
+	transport.MaxIdleConns = config.UpstreamMaxIdleConns
+	if transport.MaxIdleConns <= 0 {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost * len(getAllUpstreams(config))
+	}
+
+	transport.IdleConnTimeout = time.Duration(config.UpstreamIdleTimeoutSeconds) * time.Second
+	if transport.IdleConnTimeout <= 0 {
+		transport.IdleConnTimeout = defaultUpstreamIdleConnSeconds * time.Second
+	}
+
+	if config.NodeosProtocol == "unix" {
+		socket := config.NodeosURL
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			if address == net.JoinHostPort(unixSocketHost, "80") {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			}
+			// The log relays share the transport
+			return dial(ctx, network, address)
+		}
+	}
+
+	// Responses are relayed as nodeos encoded them, for the encodings the client accepts
+	transport.DisableCompression = true
+
+	proxy, err := getUpstreamProxy(config)
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = proxy
+
+	transport.MaxConnsPerHost = config.UpstreamMaxConnsPerHost
+	transport.DisableKeepAlives = config.UpstreamDisableKeepAlives
+
+	return transport, nil
+}
+
+// parseProxyURL parses upstreamProxyUrl, which must be an http, https or socks5 URL.
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	parsed, err := url.Parse(proxyURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https" && parsed.Scheme != "socks5") || parsed.Host == "" {
+		return nil, fmt.Errorf("upstreamProxyUrl: %q must be an http, https or socks5 URL, or none", proxyURL)
+	}
+
+	return parsed, nil
+}
+
+// getUpstreamProxy returns the Proxy function of the transport. An empty upstreamProxyUrl uses the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, and "none" connects directly.
+// Hosts matching noProxy and the unix socket are always connected to directly.
+func getUpstreamProxy(config *Config) (func(*http.Request) (*url.URL, error), error) {
+	proxy := http.ProxyFromEnvironment
+	switch config.UpstreamProxyURL {
+	case "":
+	case "none":
+		return nil, nil
+	default:
+		proxyURL, err := parseProxyURL(config.UpstreamProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	noProxy := config.NoProxy
+	unix := config.NodeosProtocol == "unix"
+	return func(request *http.Request) (*url.URL, error) {
+		host := request.URL.Hostname()
+		if (unix && host == unixSocketHost) || matchNoProxy(noProxy, host) {
+			return nil, nil
+		}
+
+		return proxy(request)
+	}, nil
+}
+
+// matchNoProxy reports whether a host is exempt from the proxy by noProxy. Entries are host names, which
+// also match their subdomains, IP addresses or CIDRs, or "*" for every host.
+func matchNoProxy(noProxy []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(entry), "."))
+		if entry == "*" || entry == host || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil && ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getUpstreams returns the base URLs of the nodeos upstreams: nodeosUpstreams when it is set,
+// otherwise nodeosUpstream, otherwise the URL made of nodeosProtocol, nodeosUrl and nodeosPort,
+// or the unixSocketHost URL for a unix socket.
+func getUpstreams(config *Config) []string {
+	if len(config.NodeosUpstreams) > 0 {
+		return config.NodeosUpstreams
+	}
+	if config.NodeosUpstream != "" {
+		return []string{config.NodeosUpstream}
+	}
+
+	if config.NodeosProtocol == "unix" {
+		return []string{"http://" + unixSocketHost}
+	}
+
+	return []string{fmt.Sprintf("%s://%s:%s", config.NodeosProtocol, config.NodeosURL, config.NodeosPort)}
+}
+
+// getAllUpstreams returns the default upstreams followed by the namedUpstreams that routes can send requests to,
+// sorted by name. Each URL is listed once.
+func getAllUpstreams(config *Config) []string {
+	all := append([]string{}, getUpstreams(config)...)
+
+	names := make([]string, 0, len(config.NamedUpstreams))
+	for name := range config.NamedUpstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		listed := false
+		for _, upstream := range all {
+			listed = listed || upstream == config.NamedUpstreams[name]
+		}
+		if !listed {
+			all = append(all, config.NamedUpstreams[name])
+		}
+	}
+
+	return all
+}
+
+// getRouteUpstreams returns the upstreams a request can be sent to: the named upstream of the longest
+// prefix in routes that matches its path, or the default upstreams when none matches.
+func getRouteUpstreams(config *Config, r *http.Request) []string {
+	requestPath := path.Clean("/" + r.URL.Path)
+	target := ""
+	longest := -1
+
+	for prefix, name := range config.Routes {
+		trimmed := strings.TrimSuffix(prefix, "*")
+		if strings.HasPrefix(requestPath, trimmed) && len(trimmed) > longest {
+			target = name
+			longest = len(trimmed)
+		}
+	}
+
+	if target == "" {
+		return getUpstreams(config)
+	}
+
+	return []string{config.NamedUpstreams[target]}
+}
+
+// checkUnixSocket reports whether the nodeosUrl socket can be connected to when nodeosProtocol is unix.
+func checkUnixSocket(config *Config) error {
+	if config.NodeosProtocol != "unix" {
+		return nil
+	}
+
+	connection, err := net.DialTimeout("unix", config.NodeosURL, 3*time.Second)
+	if err != nil {
+		return err
+	}
+
+	return connection.Close()
+}
+
+// getHealthCheckInterval returns healthCheckSeconds as a duration.
+func getHealthCheckInterval(config *Config) time.Duration {
+	if config.HealthCheckSeconds <= 0 {
+		return defaultHealthCheckSeconds * time.Second
+	}
+
+	return time.Duration(config.HealthCheckSeconds) * time.Second
+}
+
+// getStatus returns the status of an upstream, creating it if needed. The mutex must be held.
+func (pool *upstreamPool) getStatus(upstream string) *UpstreamStatus {
+	status, exists := pool.status[upstream]
+	if !exists {
+		status = &UpstreamStatus{URL: upstream, Healthy: true}
+		pool.status[upstream] = status
+	}
+
+	return status
+}
+
+// getUpstreamWeight returns the weight of an upstream in upstreamWeights, 1 when it is not listed.
+func getUpstreamWeight(config *Config, upstream string) int {
+	if weight, exists := config.UpstreamWeights[upstream]; exists {
+		return weight
+	}
+
+	return 1
+}
+
+// pick returns the next healthy upstream of the candidates, or errNoHealthyUpstream when they are all down.
+// Each healthy upstream gains its weight, and the one with the most is picked and loses the total.
+func (pool *upstreamPool) pick(config *Config, candidates []string) (string, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	var picked *UpstreamStatus
+	total := 0
+	for _, upstream := range candidates {
+		status := pool.getStatus(upstream)
+		weight := getUpstreamWeight(config, upstream)
+		if !status.Healthy || weight <= 0 {
+			continue
+		}
+
+		status.current += weight
+		total += weight
+		if picked == nil || status.current > picked.current {
+			picked = status
+		}
+	}
+	if picked == nil {
+		return "", errNoHealthyUpstream
+	}
+
+	picked.current -= total
+	picked.Requests++
+
+	return picked.URL, nil
+}
+
+// setHealth records the result of a health check.
+func (pool *upstreamPool) setHealth(upstream string, err error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	status := pool.getStatus(upstream)
+	if status.Healthy != (err == nil) {
+		if err != nil {
+			log.Printf("Upstream %s is down: %s", upstream, err)
+		} else {
+			log.Printf("Upstream %s is back up", upstream)
+		}
+	}
+
+	status.Healthy = err == nil
+	if !status.Healthy {
+		// It starts over with its share when it comes back
+		status.current = 0
+	}
+	status.LastChecked = time.Now().UTC()
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+	}
+}
+
+// getStatuses returns the status of the configured upstreams, in the order of getAllUpstreams.
+func (pool *upstreamPool) getStatuses(config *Config) []UpstreamStatus {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	statuses := []UpstreamStatus{}
+	for _, upstream := range getAllUpstreams(config) {
+		status := *pool.getStatus(upstream)
+		if status.Healthy {
+			status.Weight = getUpstreamWeight(config, upstream)
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// checkUpstream requests get_info from an upstream, failing if it does not answer 200 within the timeout.
+func checkUpstream(upstream string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	config := getConfig()
+	request, err := http.NewRequest("GET", getUpstreamURL(config, upstream, &url.URL{Path: healthCheckPath}), nil)
+	if err != nil {
+		return err
+	}
+	setUpstreamAuth(config, request)
+
+	res, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", healthCheckPath, res.StatusCode)
+	}
+
+	return nil
+}
+
+// checkUpstreams checks every configured upstream once, in parallel.
+func checkUpstreams(config *Config) {
+	var wait sync.WaitGroup
+	for _, upstream := range getAllUpstreams(config) {
+		wait.Add(1)
+		go func(upstream string) {
+			defer wait.Done()
+			upstreams.setHealth(upstream, checkUpstream(upstream, getHealthCheckInterval(config)))
+		}(upstream)
+	}
+	wait.Wait()
+}
+
+// watchUpstreams checks the upstreams every healthCheckSeconds, taking those that fail out of rotation until they recover.
+func watchUpstreams() {
+	for {
+		config := getConfig()
+		checkUpstreams(config)
+		time.Sleep(getHealthCheckInterval(config))
+	}
+}
+
+// lookupHost resolves the host names of the upstreams.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// resolveUpstreams returns the sorted addresses each upstream host name resolves to. IP addresses and the
+// unix socket are left out, as are names that fail to resolve so a DNS hiccup does not drop connections.
+func resolveUpstreams(config *Config) map[string]string {
+	resolved := map[string]string{}
+	for _, upstream := range getAllUpstreams(config) {
+		parsed, err := url.Parse(upstream)
+		if err != nil {
+			continue
+		}
+
+		host := parsed.Hostname()
+		if net.ParseIP(host) != nil || (config.NodeosProtocol == "unix" && host == unixSocketHost) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		addresses, err := lookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			log.Printf("Error resolving upstream %s %s", host, err)
+			continue
+		}
+
+		sort.Strings(addresses)
+		resolved[host] = strings.Join(addresses, ", ")
+	}
+
+	return resolved
+}
+
+// refreshUpstreamDNS resolves the upstreams again and reports whether a name now points to other addresses
+// than in previous. Names that failed to resolve keep their previous addresses.
+func refreshUpstreamDNS(config *Config, previous map[string]string) (map[string]string, bool) {
+	resolved := resolveUpstreams(config)
+
+	changed := false
+	for host, addresses := range resolved {
+		if known, exists := previous[host]; exists && known != addresses {
+			log.Printf("Upstream %s now resolves to %s instead of %s", host, addresses, known)
+			changed = true
+		}
+	}
+
+	for host, addresses := range previous {
+		if _, exists := resolved[host]; !exists {
+			resolved[host] = addresses
+		}
+	}
+
+	return resolved, changed
+}
+
+// watchUpstreamDNS resolves the upstreams every interval and closes the idle connections when an address
+// changed, so requests stop going to the old addresses after a failover. Connections that were busy are
+// closed on the next pass, once they are back in the pool.
+func watchUpstreamDNS(interval time.Duration) {
+	resolved := resolveUpstreams(getConfig())
+	closeAgain := false
+
+	for {
+		time.Sleep(interval)
+
+		var changed bool
+		resolved, changed = refreshUpstreamDNS(getConfig(), resolved)
+		if changed || closeAgain {
+			client.CloseIdleConnections()
+		}
+		closeAgain = changed
+	}
+}
+
+// setForwardedHeaders tells nodeos who the client is. The address of the connection is appended to
+// X-Forwarded-For, X-Real-IP is set to the client found by getHost and X-Forwarded-Proto to its scheme. The headers sent by the client are only
+// kept when it is one of the trustedProxies, otherwise the chain starts again from the connection.
+func setForwardedHeaders(headers http.Header, r *http.Request) {
+	peer := stripPort(r.RemoteAddr)
+	forwardedFor := peer
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	if isTrustedProxy(r) {
+		if chain := strings.Join(r.Header["X-Forwarded-For"], ", "); chain != "" {
+			forwardedFor = chain + ", " + peer
+		}
+		if forwardedProto := r.Header.Get("X-Forwarded-Proto"); forwardedProto != "" {
+			proto = forwardedProto
+		}
+	}
+
+	headers.Set("X-Forwarded-For", forwardedFor)
+	headers.Set("X-Real-IP", getHost(r))
+	headers.Set("X-Forwarded-Proto", proto)
+}
+
+// getNodeosURL returns the URL of a request on the first upstream.
+func getNodeosURL(config *Config, requestURL *url.URL) string {
+	return getUpstreamURL(config, getUpstreams(config)[0], requestURL)
+}
+
+// escapePathPrefix returns a nodeosPathPrefix or stripPathPrefix as an escaped path with a leading
+// slash and no trailing slash, or "" when it is empty.
+func escapePathPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+
+	return (&url.URL{Path: "/" + prefix}).EscapedPath()
+}
+
+// getUpstreamPath returns the escaped path to request from nodeos: the request path without
+// stripPathPrefix, under nodeosPathPrefix. The escaping of the request path is kept as sent by the client.
+func getUpstreamPath(config *Config, requestURL *url.URL) string {
+	requestPath := requestURL.EscapedPath()
+
+	if strip := escapePathPrefix(config.StripPathPrefix); strip != "" {
+		if requestPath == strip || strings.HasPrefix(requestPath, strip+"/") {
+			requestPath = requestPath[len(strip):]
+		}
+	}
+
+	return escapePathPrefix(config.NodeosPathPrefix) + "/" + strings.TrimPrefix(requestPath, "/")
+}
+
+// getUpstreamURL returns the URL of a request on an upstream. Any path the
+// upstream contains is used as a prefix for the request path.
+func getUpstreamURL(config *Config, upstream string, requestURL *url.URL) string {
+	nodeosURL := strings.TrimSuffix(upstream, "/") + getUpstreamPath(config, requestURL)
+	if requestURL.RawQuery != "" {
+		nodeosURL += "?" + requestURL.RawQuery
+	}
+
+	return nodeosURL
+}
+
+// setUpstreamAuth sets the credentials of nodeosBasicAuthUser on a request to nodeos.
+// They replace any Authorization header sent by the client.
+func setUpstreamAuth(config *Config, request *http.Request) {
+	if config.NodeosBasicAuthUser != "" {
+		request.SetBasicAuth(config.NodeosBasicAuthUser, config.NodeosBasicAuthPassword)
+	}
+}
+
+// isRetrySafe reports whether the request can be sent to nodeos again after a failure: GET and HEAD requests,
+// and POST requests to the upstreamRetryPaths prefixes. The push endpoints are never retried, since the
+// first attempt may have been applied.
+func isRetrySafe(config *Config, r *http.Request) bool {
+	if isPushEndpoint(r) {
+		return false
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		return true
+	case "POST":
+		return matchPathPrefix(config.UpstreamRetryPaths, path.Clean("/"+r.URL.Path))
+	}
+
+	return false
+}
+
+// getRetryBackoff returns how long to wait before the given retry, doubling from upstreamRetryBackoffMs
+// with up to 50% of jitter either way so clients retrying together do not hit nodeos at once.
+func getRetryBackoff(config *Config, retry int) time.Duration {
+	backoff := config.UpstreamRetryBackoffMs
+	if backoff <= 0 {
+		backoff = defaultUpstreamRetryBackoffMs
+	}
+
+	// Doubling stops at maxUpstreamRetryBackoff so the delay cannot overflow
+	delay := time.Duration(backoff) * time.Millisecond
+	for i := 0; i < retry && delay > 0 && delay < maxUpstreamRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay <= 0 || delay > maxUpstreamRetryBackoff {
+		delay = maxUpstreamRetryBackoff
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)))
+}
+
+// doUpstreamRequest sends the request to the next healthy upstream with the given body. Retry-safe requests are
+// attempted again up to upstreamRetries times when nodeos cannot be reached, moving on to the next upstream each time.
+func doUpstreamRequest(config *Config, r *http.Request, body []byte) (*http.Response, error) {
+	retries := 0
+	if isRetrySafe(config, r) {
+		retries = config.UpstreamRetries
+	}
+
+	// A route only uses its own upstream, even when it is down
+	candidates := getRouteUpstreams(config, r)
+
+	for retry := 0; ; retry++ {
+		upstream, err := upstreams.pick(config, candidates)
+		if err != nil {
+			return nil, err
+		}
+
+		// The request to nodeos is cancelled if the client goes away
+		request, err := http.NewRequestWithContext(r.Context(), r.Method, getUpstreamURL(config, upstream, r.URL), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		// Forward headers to nodeos
+		request.Header = make(http.Header)
+		copyHeaders(request.Header, r.Header)
+		setForwardedHeaders(request.Header, r)
+		if id := getRequestID(r); id != "" {
+			request.Header.Set(requestIDHeader, id)
+		}
+		if config.PreserveHostHeader {
+			request.Host = r.Host
+		}
+		setUpstreamAuth(config, request)
+
+		release, err := acquireUpstreamSlot(config)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := client.Do(request)
+		if err != nil {
+			release()
+		} else {
+			res.Body = &releasingBody{ReadCloser: res.Body, release: release}
+		}
+
+		if err == nil || retry >= retries || r.Context().Err() != nil {
+			return res, err
+		}
+
+		timer := time.NewTimer(getRetryBackoff(config, retry))
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Validator is a check on the transactions of a request. Validators are run by validatorMiddleware
+// and can be added to filterEndpoints by name once registered with RegisterValidator.
+// The built-in checks of every request's transactions are validators. Checks that skip some endpoints
+// or configurations before the body is parsed, such as validateExpiration, remain plain middleware.
+//
+// Validate returns nil to accept the request. Any other error rejects it, with the error message
+// as the failure; an *ErrorMessage can be returned to include details and a status code.
+type Validator interface {
+	Name() string
+	Validate(transactions []Transaction, r *http.Request) error
+}
+
+// RegisterValidator makes the validator available in filterEndpoints under its name.
+// It is meant to be called from an init function, and panics if the name is already in use.
+func RegisterValidator(validator Validator) {
+	name := validator.Name()
+	if _, exists := filterMiddlewares[name]; exists {
+		panic(fmt.Sprintf("patroneos: middleware %q is already registered", name))
+	}
+
+	filterMiddlewares[name] = validatorMiddleware(validator)
+}
+
+// validatorMiddleware runs the validator on the transactions of the request, logging its
+// error as a failure.
+func validatorMiddleware(validator Validator) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+
+			transactions, ctx, err := getTransactions(r)
+			if err != nil {
+				logError(err, w, r)
+				return
+			}
+
+			err = validator.Validate(transactions, r.WithContext(ctx))
+			if err != nil {
+				logError(err, w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+	}
+}
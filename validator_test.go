@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// memoValidator rejects transactions with a memo action, like a chain specific check would.
+type memoValidator struct{}
+
+func (memoValidator) Name() string {
+	return "validateNoMemo"
+}
+
+func (memoValidator) Validate(transactions []Transaction, r *http.Request) error {
+	for _, transaction := range transactions {
+		for _, action := range transaction.getActions() {
+			if action.Type == "memo" {
+				return errors.New("MEMO_NOT_ALLOWED")
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestRegisterValidator(t *testing.T) {
+	RegisterValidator(memoValidator{})
+	defer delete(filterMiddlewares, memoValidator{}.Name())
+
+	tests := []TestStruct{
+		{
+			description:  "rejected by the custom validator",
+			url:          "/",
+			body:         []byte(`{"actions": [{"account": "tokens", "name": "memo"}]}`),
+			expectedBody: "{\"message\":\"MEMO_NOT_ALLOWED\",\"code\":400}",
+			expectedCode: 400,
+		},
+		{
+			description:  "rejected by a built in validator",
+			url:          "/",
+			body:         []byte(`{"actions": [{"account": "currency", "name": "transfer"}]}`),
+			expectedBody: "{\"message\":\"BLACKLISTED_CONTRACT\",\"code\":403}",
+			expectedCode: 403,
+		},
+		{
+			description:  "accepted",
+			url:          "/",
+			body:         []byte(`{"actions": [{"account": "tokens", "name": "transfer"}]}`),
+			expectedBody: "SUCCESS\n",
+			expectedCode: 200,
+		},
+	}
+
+	ts := httptest.NewServer(configuredMiddleware(getTestHandler()))
+	defer ts.Close()
+
+	setConfig()
+	config := *getConfig()
+	config.FilterEndpoints = []string{"validateJSON", "validateNoMemo", "validateContract"}
+	storeConfig(config)
+
+	for _, tc := range tests {
+		verifyMiddleware(t, ts, tc)
+	}
+
+	setConfig()
+}
+
+func TestRegisterValidatorDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering a name twice to panic.")
+		}
+	}()
+
+	RegisterValidator(maxTransactionsValidator{})
+}